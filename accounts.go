@@ -0,0 +1,496 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Accounts
+//
+// Every visitor is a user, identified by a signed session cookie. A new visitor gets an anonymous user
+// with a numbered name. Registering (with a unique display name and an email address) turns the
+// browser's anonymous user into an account, so its play history is kept. There are no passwords:
+// to log in, a user follows a one-time link sent to their email (printed to the log if no mail server
+// is configured). Logging in from a browser whose anonymous user has played claims that history for
+// the account.
+
+const (
+	sessionCookie   = "session"
+	sessionLifetime = 365 * 24 * time.Hour
+	loginTokenTTL   = 15 * time.Minute
+)
+
+// user key indexes
+const (
+	nameIndex  = "name"
+	emailIndex = "email"
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]{2,19}$`) // can't collide with anonymous (numbered) names
+
+// signs session cookies; set from SESSION_SECRET (which all instances must share)
+var sessionSecret []byte
+
+type User struct {
+	ID        string
+	Name      string
+	Email     string   // "" for anonymous users
+	Created   int64    // unix nano
+	Bot       bool     // played by a program (see bots.go)
+	Owner     string   // for a bot, the id of the user who created it
+	TokenHash string   // for a bot, hash of its API token
+	Bots      []string // ids of the user's bots
+}
+
+func (u *User) Registered() bool {
+	return u.Email != ""
+}
+
+// emailed as a one-time link
+type Login struct {
+	Email string
+	Name  string // "" unless registering
+}
+
+var errNameTaken = errors.New("That name is taken.")
+
+func initSessionSecret() {
+	if secret := os.Getenv("SESSION_SECRET"); secret != "" {
+		sessionSecret = []byte(secret)
+		return
+	}
+	logger.Warn("SESSION_SECRET not set: using a random secret, so sessions will not survive a restart")
+	sessionSecret = make([]byte, 32)
+	if _, err := rand.Read(sessionSecret); err != nil {
+		panic(err)
+	}
+}
+
+func sessionSignature(payload string) string {
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// "<user id>.<expiry unix seconds>.<signature>"
+func signSession(userID string, expiry time.Time) string {
+	payload := userID + "." + strconv.FormatInt(expiry.Unix(), 10)
+	return payload + "." + sessionSignature(payload)
+}
+
+// returns user id and expiry of a valid session ("" if invalid or expired)
+func verifySession(value string) (string, time.Time) {
+	i := strings.LastIndex(value, ".")
+	if i == -1 {
+		return "", time.Time{}
+	}
+	payload, signature := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(sessionSignature(payload))) {
+		return "", time.Time{}
+	}
+	parts := strings.Split(payload, ".")
+	if len(parts) != 2 {
+		return "", time.Time{}
+	}
+	seconds, err := strconv.ParseInt(parts[1], 10, 64)
+	expiry := time.Unix(seconds, 0)
+	if err != nil || time.Now().After(expiry) {
+		return "", time.Time{}
+	}
+	return parts[0], expiry
+}
+
+func secureRequest(c *gin.Context) bool {
+	return c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+}
+
+func setSession(c *gin.Context, userID string) {
+	expiry := time.Now().Add(sessionLifetime)
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    signSession(userID, expiry),
+		Path:     "/",
+		Expires:  expiry,
+		MaxAge:   int(sessionLifetime / time.Second),
+		Secure:   secureRequest(c),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSession(c *gin.Context) {
+	c.SetCookie(sessionCookie, "", -1, "/", "", secureRequest(c), true)
+}
+
+// nil if no such user
+func (cl *Cluster) loadUser(userID string) (*User, error) {
+	bytes, err := cl.Store.LoadUser(userID)
+	if err != nil || bytes == nil {
+		return nil, err
+	}
+	user := &User{}
+	if err := json.Unmarshal(bytes, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (cl *Cluster) saveUser(user *User) error {
+	bytes, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return cl.Store.SaveUser(user.ID, bytes)
+}
+
+func (cl *Cluster) newAnonymousUser() (*User, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	userNumber, err := cl.Store.NextUserNumber() // used for default user names
+	if err != nil {
+		return nil, err
+	}
+	user := &User{
+		ID:      id.String(),
+		Name:    strconv.FormatInt(userNumber, 10),
+		Created: time.Now().UnixNano(),
+	}
+	if err := cl.saveUser(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// user of the request's session (a new anonymous user if the request has no valid session)
+func (cl *Cluster) currentUser(c *gin.Context) (*User, error) {
+	// (a request bearing a bot's API token is made as the bot; see authenticateBot)
+	if bot, ok := c.Get(botUserKey); ok {
+		return bot.(*User), nil
+	}
+	if value, err := c.Cookie(sessionCookie); err == nil {
+		if userID, expiry := verifySession(value); userID != "" {
+			user, err := cl.loadUser(userID)
+			if err != nil {
+				return nil, err
+			}
+			if user != nil {
+				if time.Until(expiry) < sessionLifetime/2 {
+					setSession(c, user.ID)
+				}
+				return user, nil
+			}
+		}
+	}
+	user, err := cl.newAnonymousUser()
+	if err != nil {
+		return nil, err
+	}
+	setSession(c, user.ID)
+	return user, nil
+}
+
+func normalizeEmail(address string) (string, error) {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", errors.New("Invalid email address.")
+	}
+	return strings.ToLower(parsed.Address), nil
+}
+
+// email a one-time login link
+func (cl *Cluster) sendLoginLink(c *gin.Context, login Login) error {
+	token, err := uuid.NewV4()
+	if err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(login)
+	if err != nil {
+		return err
+	}
+	if err := cl.Store.SaveLoginToken(token.String(), bytes, loginTokenTTL); err != nil {
+		return err
+	}
+	// the request's Host can't be trusted to build a link to mail someone (except in dev)
+	baseURL := os.Getenv("BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://" + c.Request.Host
+	}
+	link := strings.TrimSuffix(baseURL, "/") + "/login/" + token.String()
+	return sendMail(login.Email, "Log in to Chrss",
+		"Follow this link to log in (it works once and expires in "+loginTokenTTL.String()+"):\r\n\r\n"+link+"\r\n")
+}
+
+// sends through SMTP_ADDR (host:port) as SMTP_FROM, authenticating with SMTP_USER and SMTP_PASSWORD if set
+// (without SMTP_ADDR, as in dev, the mail is printed to the log)
+func sendMail(to string, subject string, body string) error {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		logger.Info("mail (not sent: SMTP_ADDR not set)", "to", to, "subject", subject, "body", body)
+		return nil
+	}
+	from := os.Getenv("SMTP_FROM")
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USER"); user != "" {
+		host := strings.Split(addr, ":")[0]
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	msg := "From: " + from + "\r\nTo: " + to + "\r\nSubject: " + subject + "\r\n\r\n" + body
+	return smtp.SendMail(addr, auth, from, []string{to}, []byte(msg))
+}
+
+// start registering the anonymous user as an account (completed when they follow the emailed link)
+func (cl *Cluster) requestRegistration(c *gin.Context, name string, email string) error {
+	if !validName.MatchString(name) {
+		return errors.New("Names are 3 to 20 letters, digits, '-' or '_', starting with a letter.")
+	}
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return err
+	}
+	owner, err := cl.Store.LookupUserKey(nameIndex, strings.ToLower(name))
+	if err != nil {
+		return err
+	}
+	if owner != "" {
+		return errNameTaken
+	}
+	// don't reveal whether the email has an account: if it does, the link just logs in
+	return cl.sendLoginLink(c, Login{Email: email, Name: name})
+}
+
+func (cl *Cluster) requestLogin(c *gin.Context, email string) error {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return err
+	}
+	userID, err := cl.Store.LookupUserKey(emailIndex, email)
+	if err != nil || userID == "" {
+		return err
+	}
+	return cl.sendLoginLink(c, Login{Email: email})
+}
+
+// complete a login or registration with the token from an emailed link
+// The browser following the link is the one logged in, and its anonymous user is the one registered or
+// whose history is claimed (so a link requested from another browser can't take over this one's history).
+func (cl *Cluster) completeLogin(c *gin.Context, token string) (*User, error) {
+	bytes, err := cl.Store.TakeLoginToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if bytes == nil {
+		return nil, errors.New("This login link has expired or was already used.")
+	}
+	var login Login
+	if err := json.Unmarshal(bytes, &login); err != nil {
+		return nil, err
+	}
+	current, err := cl.currentUser(c)
+	if err != nil {
+		return nil, err
+	}
+	accountID, err := cl.Store.LookupUserKey(emailIndex, login.Email)
+	if err != nil {
+		return nil, err
+	}
+	if accountID == "" && login.Name != "" {
+		account, err := cl.register(current, login)
+		if err != nil {
+			return nil, err
+		}
+		setSession(c, account.ID)
+		return account, nil
+	}
+	account, err := cl.loadUser(accountID)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, errors.New("No account for " + login.Email)
+	}
+	if !current.Registered() && current.ID != account.ID {
+		if err := cl.claimHistory(current, account); err != nil {
+			logger.Error("could not claim history", "user", current.ID, "account", account.ID, "err", err)
+		}
+	}
+	setSession(c, account.ID)
+	return account, nil
+}
+
+// make an account of the anonymous user (or a new user if the current one is already registered)
+func (cl *Cluster) register(current *User, login Login) (*User, error) {
+	account := current
+	if current.Registered() {
+		var err error
+		if account, err = cl.newAnonymousUser(); err != nil {
+			return nil, err
+		}
+	}
+	owner, err := cl.Store.ClaimUserKey(nameIndex, strings.ToLower(login.Name), account.ID)
+	if err != nil {
+		return nil, err
+	}
+	if owner != account.ID {
+		return nil, errNameTaken
+	}
+	owner, err = cl.Store.ClaimUserKey(emailIndex, login.Email, account.ID)
+	if err == nil && owner != account.ID {
+		err = errors.New("That email already has an account.")
+	}
+	if err != nil {
+		cl.Store.ReleaseUserKey(nameIndex, strings.ToLower(login.Name), account.ID)
+		return nil, err
+	}
+	account.Name = login.Name
+	account.Email = login.Email
+	if err := cl.saveUser(account); err != nil {
+		return nil, err
+	}
+	cl.renameInRatings(account)
+	logger.Info("registered user", "user", account.ID, "name", account.Name)
+	return account, nil
+}
+
+func (cl *Cluster) rename(user *User, name string) error {
+	if !user.Registered() {
+		return errors.New("Only registered users can choose a name.")
+	}
+	if !validName.MatchString(name) {
+		return errors.New("Names are 3 to 20 letters, digits, '-' or '_', starting with a letter.")
+	}
+	owner, err := cl.Store.ClaimUserKey(nameIndex, strings.ToLower(name), user.ID)
+	if err != nil {
+		return err
+	}
+	if owner != user.ID {
+		return errNameTaken
+	}
+	if strings.ToLower(name) != strings.ToLower(user.Name) {
+		cl.Store.ReleaseUserKey(nameIndex, strings.ToLower(user.Name), user.ID)
+	}
+	user.Name = name
+	if err := cl.saveUser(user); err != nil {
+		return err
+	}
+	cl.renameInRatings(user)
+	return nil
+}
+
+// ratings carry the user's name for the leaderboard
+func (cl *Cluster) renameInRatings(user *User) {
+	pools, err := cl.Store.ListRatingPools()
+	if err != nil {
+		logger.Error("could not list rating pools", "err", err)
+		return
+	}
+	for _, pool := range pools {
+		bytes, err := cl.Store.LoadRating(pool, user.ID)
+		if err != nil || bytes == nil {
+			continue
+		}
+		rating := &Rating{}
+		if json.Unmarshal(bytes, rating) == nil {
+			rating.UserName = user.Name
+			cl.saveRating(rating)
+		}
+	}
+}
+
+// move the anonymous user's history to the account and delete the anonymous user
+func (cl *Cluster) claimHistory(anonymous *User, account *User) error {
+	// ratings: where the account already has a rating in the pool, it is kept
+	// (two ratings of the same player can't be meaningfully combined)
+	pools, err := cl.Store.ListRatingPools()
+	if err != nil {
+		return err
+	}
+	for _, pool := range pools {
+		bytes, err := cl.Store.LoadRating(pool, anonymous.ID)
+		if err != nil || bytes == nil {
+			continue
+		}
+		existing, err := cl.Store.LoadRating(pool, account.ID)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			rating := &Rating{}
+			if err := json.Unmarshal(bytes, rating); err != nil {
+				return err
+			}
+			rating.UserID = account.ID
+			rating.UserName = account.Name
+			if err := cl.saveRating(rating); err != nil {
+				return err
+			}
+		}
+		cl.Store.DeleteRating(pool, anonymous.ID)
+	}
+
+	// rating changes and match records, merged in time order
+	lists := []struct {
+		list   func(string) ([][]byte, error)
+		add    func(string, []byte) error
+		delete func(string) error
+	}{
+		{cl.Store.ListRatingChanges, cl.Store.AddRatingChange, cl.Store.DeleteRatingChanges},
+		{cl.Store.ListMatchRecords, cl.Store.AddMatchRecord, cl.Store.DeleteMatchRecords},
+	}
+	for _, l := range lists {
+		accountList, err := l.list(account.ID)
+		if err != nil {
+			return err
+		}
+		anonymousList, err := l.list(anonymous.ID)
+		if err != nil {
+			return err
+		}
+		if len(anonymousList) == 0 {
+			continue
+		}
+		if err := l.delete(account.ID); err != nil {
+			return err
+		}
+		for _, bytes := range mergeByTime(accountList, anonymousList) {
+			if err := l.add(account.ID, bytes); err != nil {
+				return err
+			}
+		}
+		l.delete(anonymous.ID)
+	}
+
+	// seats in matches run by this instance
+	// (matches run by other instances keep the anonymous user, who can no longer rejoin them)
+	for _, m := range cl.Matches.List() {
+		m.Mutex.Lock()
+		if m.WhitePlayerID == anonymous.ID {
+			m.WhitePlayerID = account.ID
+		}
+		if m.BlackPlayerID == anonymous.ID {
+			m.BlackPlayerID = account.ID
+		}
+		m.Mutex.Unlock()
+		cl.saveMatch(m)
+	}
+
+	logger.Info("claimed history of anonymous user", "user", account.ID, "name", account.Name, "anonymous", anonymous.ID)
+	return cl.Store.DeleteUser(anonymous.ID)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Admin console
+//
+// Registered users whose emails are listed in ADMIN_EMAILS (comma separated) can use /admin to see the
+// live matches of every instance, inspect a match's full state, end or abort a match, kick a connection,
+// and hand a seat to the AI (or take it back). An action on a match is carried out by the instance which
+// owns it (sent over the bus if that is another instance). A maintenance notice goes to every player and
+// spectator connected to any instance.
+
+const (
+	noticeChannel   = "chrss:notice"
+	maxNoticeLength = 500         // characters
+	adminUserKey    = "adminUser" // gin context key of the admin making the request
+)
+
+// admin actions
+const (
+	endAction    = "end"   // end with Winner as the result
+	abortAction  = "abort" // end without a result
+	kickAction   = "kick"  // close Target's connection (white, black, or a spectator's name)
+	toggleAction = "ai"    // hand Color's seat to the AI, or take it back
+)
+
+// sent to the owner of the match (in a relayEvent's Data) if another instance owns it
+type AdminAction struct {
+	Action string
+	Winner string // for end: white, black, or draw
+	Target string // for kick
+	Color  string // for ai
+	Admin  string // name of the admin (for logs)
+}
+
+type NoticePayload struct {
+	Message string `json:"message"`
+}
+
+var errNotAdmin = errors.New("You are not an administrator.")
+
+// (registered emails, normalized)
+var adminEmails = map[string]bool{}
+
+func initAdmins() {
+	for _, address := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if strings.TrimSpace(address) == "" {
+			continue
+		}
+		email, err := normalizeEmail(address)
+		if err != nil {
+			logger.Warn("invalid email in ADMIN_EMAILS", "email", address, "err", err)
+			continue
+		}
+		adminEmails[email] = true
+	}
+}
+
+func (u *User) Admin() bool {
+	return u.Registered() && adminEmails[u.Email]
+}
+
+// middleware for /admin routes
+func (cl *Cluster) requireAdmin(c *gin.Context) {
+	user, err := cl.currentUser(c)
+	if err != nil {
+		logger.Error("could not identify user", "err", err)
+		c.String(http.StatusInternalServerError, "Could not identify user.")
+		c.Abort()
+		return
+	}
+	if !user.Admin() {
+		c.String(http.StatusForbidden, errNotAdmin.Error())
+		c.Abort()
+		return
+	}
+	c.Set(adminUserKey, user)
+}
+
+// a match as listed in the console
+type AdminMatchRow struct {
+	MatchSummary
+	Owner     string // instance ("" if none)
+	WhiteName string
+	BlackName string
+}
+
+func (cl *Cluster) adminMatchRows() ([]AdminMatchRow, error) {
+	summaries, err := cl.listSummaries()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].StartTime > summaries[j].StartTime })
+	names := map[string]string{} // user id -> name
+	userName := func(userID string, presence string) string {
+		if presence == "ai" && userID == "" {
+			return "AI"
+		}
+		if userID == "" {
+			return ""
+		}
+		if name, ok := names[userID]; ok {
+			return name
+		}
+		name := userID
+		if user, err := cl.loadUser(userID); err == nil && user != nil {
+			name = user.Name
+		}
+		names[userID] = name
+		return name
+	}
+	rows := make([]AdminMatchRow, len(summaries))
+	for i, summary := range summaries {
+		owner, err := cl.Store.MatchOwner(summary.Name)
+		if err != nil {
+			logger.Error("could not load match owner", "match", summary.Name, "err", err)
+		}
+		rows[i] = AdminMatchRow{
+			MatchSummary: summary,
+			Owner:        owner,
+			WhiteName:    userName(summary.WhitePlayerID, summary.WhitePresence),
+			BlackName:    userName(summary.BlackPlayerID, summary.BlackPresence),
+		}
+	}
+	return rows, nil
+}
+
+// the match's full state (indented JSON), and the names of its spectators if this instance owns it
+// returns nil state if no such match
+func (cl *Cluster) adminMatchState(name string) ([]byte, []string, error) {
+	var state []byte
+	var spectators []string
+	var err error
+	if m, ok := cl.Matches.Load(name); ok {
+		m.Mutex.RLock()
+		state, err = json.Marshal(m)
+		for conn := range m.Spectators {
+			spectators = append(spectators, conn.Name)
+		}
+		m.Mutex.RUnlock()
+	} else {
+		state, err = cl.Store.LoadMatch(name)
+	}
+	if err != nil || state == nil {
+		return nil, nil, err
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, state, "", "  "); err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(spectators)
+	return indented.Bytes(), spectators, nil
+}
+
+// carry out the action on the match, or send it to the instance which owns the match
+// returns the outcome to show the admin
+func (cl *Cluster) adminAction(name string, action AdminAction) (string, error) {
+	if m, ok := cl.Matches.Load(name); ok {
+		if err := cl.applyAdminAction(m, action); err != nil {
+			return "", err
+		}
+		return "Done.", nil
+	}
+	owner, err := cl.Store.MatchOwner(name)
+	if err != nil {
+		return "", err
+	}
+	if owner == "" {
+		// (no instance runs the match, so we take it over)
+		m, _, err := cl.localMatch(name)
+		if err != nil {
+			return "", err
+		}
+		if m == nil {
+			return "", errors.New("No match with id '" + name + "' exists.")
+		}
+		if err := cl.applyAdminAction(m, action); err != nil {
+			return "", err
+		}
+		return "Done.", nil
+	}
+	data, err := json.Marshal(action)
+	if err != nil {
+		return "", err
+	}
+	bytes, err := json.Marshal(relayEvent{Kind: adminEvent, Match: name, Data: data})
+	if err != nil {
+		return "", err
+	}
+	if err := cl.Bus.Publish(instanceChannel(owner), bytes); err != nil {
+		return "", err
+	}
+	return "Sent to instance " + owner + ".", nil
+}
+
+// (from an admin connected to another instance)
+func (cl *Cluster) handleAdminEvent(event relayEvent) {
+	var action AdminAction
+	if err := json.Unmarshal(event.Data, &action); err != nil {
+		logger.Error("could not JSON decode admin action", "err", err)
+		return
+	}
+	m, ok := cl.Matches.Load(event.Match)
+	if !ok {
+		logger.Warn("admin action on match this instance does not run", "match", event.Match)
+		return
+	}
+	if err := cl.applyAdminAction(m, action); err != nil {
+		logger.Warn("admin action failed", "match", event.Match, "err", err)
+	}
+}
+
+// locks match mutex
+func (cl *Cluster) applyAdminAction(m *Match, action AdminAction) error {
+	m.Mutex.Lock()
+	m.logger().Info("admin action", "admin", action.Admin, "action", action.Action)
+	var err error
+	crashed := m.guard("admin action "+action.Action, func() {
+		err = m.adminAction(action)
+	})
+	if crashed || err != nil {
+		m.Mutex.Unlock()
+		return err
+	}
+	m.sendState(white, false, false)
+	m.sendState(black, false, false)
+	m.sendSpectators(false, false)
+	m.Mutex.Unlock()
+	cl.saveMatch(m)
+	return nil
+}
+
+// assumes match mutex is held
+func (m *Match) adminAction(action AdminAction) error {
+	inPlay := m.Phase == kingPlacementPhase || m.Phase == mainPhase
+	switch action.Action {
+	case endAction:
+		if m.Phase == gameoverPhase {
+			return errors.New("The match is already over.")
+		}
+		if action.Winner != white && action.Winner != black && action.Winner != draw {
+			return errors.New("Winner must be white, black, or draw.")
+		}
+		m.endMatch(action.Winner, adminReason)
+	case abortAction:
+		if m.Phase == gameoverPhase {
+			return errors.New("The match is already over.")
+		}
+		m.endMatch(none, abortReason)
+	case kickAction:
+		kicked := 0
+		text := "Disconnected by an administrator."
+		switch action.Target {
+		case white, black:
+			conn := m.WhiteConn
+			if action.Target == black {
+				conn = m.BlackConn
+			}
+			if conn != nil {
+				conn.close(websocket.ClosePolicyViolation, text)
+				kicked++
+			}
+		default:
+			for conn := range m.Spectators {
+				if conn.Name == action.Target {
+					conn.close(websocket.ClosePolicyViolation, text)
+					kicked++
+				}
+			}
+		}
+		if kicked == 0 {
+			return errors.New("No connection '" + action.Target + "' in the match.")
+		}
+	case toggleAction:
+		if !inPlay {
+			return errors.New("The AI can take a seat only while the match is in play.")
+		}
+		if action.Color != white && action.Color != black {
+			return errors.New("Color must be white or black.")
+		}
+		isAI, otherAI := m.WhiteAI, m.BlackAI
+		if action.Color == black {
+			isAI, otherAI = m.BlackAI, m.WhiteAI
+		}
+		if !isAI && otherAI {
+			return errors.New("The AI already plays the other seat.")
+		}
+		if !isAI {
+			// (as if the player had stayed disconnected: they take the seat back by reconnecting)
+			m.aiTakeover(action.Color)
+			break
+		}
+		disconnectTime, takeover := m.disconnectState(action.Color)
+		*takeover = false
+		if action.Color == black {
+			m.BlackAI = false
+		} else {
+			m.WhiteAI = false
+		}
+		if m.presence(action.Color) == "disconnected" {
+			// the player now has the grace period to return
+			*disconnectTime = time.Now().UnixNano()
+		}
+		m.Log = append(m.Log, "an administrator took "+action.Color+" back from the AI")
+	default:
+		return errors.New("Unknown action '" + action.Action + "'.")
+	}
+	return nil
+}
+
+// publish a notice to every instance (including this one) for their connected clients
+func (cl *Cluster) broadcastNotice(message string) error {
+	message = strings.TrimSpace(message)
+	if message == "" {
+		return errors.New("The notice is empty.")
+	}
+	if utf8.RuneCountInString(message) > maxNoticeLength {
+		return errors.New("The notice is too long.")
+	}
+	bytes, err := json.Marshal(NoticePayload{message})
+	if err != nil {
+		return err
+	}
+	return cl.Bus.Publish(noticeChannel, bytes)
+}
+
+// pass notices published by admins to the players and spectators of our matches
+func (cl *Cluster) receiveNotices(notices <-chan []byte) {
+	for bytes := range notices {
+		var notice NoticePayload
+		if err := json.Unmarshal(bytes, &notice); err != nil {
+			logger.Error("could not JSON decode notice", "err", err)
+			continue
+		}
+		logger.Info("notice", "message", notice.Message)
+		for _, m := range cl.Matches.List() {
+			m.Mutex.Lock()
+			m.sendNotice(notice)
+			m.Mutex.Unlock()
+		}
+	}
+}
+
+// (spectators get the notice without the spectator delay)
+// assumes match mutex is held
+func (m *Match) sendNotice(notice NoticePayload) {
+	m.sendMessage(white, noticeMsg, 0, notice)
+	m.sendMessage(black, noticeMsg, 0, notice)
+	if len(m.Spectators) == 0 {
+		return
+	}
+	bytes, err := m.spectatorOutbox.add(noticeMsg, 0, notice)
+	if err != nil {
+		logger.Error("could not JSON encode notice", "err", err)
+		return
+	}
+	for conn := range m.Spectators {
+		conn.queue(bytes)
+	}
+}
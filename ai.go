@@ -1,11 +1,24 @@
 package main
 
 import (
-	"fmt"
 	"math/rand"
 	"time"
 )
 
+// AI levels
+const (
+	easyAI   = "easy"
+	normalAI = "normal"
+)
+
+// level of the AI playing color (an AI taking over for a disconnected player always plays its best)
+func (m *Match) aiLevel(color string) string {
+	if _, takeover := m.disconnectState(color); *takeover || m.AILevel == "" {
+		return normalAI
+	}
+	return m.AILevel
+}
+
 func kingPlacementAI(color string, board *Board) Pos {
 	free := freeSpaces(color, board)
 	if len(free) == 0 {
@@ -80,21 +93,29 @@ func freeSpaces(color string, board *Board) []int {
 }
 
 func playTurnAI(color string, m *Match) {
-	defer timeTrack(time.Now(), "playTurnAI")
+	defer observeAITurn(m.aiLevel(color), time.Now())
+
+	// the easy AI plays any card it can
+	if m.aiLevel(color) == easyAI {
+		if !m.playRandomCard(color) {
+			m.EndTurn(true, color) // pass
+			m.Log = append(m.Log, color+" passed")
+		}
+		return
+	}
 
 	public, private := m.states(color)
 	boardScore := scoreBoard(color, &m.Board)
-	fmt.Printf("current board state score: %v\n", boardScore)
+	m.playerLogger(color).Debug("AI scored board", "score", boardScore)
 
 	// positive score = better than passing
 	// negative score = worse than passing
 	scores := make([]int, len(private.Cards))
 	pos := make([]Pos, len(private.Cards)) // for the scored card, the chosen Pos to 'click'
-	fmt.Println("AI thinking...")
 	for i, c := range private.Cards {
 		if private.PlayableCards[i] {
 			scores[i], pos[i] = scoreCardAI(c.Name, color, boardScore, m)
-			fmt.Printf("card %s: score %v, pos %v\n", c.Name, scores[i], pos[i])
+			m.playerLogger(color).Debug("AI scored card", "card", c.Name, "score", scores[i], "pos", pos[i])
 		}
 	}
 
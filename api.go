@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// JSON API
+//
+// For third-party clients and bots, /api/v1 serves the lobby, match creation and joining, match state and
+// results, replays, and players' match histories as JSON:
+//
+//	GET  /api/v1/matches                  LobbyResponse: open and live matches
+//	POST /api/v1/matches                  create a match (settings as below) -> SeatResponse (201)
+//	GET  /api/v1/matches/:name            MatchResponse: the match, and its state as seen by the requester
+//	POST /api/v1/matches/:name/join       take the open seat (JoinRequest) -> SeatResponse
+//	GET  /api/v1/matches/:name/result     ResultResponse (once the match is over)
+//	GET  /api/v1/matches/:name/replay     the replay frames (as from /replay/:name/frames)
+//	GET  /api/v1/users/:name/matches      a registered user's MatchRecords, most recent first
+//	GET  /api/v1/challenges               ChallengesResponse (see bots.go)
+//
+// Requests are made as the session's user (the session cookie is set on the first request, as for the
+// site), or as the bot whose API token they bear (see bots.go). The settings of a new match are a JSON
+// object with the same keys and meanings as the /createMatch query parameters: color, ai, aiLevel, dev,
+// ruleset, rated, maxRounds, grace, onDisconnect, spectatorDelay, timeBank, increment, private, password,
+// and opponent. A match is played over its websocket (the socket path of a SeatResponse), as described in
+// protocol.go. An error response is
+//
+//	{"error": {"code": "<code>", "message": "<message>"}}
+
+// error codes
+const (
+	notFoundAPIError     = "not_found"
+	badRequestAPIError   = "bad_request"
+	forbiddenAPIError    = "forbidden"
+	unauthorizedAPIError = "unauthorized" // bad bot API token (see bots.go)
+	conflictAPIError     = "conflict"
+	unavailableAPIError  = "unavailable"
+	internalAPIError     = "internal"
+)
+
+const maxAPIBodyBytes = 16 * 1024
+
+// a match as listed in the lobby
+type APIMatch struct {
+	Name          string `json:"name"`
+	CreatorName   string `json:"creatorName"`
+	StartTime     int64  `json:"startTime"` // unix nano
+	Phase         Phase  `json:"phase"`
+	Round         int    `json:"round"`
+	OpenColor     string `json:"openColor"` // "" if neither seat can be taken
+	Locked        bool   `json:"locked"`    // joining needs the password
+	Rated         bool   `json:"rated"`
+	MaxRounds     int    `json:"maxRounds"`     // 0 for no limit
+	TimeBank      int64  `json:"timeBank"`      // seconds (0 for no time bank)
+	TimeIncrement int64  `json:"timeIncrement"` // seconds
+	WhitePresence string `json:"whitePresence"` // connected, disconnected, or ai
+	BlackPresence string `json:"blackPresence"`
+	Spectators    int    `json:"spectators"`
+}
+
+type LobbyResponse struct {
+	Open []APIMatch `json:"open"` // matches with a seat anyone can take
+	Live []APIMatch `json:"live"` // matches being played
+}
+
+// a seat the requester holds
+type SeatResponse struct {
+	Match      string `json:"match"`
+	Color      string `json:"color"`
+	Socket     string `json:"socket"`               // websocket path for playing the seat
+	Page       string `json:"page"`                 // path of the match's page on the site
+	InviteLink string `json:"inviteLink,omitempty"` // for a match the requester created with a restricted seat
+}
+
+type JoinRequest struct {
+	Invite   string `json:"invite"`   // for a private match
+	Password string `json:"password"` // for a match with a password
+}
+
+type MatchResponse struct {
+	Match APIMatch `json:"match"`
+	Color string   `json:"color"` // the requester's seat ("" for a spectator)
+	// as sent in snapshots (see protocol.go); null for a spectator if the match has a spectator delay
+	// (watch it over /ws-watch/:name instead)
+	State gin.H `json:"state"`
+}
+
+type ResultResponse struct {
+	Match     string `json:"match"`
+	Winner    string `json:"winner"` // white, black, draw, or none
+	EndReason string `json:"endReason"`
+	Rounds    int    `json:"rounds"`
+	Series    Series `json:"series"` // including this match
+}
+
+func apiError(c *gin.Context, status int, code string, message string) {
+	c.JSON(status, gin.H{"error": ProtocolError{code, message}})
+}
+
+func apiMatch(summary MatchSummary) APIMatch {
+	return APIMatch{
+		Name:          summary.Name,
+		CreatorName:   summary.CreatorName,
+		StartTime:     summary.StartTime,
+		Phase:         summary.Phase,
+		Round:         summary.Round,
+		OpenColor:     summary.OpenColor,
+		Locked:        summary.Locked,
+		Rated:         summary.Rated,
+		MaxRounds:     summary.MaxRounds,
+		TimeBank:      summary.TimeBank / 1e9,
+		TimeIncrement: summary.TimeIncrement / 1e9,
+		WhitePresence: summary.WhitePresence,
+		BlackPresence: summary.BlackPresence,
+		Spectators:    summary.Spectators,
+	}
+}
+
+func seatResponse(name string, color string, grant string) SeatResponse {
+	query := ""
+	if grant != "" {
+		query = "?grant=" + url.QueryEscape(grant)
+	}
+	return SeatResponse{
+		Match:  name,
+		Color:  color,
+		Socket: "/ws/" + name + "/" + color + query,
+		Page:   "/match/" + name + "/" + color + query,
+	}
+}
+
+// (the current user, or nil after responding with an error)
+func (cl *Cluster) apiUser(c *gin.Context) *User {
+	user, err := cl.currentUser(c)
+	if err != nil {
+		logger.Error("could not identify user", "err", err)
+		apiError(c, http.StatusInternalServerError, internalAPIError, "Could not identify user.")
+		return nil
+	}
+	return user
+}
+
+func (cl *Cluster) apiLobby(c *gin.Context) {
+	summaries, err := cl.listSummaries()
+	if err != nil {
+		logger.Error("could not list matches", "err", err)
+		apiError(c, http.StatusInternalServerError, internalAPIError, "Could not list matches.")
+		return
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].StartTime > summaries[j].StartTime })
+	lobby := LobbyResponse{Open: []APIMatch{}, Live: []APIMatch{}}
+	for _, summary := range summaries {
+		if summary.DevMode {
+			continue
+		}
+		if summary.Open {
+			lobby.Open = append(lobby.Open, apiMatch(summary))
+		}
+		if summary.Live && !summary.Private {
+			lobby.Live = append(lobby.Live, apiMatch(summary))
+		}
+	}
+	c.JSON(http.StatusOK, lobby)
+}
+
+func (cl *Cluster) apiCreateMatch(c *gin.Context) {
+	user := cl.apiUser(c)
+	if user == nil {
+		return
+	}
+	settings := map[string]interface{}{}
+	decoder := json.NewDecoder(http.MaxBytesReader(c.Writer, c.Request.Body, maxAPIBodyBytes))
+	decoder.UseNumber()
+	if err := decoder.Decode(&settings); err != nil {
+		apiError(c, http.StatusBadRequest, badRequestAPIError, "Settings must be a JSON object.")
+		return
+	}
+	for key, value := range settings {
+		switch value.(type) {
+		case string, json.Number, bool:
+		default:
+			apiError(c, http.StatusBadRequest, badRequestAPIError, "Invalid "+key+": must be a string, number, or boolean.")
+			return
+		}
+	}
+	// (each setting as it would be given in the query string)
+	param := func(key string) string {
+		switch v := settings[key].(type) {
+		case string:
+			return v
+		case json.Number:
+			return v.String()
+		case bool:
+			if v {
+				return "true"
+			}
+			return "false"
+		}
+		return ""
+	}
+	match, color, err := cl.createMatch(user, param, param("password"))
+	if err != nil {
+		logger.Warn("could not create match", "err", err)
+		status, message := createMatchFailure(err)
+		code := internalAPIError
+		switch status {
+		case http.StatusBadRequest:
+			code = badRequestAPIError
+		case http.StatusServiceUnavailable:
+			code = unavailableAPIError
+		}
+		apiError(c, status, code, message)
+		return
+	}
+	response := seatResponse(match.Name, color, "")
+	match.Mutex.RLock()
+	if match.restricted() && match.openColor() != "" {
+		response.InviteLink = match.inviteLink()
+	}
+	match.Mutex.RUnlock()
+	c.JSON(http.StatusCreated, response)
+}
+
+// checks the invite and password, and claims the open seat (if this instance runs the match; otherwise
+// the seat is claimed when the websocket connects, as for the site)
+func (cl *Cluster) apiJoin(c *gin.Context) {
+	user := cl.apiUser(c)
+	if user == nil {
+		return
+	}
+	var request JoinRequest
+	if c.Request.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(c.Writer, c.Request.Body, maxAPIBodyBytes)).Decode(&request); err != nil {
+			apiError(c, http.StatusBadRequest, badRequestAPIError, "Request must be a JSON object.")
+			return
+		}
+	}
+	name := c.Param("name")
+	info, err := cl.loadJoinInfo(name)
+	if err != nil {
+		logger.Error("could not load match", "match", name, "err", err)
+	}
+	if info != nil {
+		if color := info.seat(user.ID); color != "" {
+			c.JSON(http.StatusOK, seatResponse(name, color, ""))
+			return
+		}
+	}
+	// a private match doesn't exist for those without the invite
+	if info == nil || !info.validInvite(request.Invite) {
+		apiError(c, http.StatusNotFound, notFoundAPIError, "No match with id '"+name+"' exists.")
+		return
+	}
+	if info.OpenColor == "" {
+		apiError(c, http.StatusConflict, conflictAPIError, "Both seats are taken.")
+		return
+	}
+	if !info.validPassword(request.Password) {
+		apiError(c, http.StatusForbidden, forbiddenAPIError, "Wrong password.")
+		return
+	}
+	color, grant := info.OpenColor, ""
+	if info.InviteToken != "" {
+		grant = seatGrant(info.InviteToken, color, user.ID)
+	}
+	if match, ok := cl.Matches.Load(name); ok {
+		match.Mutex.Lock()
+		err := match.claimSeat(color, user.ID, grant)
+		match.Mutex.Unlock()
+		if err != nil {
+			apiError(c, http.StatusConflict, conflictAPIError, err.Error())
+			return
+		}
+		cl.saveMatch(match)
+	}
+	c.JSON(http.StatusOK, seatResponse(name, color, grant))
+}
+
+func (cl *Cluster) apiMatchState(c *gin.Context) {
+	user := cl.apiUser(c)
+	if user == nil {
+		return
+	}
+	name := c.Param("name")
+	summary, err := cl.loadSummary(name)
+	if err != nil {
+		logger.Error("could not load match", "match", name, "err", err)
+		apiError(c, http.StatusInternalServerError, internalAPIError, "Could not load match.")
+		return
+	}
+	color := ""
+	if summary != nil {
+		if summary.WhitePlayerID == user.ID {
+			color = white
+		} else if summary.BlackPlayerID == user.ID {
+			color = black
+		}
+	}
+	// a private match doesn't exist for those not playing it
+	if summary == nil || (summary.Private && color == "") {
+		apiError(c, http.StatusNotFound, notFoundAPIError, "No match with id '"+name+"' exists.")
+		return
+	}
+	m, ok := cl.Matches.Load(name)
+	if !ok {
+		// (run by another instance: its last save)
+		state, err := cl.Store.LoadMatch(name)
+		if err == nil && state != nil {
+			m, err = decodeMatch(state)
+		}
+		if err != nil || m == nil {
+			logger.Error("could not load match", "match", name, "err", err)
+			apiError(c, http.StatusInternalServerError, internalAPIError, "Could not load match.")
+			return
+		}
+	}
+	response := MatchResponse{Match: apiMatch(*summary), Color: color}
+	m.Mutex.RLock()
+	if color != "" {
+		response.State = m.playerState(color, false, false)
+	} else if m.SpectatorDelay == 0 || m.Phase == gameoverPhase {
+		response.State = m.spectatorState(false, false)
+	}
+	m.Mutex.RUnlock()
+	if !ok && response.State != nil {
+		// (a copy has no connections)
+		response.State["whitePresence"] = summary.WhitePresence
+		response.State["blackPresence"] = summary.BlackPresence
+		response.State["spectators"] = summary.Spectators
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// the result, from the match or, once it has been evicted, from the last frame of its replay
+// (a private match's only to its players)
+func (cl *Cluster) apiResult(c *gin.Context) {
+	user := cl.apiUser(c)
+	if user == nil {
+		return
+	}
+	name := c.Param("name")
+	var result struct {
+		Phase     Phase  `json:"phase"`
+		Winner    string `json:"winner"`
+		EndReason string `json:"endReason"`
+		Round     int    `json:"round"`
+		Series    Series `json:"series"`
+	}
+	m, ok := cl.Matches.Load(name)
+	var err error
+	if !ok {
+		var state []byte
+		state, err = cl.Store.LoadMatch(name)
+		if err == nil && state != nil {
+			m, err = decodeMatch(state)
+		}
+	}
+	if err == nil && m != nil {
+		m.Mutex.RLock()
+		access := ReplayAccess{m.Private, m.WhitePlayerID, m.BlackPlayerID}
+		result.Phase, result.Winner, result.EndReason = m.Phase, m.Winner, m.EndReason
+		result.Round, result.Series = m.Round, m.seriesScore()
+		m.Mutex.RUnlock()
+		if !access.allows(user.ID) {
+			apiError(c, http.StatusNotFound, notFoundAPIError, "No match with id '"+name+"' exists.")
+			return
+		}
+	} else if err == nil {
+		var access *ReplayAccess
+		var frames [][]byte
+		access, err = cl.loadReplayAccess(name)
+		if err == nil && access != nil && access.allows(user.ID) {
+			frames, err = cl.Store.ListReplayFrames(name)
+		}
+		if err == nil && len(frames) == 0 {
+			apiError(c, http.StatusNotFound, notFoundAPIError, "No match with id '"+name+"' exists.")
+			return
+		}
+		if err == nil {
+			// (the frame has the spectators' view of the final state)
+			err = json.Unmarshal(frames[len(frames)-1], &result)
+		}
+	}
+	if err != nil {
+		logger.Error("could not load match", "match", name, "err", err)
+		apiError(c, http.StatusInternalServerError, internalAPIError, "Could not load match.")
+		return
+	}
+	if result.Phase != gameoverPhase {
+		apiError(c, http.StatusConflict, conflictAPIError, "The match is not over.")
+		return
+	}
+	c.JSON(http.StatusOK, ResultResponse{name, result.Winner, result.EndReason, result.Round, result.Series})
+}
+
+// (only once the match has ended, and a private match's only to its players)
+func (cl *Cluster) apiReplay(c *gin.Context) {
+	user := cl.apiUser(c)
+	if user == nil {
+		return
+	}
+	name := c.Param("name")
+	replay, err := cl.replayFor(name, user.ID)
+	if err != nil {
+		logger.Error("could not load replay", "err", err)
+		apiError(c, http.StatusInternalServerError, internalAPIError, "Could not load replay.")
+		return
+	}
+	if replay == nil {
+		apiError(c, http.StatusNotFound, notFoundAPIError, "No replay of match '"+name+"' exists.")
+		return
+	}
+	c.Data(http.StatusOK, "application/json", replay)
+}
+
+func (cl *Cluster) apiUserMatches(c *gin.Context) {
+	name := c.Param("name")
+	userID, err := cl.Store.LookupUserKey(nameIndex, strings.ToLower(name))
+	if err != nil {
+		logger.Error("could not load user", "err", err)
+		apiError(c, http.StatusInternalServerError, internalAPIError, "Could not load user.")
+		return
+	}
+	if userID == "" {
+		apiError(c, http.StatusNotFound, notFoundAPIError, "No user named '"+name+"' exists.")
+		return
+	}
+	records, err := cl.listMatchRecords(userID)
+	if err != nil {
+		logger.Error("could not list match records", "err", err)
+		apiError(c, http.StatusInternalServerError, internalAPIError, "Could not list matches.")
+		return
+	}
+	c.JSON(http.StatusOK, records)
+}
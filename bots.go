@@ -0,0 +1,522 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Bots
+//
+// A registered user can create bot accounts on the account page, each with an API token. A program
+// playing as the bot sends the token with its requests to the JSON API (see api.go) and its websocket
+// connections (/ws/:name/:color, /ws-watch/:name, and /ws-queue):
+//
+//	Authorization: Bearer <token>
+//
+// Bots play by the same protocol as everyone else (see protocol.go), helped by two additions: the player
+// state has legalActions, the messages the player can send now (with, for play_card and for placing the
+// King, the positions they can be sent with), and play_card selects and plays a card in one message.
+// Where a websocket is inconvenient, a bot can instead read its seat's server messages from an HTTP stream
+// and post its own messages:
+//
+//	GET  /api/v1/bot/matches/:name/:color/stream?lastSeq=<n>   the seat's server messages (NDJSON)
+//	POST /api/v1/bot/matches/:name/:color/actions              a client message -> 202 (replies come on the stream)
+//
+// The stream has one envelope per line (a blank line now and then keeps the connection alive). Its last
+// line is a closed message giving the close code and reason, as would close a websocket.
+//
+// Anyone can challenge a user (bot or not) by creating a match with the opponent setting, the user's
+// name: the other seat is reserved for them. GET /api/v1/challenges lists the requester's challenges,
+// waiting up to ?wait=<seconds> for an incoming one. A challenge is accepted by taking the seat and
+// readying up, or declined with a decline_challenge message.
+
+const (
+	botTokenIndex         = "botToken" // user key index: hash of a bot's API token -> bot id
+	botTokenBytes         = 24
+	maxBotsPerUser        = 10
+	botUserKey            = "botUser"        // gin context key of the bot making the request
+	maxChallengeWait      = 25 * time.Second // (under Heroku's 30 second request timeout)
+	challengePollInterval = time.Second
+)
+
+var errNotYourSeat = errors.New("You do not hold this seat.")
+
+func hashBotToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// returns the bot and its API token
+func (cl *Cluster) createBot(owner *User, name string) (*User, string, error) {
+	if !owner.Registered() {
+		return nil, "", errors.New("Only registered users can create bots.")
+	}
+	if len(owner.Bots) >= maxBotsPerUser {
+		return nil, "", errors.New("You already have " + strconv.Itoa(maxBotsPerUser) + " bots.")
+	}
+	if !validName.MatchString(name) {
+		return nil, "", errors.New("Names are 3 to 20 letters, digits, '-' or '_', starting with a letter.")
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, "", err
+	}
+	// (the bot is saved only once it has its name, so a failure leaves no user behind)
+	bot := &User{ID: id.String(), Name: name, Created: time.Now().UnixNano(), Bot: true, Owner: owner.ID}
+	claimant, err := cl.Store.ClaimUserKey(nameIndex, strings.ToLower(name), bot.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	if claimant != bot.ID {
+		return nil, "", errNameTaken
+	}
+	token, err := cl.issueBotToken(bot) // saves the bot
+	if err != nil {
+		cl.Store.ReleaseUserKey(nameIndex, strings.ToLower(name), bot.ID)
+		return nil, "", err
+	}
+	owner.Bots = append(owner.Bots, bot.ID)
+	if err := cl.saveUser(owner); err != nil {
+		owner.Bots = owner.Bots[:len(owner.Bots)-1]
+		cl.Store.ReleaseUserKey(botTokenIndex, bot.TokenHash, bot.ID)
+		cl.Store.ReleaseUserKey(nameIndex, strings.ToLower(name), bot.ID)
+		cl.Store.DeleteUser(bot.ID)
+		return nil, "", err
+	}
+	return bot, token, nil
+}
+
+// new API token for the bot (its previous token stops working)
+func (cl *Cluster) issueBotToken(bot *User) (string, error) {
+	token := randomToken(botTokenBytes)
+	hash := hashBotToken(token)
+	claimant, err := cl.Store.ClaimUserKey(botTokenIndex, hash, bot.ID)
+	if err != nil {
+		return "", err
+	}
+	if claimant != bot.ID {
+		return "", errors.New("Could not issue a token. Try again.")
+	}
+	previous := bot.TokenHash
+	bot.TokenHash = hash
+	if err := cl.saveUser(bot); err != nil {
+		cl.Store.ReleaseUserKey(botTokenIndex, hash, bot.ID)
+		return "", err
+	}
+	if previous != "" {
+		cl.Store.ReleaseUserKey(botTokenIndex, previous, bot.ID)
+	}
+	return token, nil
+}
+
+func (cl *Cluster) listBots(owner *User) []*User {
+	bots := []*User{}
+	for _, id := range owner.Bots {
+		bot, err := cl.loadUser(id)
+		if err != nil {
+			logger.Error("could not load bot", "bot", id, "err", err)
+			continue
+		}
+		if bot != nil {
+			bots = append(bots, bot)
+		}
+	}
+	return bots
+}
+
+// the owner's bot with the name (nil if none)
+func (cl *Cluster) ownedBot(owner *User, name string) *User {
+	for _, bot := range cl.listBots(owner) {
+		if strings.ToLower(bot.Name) == strings.ToLower(name) {
+			return bot
+		}
+	}
+	return nil
+}
+
+// middleware: a request bearing a bot's API token is made as the bot
+// (requests without the header are left to the session cookie)
+func (cl *Cluster) authenticateBot(c *gin.Context) {
+	auth := c.GetHeader("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return
+	}
+	botID, err := cl.Store.LookupUserKey(botTokenIndex, hashBotToken(strings.TrimPrefix(auth, "Bearer ")))
+	var bot *User
+	if err == nil && botID != "" {
+		bot, err = cl.loadUser(botID)
+	}
+	if err != nil {
+		logger.Error("could not load bot", "err", err)
+		apiError(c, http.StatusInternalServerError, internalAPIError, "Could not identify user.")
+		c.Abort()
+		return
+	}
+	if bot == nil || !bot.Bot {
+		apiError(c, http.StatusUnauthorized, unauthorizedAPIError, "Invalid API token.")
+		c.Abort()
+		return
+	}
+	c.Set(botUserKey, bot)
+}
+
+// middleware for routes only bots may use (after authenticateBot)
+func requireBot(c *gin.Context) {
+	if _, ok := c.Get(botUserKey); !ok {
+		apiError(c, http.StatusUnauthorized, unauthorizedAPIError, "Send the bot's API token as a bearer token.")
+		c.Abort()
+	}
+}
+
+// a message the player can send now
+type LegalAction struct {
+	Type      string `json:"type"`
+	Card      *int   `json:"card,omitempty"`      // for play_card: index into the player's cards
+	CardName  string `json:"cardName,omitempty"`  // for play_card
+	Positions []Pos  `json:"positions,omitempty"` // for play_card and click_board: where it can be played
+}
+
+// (chat, mute, get_state, and time_expired can always be sent, so are left out)
+// assumes match mutex is held
+func (m *Match) legalActions(color string) []LegalAction {
+	actions := []LegalAction{}
+	if m.stopped() {
+		return actions
+	}
+	public, private := m.states(color)
+	switch m.Phase {
+	case readyUpPhase:
+		if !public.Ready {
+			actions = append(actions, LegalAction{Type: "ready"})
+		}
+		if m.ChallengedID != "" && m.ChallengedID == m.playerID(color) {
+			actions = append(actions, LegalAction{Type: "decline_challenge"})
+		}
+	case kingPlacementPhase:
+		if !public.KingPlayed {
+			spaces := []Pos{}
+			for _, idx := range freeSpaces(color, &m.Board) {
+				spaces = append(spaces, positions[idx])
+			}
+			actions = append(actions, LegalAction{Type: "click_board", Positions: spaces})
+		}
+	case mainPhase:
+		if m.Turn != color {
+			break
+		}
+		for i, card := range private.Cards {
+			if !private.PlayableCards[i] {
+				continue
+			}
+			legal := []Pos{}
+			for _, idx := range validCardPositions(card.Name, color, m, &m.Board) {
+				if cardPlayProblem(m, card.Name, card.Type, color, public, positions[idx], &m.Board) == "" {
+					legal = append(legal, positions[idx])
+				}
+			}
+			if len(legal) > 0 {
+				i := i
+				actions = append(actions, LegalAction{Type: "play_card", Card: &i, CardName: card.Name, Positions: legal})
+			}
+		}
+		if public.KingPlayed {
+			actions = append(actions, LegalAction{Type: "pass"})
+		}
+	case gameoverPhase:
+		if m.Rematch == "" && !m.RematchAccepted && m.RematchOffer != color && m.EndReason != declinedReason {
+			actions = append(actions, LegalAction{Type: "rematch"})
+		}
+		if m.RematchOffer == otherColor(color) && !m.RematchAccepted {
+			actions = append(actions, LegalAction{Type: "decline_rematch"})
+		}
+	}
+	if m.Phase == kingPlacementPhase || m.Phase == mainPhase {
+		actions = append(actions, LegalAction{Type: "resign"})
+		if m.DrawOffer == none {
+			actions = append(actions, LegalAction{Type: "offer_draw"})
+		} else if m.DrawOffer == otherColor(color) {
+			actions = append(actions, LegalAction{Type: "accept_draw"}, LegalAction{Type: "decline_draw"})
+		}
+	}
+	return actions
+}
+
+// assumes match mutex is held
+func (m *Match) playerID(color string) string {
+	if color == black {
+		return m.BlackPlayerID
+	}
+	return m.WhitePlayerID
+}
+
+// the seat's server messages as a stream (see streamPump)
+func (cl *Cluster) botStream(c *gin.Context) {
+	if cl.shuttingDown() {
+		apiError(c, http.StatusServiceUnavailable, unavailableAPIError, errShuttingDown.Error())
+		return
+	}
+	bot := c.MustGet(botUserKey).(*User)
+	name, color := c.Param("name"), c.Param("color")
+	if color != white && color != black {
+		apiError(c, http.StatusNotFound, notFoundAPIError, "Must specify black or white. Invalid match color: '"+color+"'.")
+		return
+	}
+	match, owner, err := cl.localMatch(name)
+	if err != nil {
+		logger.Error("could not load match", "match", name, "err", err)
+	}
+	if match == nil && owner == "" {
+		apiError(c, http.StatusNotFound, notFoundAPIError, "No match with id '"+name+"' exists.")
+		return
+	}
+	lastSeq := parseLastSeq(c.Query("lastSeq"))
+	if match != nil {
+		match.Mutex.Lock()
+		if err := match.claimSeat(color, bot.ID, c.Query("grant")); err != nil {
+			match.Mutex.Unlock()
+			apiError(c, http.StatusConflict, conflictAPIError, "Cannot join match '"+name+"' as "+color+". "+err.Error())
+			return
+		}
+		match.Mutex.Unlock()
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+	requestDone := c.Request.Context().Done()
+	if match == nil {
+		// the owner checks the seat
+		conn := newStreamClient(connLabel(name, color) + " (relayed)")
+		cl.relay(conn, func(func([]byte), func([]byte)) {
+			conn.streamPump(c.Writer, requestDone)
+		}, name, owner, color, bot.ID, bot.Name, c.Query("grant"), lastSeq)
+		return
+	}
+	conn := newStreamClient(connLabel(name, color))
+	match.Mutex.Lock()
+	match.attachPlayer(color, conn, lastSeq)
+	match.Mutex.Unlock()
+	cl.saveMatch(match)
+
+	conn.streamPump(c.Writer, requestDone)
+
+	match.Mutex.Lock()
+	match.detachPlayer(color, conn)
+	match.Mutex.Unlock()
+	cl.saveMatch(match)
+}
+
+// a client message for the seat, handled as if sent over its connection
+func (cl *Cluster) botAction(c *gin.Context) {
+	bot := c.MustGet(botUserKey).(*User)
+	name, color := c.Param("name"), c.Param("color")
+	if color != white && color != black {
+		apiError(c, http.StatusNotFound, notFoundAPIError, "Must specify black or white. Invalid match color: '"+color+"'.")
+		return
+	}
+	msg, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxMessageSize))
+	if err != nil {
+		apiError(c, http.StatusBadRequest, badRequestAPIError, "Message must be at most "+strconv.Itoa(maxMessageSize)+" bytes.")
+		return
+	}
+	messagesReceived.Inc()
+	if !cl.userBuckets.take(bot.ID) {
+		messagesDropped.Inc()
+		apiError(c, http.StatusTooManyRequests, rateLimitedError, "Sending messages too fast.")
+		return
+	}
+	match, owner, err := cl.localMatch(name)
+	if err != nil {
+		logger.Error("could not load match", "match", name, "err", err)
+	}
+	if match == nil && owner == "" {
+		apiError(c, http.StatusNotFound, notFoundAPIError, "No match with id '"+name+"' exists.")
+		return
+	}
+	if match != nil {
+		err = cl.seatMessage(match, color, bot.ID, msg)
+	} else {
+		err = cl.relayAction(owner, name, color, bot.ID, msg)
+	}
+	if err == errNotYourSeat {
+		apiError(c, http.StatusForbidden, forbiddenAPIError, err.Error())
+		return
+	}
+	if err != nil {
+		logger.Error("could not handle bot action", "match", name, "err", err)
+		apiError(c, http.StatusInternalServerError, internalAPIError, "Could not send the message.")
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"accepted": true})
+}
+
+// handle a client message for the seat (its replies go to the seat's connection)
+func (cl *Cluster) seatMessage(m *Match, color string, userID string, msg []byte) error {
+	m.Mutex.RLock()
+	seated := m.playerID(color) == userID
+	m.Mutex.RUnlock()
+	if !seated {
+		return errNotYourSeat
+	}
+	if cl.processMessage(msg, m, color) {
+		cl.saveMatch(m)
+	}
+	return nil
+}
+
+// pass a client message for the seat to the instance running the match
+// (which checks the seat again, as it may have changed since the summary was saved)
+func (cl *Cluster) relayAction(owner string, name string, color string, userID string, msg []byte) error {
+	summary, err := cl.loadSummary(name)
+	if err != nil {
+		return err
+	}
+	if summary == nil || (color == white && summary.WhitePlayerID != userID) ||
+		(color == black && summary.BlackPlayerID != userID) {
+		return errNotYourSeat
+	}
+	return cl.publishRelayEvent(owner, relayEvent{Kind: actionEvent, Match: name, Color: color, UserID: userID, Data: msg})
+}
+
+// a match the requester was challenged to, or challenged someone else to, which has yet to start
+type Challenge struct {
+	Match      APIMatch     `json:"match"`
+	Challenger string       `json:"challenger"` // name of the user who created the match
+	Challenged string       `json:"challenged"`
+	Seat       SeatResponse `json:"seat"` // the requester's
+}
+
+type ChallengesResponse struct {
+	Incoming []Challenge `json:"incoming"`
+	Outgoing []Challenge `json:"outgoing"`
+}
+
+func (cl *Cluster) challenges(user *User) (*ChallengesResponse, error) {
+	summaries, err := cl.listSummaries()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].StartTime < summaries[j].StartTime })
+	response := &ChallengesResponse{Incoming: []Challenge{}, Outgoing: []Challenge{}}
+	for _, summary := range summaries {
+		if summary.ChallengedID == "" || summary.Phase != readyUpPhase {
+			continue
+		}
+		color := white
+		if summary.BlackPlayerID == user.ID {
+			color = black
+		} else if summary.WhitePlayerID != user.ID {
+			continue
+		}
+		challenge := Challenge{Match: apiMatch(summary), Challenger: summary.CreatorName, Seat: seatResponse(summary.Name, color, "")}
+		if summary.ChallengedID == user.ID {
+			challenge.Challenged = user.Name
+			response.Incoming = append(response.Incoming, challenge)
+			continue
+		}
+		if challenged, err := cl.loadUser(summary.ChallengedID); err == nil && challenged != nil {
+			challenge.Challenged = challenged.Name
+		}
+		response.Outgoing = append(response.Outgoing, challenge)
+	}
+	return response, nil
+}
+
+func (cl *Cluster) apiChallenges(c *gin.Context) {
+	user := cl.apiUser(c)
+	if user == nil {
+		return
+	}
+	wait := time.Duration(0)
+	if s := c.Query("wait"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds < 0 {
+			apiError(c, http.StatusBadRequest, badRequestAPIError, "Invalid wait: '"+s+"'.")
+			return
+		}
+		wait = time.Duration(seconds) * time.Second
+		if wait > maxChallengeWait {
+			wait = maxChallengeWait
+		}
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		response, err := cl.challenges(user)
+		if err != nil {
+			logger.Error("could not list matches", "err", err)
+			apiError(c, http.StatusInternalServerError, internalAPIError, "Could not list challenges.")
+			return
+		}
+		if len(response.Incoming) > 0 || !time.Now().Before(deadline) || cl.shuttingDown() {
+			c.JSON(http.StatusOK, response)
+			return
+		}
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-time.After(challengePollInterval):
+		}
+	}
+}
+
+// reserve the other seat for the user named by the opponent setting (before the match is started)
+func (cl *Cluster) challenge(m *Match, challenger *User, color string, opponent string) error {
+	if m.WhiteAI || m.BlackAI {
+		return invalidSetting("A match against the AI can't be a challenge.")
+	}
+	opponentID, err := cl.Store.LookupUserKey(nameIndex, strings.ToLower(opponent))
+	if err != nil {
+		return err
+	}
+	if opponentID == "" {
+		return invalidSetting("No user named '%s' exists.", opponent)
+	}
+	if opponentID == challenger.ID {
+		return invalidSetting("You can't challenge yourself.")
+	}
+	if color == white {
+		m.BlackPlayerID = opponentID
+	} else {
+		m.WhitePlayerID = opponentID
+	}
+	m.ChallengedID = opponentID
+	return nil
+}
+
+// the challenged player turns down the match before it starts
+// assumes match mutex is held
+func (m *Match) declineChallenge(player string) error {
+	if m.Phase != readyUpPhase || m.ChallengedID == "" || m.ChallengedID != m.playerID(player) {
+		return protocolError(invalidActionError, "no challenge to decline")
+	}
+	m.Log = append(m.Log, player+" declined the challenge")
+	m.endMatch(none, declinedReason)
+	return nil
+}
+
+// the close code and reason a stream ends with (see streamPump)
+type ClosedPayload struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// (a websocket would instead get a close frame)
+func streamClosed(code int, reason string) []byte {
+	if code == 0 {
+		code = websocket.CloseNormalClosure
+	}
+	bytes, _ := encodeServerMessage(closedMsg, 0, 0, ClosedPayload{code, reason})
+	return bytes
+}
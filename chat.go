@@ -0,0 +1,177 @@
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Chat
+//
+// Players chat with each other, and spectators with each other: spectators can read the players' chat,
+// but players never see the spectators'. A message is either text or one of the quick emotes. Each
+// sender may send only chatRateLimit messages per chatRatePeriod, and a player can mute their opponent
+// (which hides the opponent's messages, past and future, until unmuted). The spectator chat is not part
+// of the spectators' state: it is sent to them as it is written, without the spectator delay.
+
+const (
+	maxChatLength   = 200 // characters
+	maxChatHistory  = 50  // messages kept per match, for each of the players and the spectators
+	chatRateLimit   = 5
+	chatRatePeriod  = 10 * time.Second
+	spectatorSender = "spectator"
+)
+
+// emote code -> text
+var emotes = map[string]string{
+	"gg":     "good game",
+	"wp":     "well played",
+	"gl":     "good luck",
+	"hf":     "have fun",
+	"thanks": "thanks",
+	"oops":   "oops",
+}
+
+type ChatMessage struct {
+	From  string `json:"from"` // color of player, or name of spectator
+	Text  string `json:"text"`
+	Emote string `json:"emote,omitempty"` // emote code if message is an emote
+	Time  int64  `json:"time"`            // unix nano
+}
+
+// payload of chat message from client: either text or an emote code
+type ChatPayload struct {
+	Text  string `json:"text"`
+	Emote string `json:"emote"`
+}
+
+// the whole spectator chat, sent to spectators whenever it changes
+type SpectatorChatPayload struct {
+	Chat []ChatMessage `json:"chat"`
+}
+
+type MutePayload struct {
+	Muted bool `json:"muted"`
+}
+
+// recent send times of one sender
+type chatLimiter []int64
+
+// records the send if the sender is under the rate limit
+func (l *chatLimiter) allow(now int64) bool {
+	recent := (*l)[:0]
+	for _, t := range *l {
+		if now-t < int64(chatRatePeriod) {
+			recent = append(recent, t)
+		}
+	}
+	*l = recent
+	if len(recent) >= chatRateLimit {
+		return false
+	}
+	*l = append(*l, now)
+	return true
+}
+
+// validate the payload and build the message (limiter is charged only for valid messages)
+func newChatMessage(from string, payload []byte, limiter *chatLimiter) (ChatMessage, error) {
+	var chat ChatPayload
+	if err := decodePayload(payload, &chat); err != nil {
+		return ChatMessage{}, err
+	}
+	msg := ChatMessage{From: from, Time: time.Now().UnixNano()}
+	if chat.Emote != "" {
+		text, ok := emotes[chat.Emote]
+		if !ok {
+			return msg, protocolError(badPayloadError, "unknown emote '"+chat.Emote+"'")
+		}
+		msg.Text, msg.Emote = text, chat.Emote
+	} else {
+		msg.Text = strings.TrimSpace(chat.Text)
+		if msg.Text == "" {
+			return msg, protocolError(badPayloadError, "empty chat message")
+		}
+		if !utf8.ValidString(msg.Text) || utf8.RuneCountInString(msg.Text) > maxChatLength {
+			return msg, protocolError(badPayloadError, "chat message too long")
+		}
+	}
+	if !limiter.allow(msg.Time) {
+		return msg, protocolError(rateLimitedError, "sending chat messages too fast")
+	}
+	return msg, nil
+}
+
+func appendChat(history []ChatMessage, msg ChatMessage) []ChatMessage {
+	history = append(history, msg)
+	if len(history) > maxChatHistory {
+		history = history[len(history)-maxChatHistory:]
+	}
+	return history
+}
+
+// assumes match mutex is held
+func (m *Match) playerChat(player string, payload []byte) error {
+	limiter := &m.whiteChatLimiter
+	if player == black {
+		limiter = &m.blackChatLimiter
+	}
+	msg, err := newChatMessage(player, payload, limiter)
+	if err != nil {
+		return err
+	}
+	m.Chat = appendChat(m.Chat, msg)
+	return nil
+}
+
+// assumes match mutex is held
+func (m *Match) mute(player string, payload []byte) error {
+	var mute MutePayload
+	if err := decodePayload(payload, &mute); err != nil {
+		return err
+	}
+	if player == black {
+		m.BlackMutedOpponent = mute.Muted
+	} else {
+		m.WhiteMutedOpponent = mute.Muted
+	}
+	return nil
+}
+
+// the player chat as seen by the player (without the opponent's messages if muted)
+// assumes match mutex is held
+func (m *Match) chatFor(player string) []ChatMessage {
+	muted := m.WhiteMutedOpponent
+	if player == black {
+		muted = m.BlackMutedOpponent
+	}
+	chat := []ChatMessage{}
+	for _, msg := range m.Chat {
+		if !muted || msg.From == player {
+			chat = append(chat, msg)
+		}
+	}
+	return chat
+}
+
+// (spectator chat which breaks the limits is dropped: spectators are not sent replies)
+// assumes match mutex is held
+func (m *Match) spectatorChat(conn *Client, payload []byte) bool {
+	if m.spectatorChatLimiters == nil {
+		m.spectatorChatLimiters = make(map[*Client]*chatLimiter)
+	}
+	limiter := m.spectatorChatLimiters[conn]
+	if limiter == nil {
+		limiter = &chatLimiter{}
+		m.spectatorChatLimiters[conn] = limiter
+	}
+	from := conn.Name
+	if from == "" {
+		from = spectatorSender
+	}
+	msg, err := newChatMessage(from, payload, limiter)
+	if err != nil {
+		return false
+	}
+	m.SpectatorChat = appendChat(m.SpectatorChat, msg)
+	return true
+}
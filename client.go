@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// a websocket connection (or a bot's HTTP stream) with its own writer goroutine
+// (all writes go through the Send queue, so the match mutex is never held
+// during a network write, and writes to the connection are never concurrent)
+type Client struct {
+	Conn      *websocket.Conn // nil for a connection relayed from another instance, or a stream
+	Send      chan []byte     // outbound messages; bounded so that a slow client can't hold up the match
+	Label     string          // identifies the connection in logs
+	Name      string          // name of the spectator's user (for chat)
+	done      chan struct{}
+	closeOnce sync.Once
+	closeCode int // close frame to send before closing the connection
+	closeText string
+}
+
+// what the owner of a match sends over the bus to the instance relaying a connection
+type relayFrame struct {
+	Data      json.RawMessage `json:",omitempty"` // server message
+	CloseCode int             `json:",omitempty"` // if not 0, the relaying instance should close the connection
+	CloseText string          `json:",omitempty"`
+}
+
+func newClient(conn *websocket.Conn, label string) *Client {
+	c := &Client{
+		Conn:  conn,
+		Send:  make(chan []byte, sendQueueSize),
+		Label: label,
+		done:  make(chan struct{}),
+	}
+	socketOpened(c)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+	go c.writePump()
+	return c
+}
+
+// sockets open to this instance (players, spectators, and the matchmaking queue)
+var openSockets = struct {
+	sync.Mutex
+	clients map[*Client]bool
+}{clients: make(map[*Client]bool)}
+
+func socketOpened(c *Client) {
+	openSockets.Lock()
+	openSockets.clients[c] = true
+	openSockets.Unlock()
+}
+
+func socketClosed(c *Client) {
+	openSockets.Lock()
+	delete(openSockets.clients, c)
+	openSockets.Unlock()
+}
+
+func openSocketCount() int {
+	openSockets.Lock()
+	defer openSockets.Unlock()
+	return len(openSockets.clients)
+}
+
+// (e.g. at shutdown)
+func closeAllSockets(code int, text string) {
+	openSockets.Lock()
+	defer openSockets.Unlock()
+	for c := range openSockets.clients {
+		c.close(code, text)
+	}
+}
+
+// queue message without blocking
+// a client whose queue is full is too slow to keep up, so we disconnect it
+// (it can reconnect and be replayed what it missed)
+func (c *Client) queue(bytes []byte) {
+	select {
+	case <-c.done:
+	case c.Send <- bytes:
+		messagesSent.Inc()
+	default:
+		logger.Warn("disconnecting slow client", "conn", c.Label)
+		c.close(websocket.CloseTryAgainLater, "too slow to receive messages")
+	}
+}
+
+// asks the writer goroutine to send a close frame and close the connection
+// (the reader then gets an error and cleans up as for any other disconnect)
+// safe to call more than once and from any goroutine
+func (c *Client) close(code int, text string) {
+	c.closeOnce.Do(func() {
+		c.closeCode, c.closeText = code, text
+		close(c.done)
+	})
+}
+
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.Conn.Close()
+		socketClosed(c)
+	}()
+	for {
+		select {
+		case bytes := <-c.Send:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.Conn.WriteMessage(websocket.TextMessage, bytes); err != nil {
+				if !websocket.IsCloseError(err) {
+					logger.Error("could not write message", "conn", c.Label, "err", err)
+				}
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-ticker.C:
+			// keeps connection alive (heroku times out connections with no activity for 55 seconds)
+			// and detects dead peers: the reader's deadline expires if no pong comes back
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-c.done:
+			// first send what was queued before the close (e.g. a final message)
+			deadline := time.Now().Add(writeWait)
+			c.Conn.SetWriteDeadline(deadline)
+			for len(c.Send) > 0 {
+				if c.Conn.WriteMessage(websocket.TextMessage, <-c.Send) != nil {
+					return
+				}
+			}
+			closeMsg := websocket.FormatCloseMessage(c.closeCode, c.closeText)
+			c.Conn.WriteControl(websocket.CloseMessage, closeMsg, deadline)
+			return
+		}
+	}
+}
+
+// a connection held by another instance to a match we own
+// (messages are published to the relaying instance rather than written to a socket;
+// keep alive is done by the relaying instance)
+func newRelayedClient(bus MessageBus, connID string, label string) *Client {
+	c := &Client{
+		Send:  make(chan []byte, sendQueueSize),
+		Label: label,
+		done:  make(chan struct{}),
+	}
+	go c.relayPump(bus, connChannel(connID))
+	return c
+}
+
+func (c *Client) relayPump(bus MessageBus, channel string) {
+	for {
+		select {
+		case bytes := <-c.Send:
+			if err := publishFrame(bus, channel, relayFrame{Data: bytes}); err != nil {
+				logger.Error("could not relay message", "conn", c.Label, "err", err)
+				c.close(websocket.CloseTryAgainLater, "")
+			}
+		case <-c.done:
+			for len(c.Send) > 0 {
+				publishFrame(bus, channel, relayFrame{Data: <-c.Send})
+			}
+			publishFrame(bus, channel, relayFrame{CloseCode: c.closeCode, CloseText: c.closeText})
+			return
+		}
+	}
+}
+
+// a bot's HTTP stream (see bots.go); written by streamPump, in the request's goroutine
+func newStreamClient(label string) *Client {
+	c := &Client{
+		Send:  make(chan []byte, sendQueueSize),
+		Label: label,
+		done:  make(chan struct{}),
+	}
+	socketOpened(c)
+	return c
+}
+
+// write messages to the response, one per line, until the client is closed or the request is done
+func (c *Client) streamPump(w gin.ResponseWriter, requestDone <-chan struct{}) {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		socketClosed(c)
+	}()
+	write := func(bytes []byte) bool {
+		if _, err := w.Write(bytes); err != nil {
+			return false
+		}
+		if _, err := w.Write([]byte("\n")); err != nil {
+			return false
+		}
+		w.Flush()
+		return true
+	}
+	for {
+		select {
+		case bytes := <-c.Send:
+			if !write(bytes) {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-ticker.C:
+			// (a blank line keeps the connection alive, as pings do a websocket)
+			if !write(nil) {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-requestDone:
+			c.close(websocket.CloseGoingAway, "")
+			return
+		case <-c.done:
+			for len(c.Send) > 0 {
+				if !write(<-c.Send) {
+					return
+				}
+			}
+			write(streamClosed(c.closeCode, c.closeText))
+			return
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// runs for life of the match, advancing the turn when the turn timer expires,
+// forfeiting a player whose time bank runs out, and handling players who stay disconnected
+// (the server is authoritative: we don't rely upon clients to report expiry)
+// gameOver is called (in a new goroutine) once the match is over
+func runMatchClock(m *Match, gameOver func(*Match)) {
+	ticker := time.NewTicker(clockTickInterval)
+	defer ticker.Stop()
+	reported := false
+	for range ticker.C {
+		m.Mutex.Lock()
+		if m.stopped() {
+			m.Mutex.Unlock()
+			return
+		}
+		if m.Phase == gameoverPhase && !reported {
+			reported = true
+			go gameOver(m)
+		}
+		m.flushSpectatorBacklog()
+		// keep running after gameover until delayed spectators have seen the end
+		if m.Phase == gameoverPhase && len(m.spectatorBacklog) == 0 {
+			m.Mutex.Unlock()
+			return
+		}
+		currentRound := m.Round
+		changed := false
+		crashed := m.guard("clock", func() {
+			disconnectsChanged := m.checkDisconnects()
+			changed = m.checkClock() || disconnectsChanged
+		})
+		if changed && !crashed {
+			newRound := m.Round > currentRound
+			m.sendState(black, true, newRound)
+			m.sendState(white, true, newRound)
+			m.sendSpectators(true, newRound)
+		}
+		m.Mutex.Unlock()
+	}
+}
+
+// remaining turn time in nanoseconds (negative if expired)
+func (m *Match) turnRemaining() int64 {
+	return m.TurnTimer - (time.Now().UnixNano() - m.LastMoveTime)
+}
+
+// remaining time bank in nanoseconds for the player
+// (includes time spent so far in the current turn if it is the player's turn)
+func (m *Match) timeBankRemaining(color string) int64 {
+	remaining := m.WhiteTimeBank
+	if color == black {
+		remaining = m.BlackTimeBank
+	}
+	if m.Phase == mainPhase && m.Turn == color {
+		remaining -= time.Now().UnixNano() - m.LastMoveTime
+	}
+	return remaining
+}
+
+// deduct time used in the turn from the player's time bank and add the increment
+// (should be called before LastMoveTime is updated for the next turn)
+func (m *Match) chargeTimeBank(color string) {
+	if m.TimeBank == 0 || m.Phase != mainPhase {
+		return
+	}
+	elapsed := time.Now().UnixNano() - m.LastMoveTime
+	bank := &m.WhiteTimeBank
+	if color == black {
+		bank = &m.BlackTimeBank
+	}
+	*bank -= elapsed
+	if *bank > 0 {
+		*bank += m.TimeIncrement
+	}
+}
+
+// returns true if the turn timer or a time bank expired (and so state changed)
+func (m *Match) checkClock() bool {
+	switch m.Phase {
+	case mainPhase:
+		if m.TimeBank > 0 && m.timeBankRemaining(m.Turn) <= 0 {
+			m.Log = append(m.Log, m.Turn+" ran out of time")
+			m.endMatch(otherColor(m.Turn), timeoutReason)
+			return true
+		}
+		if m.turnRemaining() > 0 {
+			return false
+		}
+		m.Log = append(m.Log, m.Turn+"'s turn timer expired")
+		if !m.playRandomCard(m.Turn) {
+			m.Log = append(m.Log, m.Turn+" passed")
+			m.EndTurn(false, m.Turn)
+		}
+		return true
+	case kingPlacementPhase:
+		if m.turnRemaining() > 0 {
+			return false
+		}
+		for _, color := range []string{black, white} {
+			public, private := m.states(color)
+			if !public.KingPlayed {
+				// randomly place king in free square
+				// Because we must have reclaimed the King, there will always be a free square at this point
+				pos, _ := RandomFreeSquare(color, &m.Board)
+				private.KingPos = &pos
+				public.KingPlayed = true
+				m.Log = append(m.Log, color+" played King")
+			}
+		}
+		m.EndKingPlacement()
+		return true
+	}
+	return false
+}
+
+// play a random playable card in a random valid position
+// returns false if no card can be played
+func (m *Match) playRandomCard(color string) bool {
+	public, private := m.states(color)
+	for _, cardIdx := range rand.Perm(len(private.Cards)) {
+		if !private.PlayableCards[cardIdx] {
+			continue
+		}
+		card := private.Cards[cardIdx]
+		candidates := []Pos{}
+		for _, idx := range validCardPositions(card.Name, color, m, &m.Board) {
+			pos := positions[idx]
+			if canPlayCard(m, card.Name, card.Type, color, public, pos, &m.Board) {
+				candidates = append(candidates, pos)
+			}
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+		private.SelectedCard = cardIdx
+		m.clickBoard(color, public, private, candidates[rand.Intn(len(candidates))], &m.Board)
+		return true
+	}
+	return false
+}
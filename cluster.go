@@ -0,0 +1,600 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/gorilla/websocket"
+)
+
+// Running as multiple instances
+//
+// Each match is owned by one instance, which runs its clock and processes its events as if it
+// were the only instance. A websocket connection to an instance which does not own the match is
+// relayed over the bus: the relaying instance publishes the client's messages (and attach,
+// heartbeat, and detach events) to the owner's channel, and the owner publishes what it would
+// have written to the socket to the connection's channel.
+//
+// The owner renews its lease on the match and saves the match to the store every leaseRenewPeriod.
+// If the owner goes away, its lease lapses, and the next instance to get a connection for the
+// match restores the match from the store and takes over.
+
+// bus channels
+func instanceChannel(instance string) string {
+	return "chrss:instance:" + instance
+}
+
+func connChannel(connID string) string {
+	return "chrss:conn:" + connID
+}
+
+// this instance's part in running the matches
+type Cluster struct {
+	ID           string // identifies this instance
+	Store        MatchStore
+	Bus          MessageBus
+	Matches      *MatchMap              // matches owned by this instance
+	relayQueues  map[string]*relayQueue // events relayed to our matches by other instances, by match name
+	relayMutex   sync.Mutex             // guards relayQueues
+	userBuckets  *UserBuckets           // for flood protection
+	reaperConfig ReaperConfig           // how long finished, abandoned, and idle matches are kept
+	draining     int32                  // set (atomically) once shutting down
+}
+
+// what an instance needs to know of a match it does not own (e.g. to list it)
+type MatchSummary struct {
+	Name          string
+	CreatorName   string
+	StartTime     int64
+	LastMoveTime  int64
+	WhitePlayerID string
+	BlackPlayerID string
+	Open          bool   // a seat can be taken (and the match is not private)
+	OpenColor     string // color of that seat
+	Locked        bool   // has a password
+	Private       bool
+	Live          bool
+	DevMode       bool
+	Phase         Phase
+	Round         int
+	WhitePresence string // connected, disconnected, or ai
+	BlackPresence string
+	Spectators    int
+	Rated         bool
+	MaxRounds     int
+	TimeBank      int64 // nanoseconds
+	TimeIncrement int64
+	ChallengedID  string
+}
+
+// relayEvent kinds
+const (
+	attachEvent    = "attach"
+	messageEvent   = "message"
+	heartbeatEvent = "heartbeat"
+	detachEvent    = "detach"
+	limitedEvent   = "limited" // Data is a player's message dropped by the flood limits (see flood.go)
+	adminEvent     = "admin"   // Data is an AdminAction (not from a client connection)
+	actionEvent    = "action"  // Data is a client message POSTed for the seat by its player (see bots.go)
+)
+
+// sent to the owner of a match by the instance relaying a connection
+type relayEvent struct {
+	Kind    string
+	ConnID  string
+	Match   string
+	Color   string // empty for spectator
+	UserID  string
+	Name    string // user's name (for spectator chat)
+	Grant   string // for attach (see claimSeat), or a spectator's invite token (see canWatch)
+	LastSeq int64  // for attach
+	Data    []byte // client message (not necessarily valid JSON)
+}
+
+// the relayed events of one match, handled in order by the queue's goroutine
+// (so one slow match doesn't hold up the others)
+type relayQueue struct {
+	events  chan relayEvent
+	pending int                    // events queued but not yet handled (guarded by the cluster's relayMutex)
+	remotes map[string]*remoteConn // connections relayed to the match, by conn id (used only by the queue's goroutine)
+}
+
+const relayQueueSize = 64
+
+type remoteConn struct {
+	client   *Client
+	match    *Match
+	color    string // empty for spectator
+	lastSeen time.Time
+}
+
+func newCluster(store MatchStore, bus MessageBus, matches *MatchMap) (*Cluster, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	cl := &Cluster{
+		ID:           id.String(),
+		Store:        store,
+		Bus:          bus,
+		Matches:      matches,
+		relayQueues:  make(map[string]*relayQueue),
+		userBuckets:  NewUserBuckets(),
+		reaperConfig: loadReaperConfig(),
+	}
+	events, _, err := bus.Subscribe(instanceChannel(cl.ID))
+	if err != nil {
+		return nil, err
+	}
+	go cl.dispatch(events)
+	notices, _, err := bus.Subscribe(noticeChannel)
+	if err != nil {
+		return nil, err
+	}
+	go cl.receiveNotices(notices)
+	cl.registerGauges()
+	go cl.renewLeases()
+	go cl.runMatchmaker()
+	go cl.runReaper()
+	logger.Info("started instance", "instance", cl.ID)
+	return cl, nil
+}
+
+func (m *Match) summary() MatchSummary {
+	return MatchSummary{
+		Name:          m.Name,
+		CreatorName:   m.CreatorName,
+		StartTime:     m.StartTime,
+		LastMoveTime:  m.LastMoveTime,
+		WhitePlayerID: m.WhitePlayerID,
+		BlackPlayerID: m.BlackPlayerID,
+		Open:          m.openColor() != "" && !m.Private,
+		OpenColor:     m.openColor(),
+		Locked:        m.PasswordHash != "",
+		Private:       m.Private,
+		Live:          m.IsLive(),
+		DevMode:       m.DevMode,
+		Phase:         m.Phase,
+		Round:         m.Round,
+		WhitePresence: m.presence(white),
+		BlackPresence: m.presence(black),
+		Spectators:    len(m.Spectators),
+		Rated:         m.Rated,
+		MaxRounds:     m.MaxRounds,
+		TimeBank:      m.TimeBank,
+		TimeIncrement: m.TimeIncrement,
+		ChallengedID:  m.ChallengedID,
+	}
+}
+
+// save match so that other instances can list it (and take it over if we go away),
+// along with its new replay frames
+// locks match mutex
+func (cl *Cluster) saveMatch(m *Match) {
+	// saves of the match are made in order (so that an older state never overwrites a newer one)
+	m.saveMutex.Lock()
+	defer m.saveMutex.Unlock()
+	m.Mutex.Lock()
+	if m.disowned || m.reaped {
+		m.Mutex.Unlock()
+		return
+	}
+	state, err := json.Marshal(m)
+	if err != nil {
+		m.Mutex.Unlock()
+		m.logger().Error("could not JSON encode match", "err", err)
+		return
+	}
+	summary, err := json.Marshal(m.summary())
+	frames := m.replayFrames
+	m.replayFrames = nil
+	m.Mutex.Unlock()
+	if err != nil {
+		m.logger().Error("could not JSON encode match summary", "err", err)
+		return
+	}
+	if err := cl.Store.SaveMatch(m.Name, summary, state); err != nil {
+		m.logger().Error("could not save match", "err", err)
+	}
+	if len(frames) > 0 {
+		if err := cl.Store.AddReplayFrames(m.Name, frames); err != nil {
+			m.logger().Error("could not save replay", "err", err)
+		}
+	}
+}
+
+// remove a finished or timed out match from the store
+func (cl *Cluster) deleteMatch(name string) {
+	if err := cl.Store.DeleteMatch(name); err != nil {
+		logger.Error("could not delete match", "match", name, "err", err)
+	}
+	if err := cl.Store.ReleaseMatch(name, cl.ID); err != nil {
+		logger.Error("could not release match", "match", name, "err", err)
+	}
+}
+
+// nil if no such match
+func (cl *Cluster) loadSummary(name string) (*MatchSummary, error) {
+	bytes, err := cl.Store.LoadMatchSummary(name)
+	if err != nil || bytes == nil {
+		return nil, err
+	}
+	summary := &MatchSummary{}
+	if err := json.Unmarshal(bytes, summary); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+func (cl *Cluster) listSummaries() ([]MatchSummary, error) {
+	list, err := cl.Store.ListMatchSummaries()
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]MatchSummary, 0, len(list))
+	for _, bytes := range list {
+		var summary MatchSummary
+		if err := json.Unmarshal(bytes, &summary); err != nil {
+			logger.Error("could not JSON decode match summary", "err", err)
+			continue
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// returns the match if this instance owns it (taking it over if no instance does)
+// otherwise returns the owning instance ("" if there is no such match)
+func (cl *Cluster) localMatch(name string) (*Match, string, error) {
+	if m, ok := cl.Matches.Load(name); ok {
+		return m, cl.ID, nil
+	}
+	if cl.shuttingDown() {
+		return nil, "", errShuttingDown
+	}
+	state, err := cl.Store.LoadMatch(name)
+	if err != nil || state == nil {
+		return nil, "", err
+	}
+	owner, err := cl.Store.AcquireMatch(name, cl.ID, leaseTTL)
+	if err != nil || owner != cl.ID {
+		return nil, owner, err
+	}
+	// the owner went away, so we take over
+	// (reload in case the match was saved before the owner gave up its lease)
+	state, err = cl.Store.LoadMatch(name)
+	var m *Match
+	if err == nil && state != nil {
+		m, err = restoreMatch(state)
+	}
+	if err != nil || m == nil {
+		cl.Store.ReleaseMatch(name, cl.ID)
+		return nil, "", err
+	}
+	cl.Matches.Lock()
+	if existing, ok := cl.Matches.internal[name]; ok {
+		// restored concurrently by another request
+		cl.Matches.Unlock()
+		return existing, cl.ID, nil
+	}
+	cl.Matches.internal[name] = m
+	cl.Matches.Unlock()
+	m.logger().Info("took over match")
+	go runMatchClock(m, cl.matchOver)
+	return m, cl.ID, nil
+}
+
+// rebuild a match saved by another instance
+func restoreMatch(state []byte) (*Match, error) {
+	m, err := decodeMatch(state)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UnixNano()
+	m.resumeAfterShutdown(now)
+	// the players were connected to the previous owner, so they get the grace period to reconnect here
+	for _, color := range []string{white, black} {
+		disconnectTime, takeover := m.disconnectState(color)
+		isAI := (color == white && m.WhiteAI) || (color == black && m.BlackAI)
+		if *disconnectTime == 0 && (!isAI || *takeover) {
+			*disconnectTime = now
+		}
+	}
+	return m, nil
+}
+
+// a copy of a saved match (not run: for restoring, or for reading the state of a match run elsewhere)
+func decodeMatch(state []byte) (*Match, error) {
+	m := &Match{}
+	if err := json.Unmarshal(state, m); err != nil {
+		return nil, err
+	}
+	for i, p := range m.Board.Pieces {
+		if p != nil {
+			m.Board.PiecesActual[i] = *p
+			m.Board.Pieces[i] = &m.Board.PiecesActual[i]
+		}
+	}
+	m.WhitePublic.Other = &m.BlackPublic
+	m.BlackPublic.Other = &m.WhitePublic
+	m.WhitePrivate.Other = &m.BlackPrivate
+	m.BlackPrivate.Other = &m.WhitePrivate
+	return m, nil
+}
+
+// renew leases of our matches and save them
+// (a match whose lease has been taken by another instance is disowned)
+func (cl *Cluster) renewLeases() {
+	ticker := time.NewTicker(leaseRenewPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, m := range cl.Matches.List() {
+			owner, err := cl.Store.AcquireMatch(m.Name, cl.ID, leaseTTL)
+			if err != nil {
+				m.logger().Error("could not renew match lease", "err", err)
+				continue
+			}
+			if owner != cl.ID {
+				cl.disown(m)
+				continue
+			}
+			cl.saveMatch(m)
+		}
+	}
+}
+
+// stop running a match now owned by another instance
+// (its clients reconnect and are relayed to the new owner)
+func (cl *Cluster) disown(m *Match) {
+	m.logger().Warn("lost ownership of match")
+	cl.Matches.Lock()
+	if cl.Matches.internal[m.Name] == m {
+		delete(cl.Matches.internal, m.Name)
+	}
+	cl.Matches.Unlock()
+	m.Mutex.Lock()
+	m.disowned = true
+	for _, conn := range []*Client{m.WhiteConn, m.BlackConn} {
+		if conn != nil {
+			conn.close(websocket.CloseTryAgainLater, "Match moved to another server.")
+		}
+	}
+	for conn := range m.Spectators {
+		conn.close(websocket.CloseTryAgainLater, "Match moved to another server.")
+	}
+	m.Mutex.Unlock()
+}
+
+// relay a connection to the instance which owns the match, passing it the client messages read
+// (and those of a player dropped by the flood limits, for the owner to reply to)
+// (color is empty for spectator)
+func (cl *Cluster) relay(conn *Client, read func(handle func([]byte), limited func([]byte)), name string,
+	owner string, color string, userID string, userName string, grant string, lastSeq int64) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		logger.Error("could not generate UUIDv4", "err", err)
+		conn.close(websocket.CloseTryAgainLater, "")
+		return
+	}
+	frames, unsubscribe, err := cl.Bus.Subscribe(connChannel(id.String()))
+	if err != nil {
+		logger.Error("could not subscribe to relay channel", "err", err)
+		conn.close(websocket.CloseTryAgainLater, "")
+		return
+	}
+	defer unsubscribe()
+	send := func(kind string, data []byte) {
+		cl.publishRelayEvent(owner, relayEvent{kind, id.String(), name, color, userID, userName, grant, lastSeq, data})
+	}
+
+	go forwardFrames(frames, conn)
+
+	// the owner drops the connection if it stops hearing from us,
+	// and we drop it if the match moves to another owner
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(pingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				send(heartbeatEvent, nil)
+				if current, err := cl.Store.MatchOwner(name); err == nil && current != owner {
+					conn.close(websocket.CloseTryAgainLater, "Match moved to another server.")
+				}
+			}
+		}
+	}()
+
+	send(attachEvent, nil)
+	read(func(msg []byte) {
+		send(messageEvent, msg)
+	}, func(msg []byte) {
+		if color != "" {
+			send(limitedEvent, msg)
+		}
+	})
+	send(detachEvent, nil)
+	conn.close(websocket.CloseNormalClosure, "")
+}
+
+func (cl *Cluster) publishRelayEvent(owner string, event relayEvent) error {
+	bytes, err := json.Marshal(event)
+	if err == nil {
+		err = cl.Bus.Publish(instanceChannel(owner), bytes)
+	}
+	if err != nil {
+		logger.Error("could not relay event", "event", event.Kind, "instance", owner, "err", err)
+	}
+	return err
+}
+
+// identifies a player's or spectator's (color "") connection in logs
+func connLabel(name string, color string) string {
+	if color == "" {
+		return "spectator connection in match " + name
+	}
+	return color + " connection in match " + name
+}
+
+// pass frames published for a connection to the socket (until unsubscribed)
+func forwardFrames(frames <-chan []byte, conn *Client) {
+	for bytes := range frames {
+		var frame relayFrame
+		if err := json.Unmarshal(bytes, &frame); err != nil {
+			continue
+		}
+		if frame.CloseCode != 0 {
+			conn.close(frame.CloseCode, frame.CloseText)
+		} else {
+			conn.queue(frame.Data)
+		}
+	}
+}
+
+// handle events from instances relaying connections to our matches
+func (cl *Cluster) dispatch(events <-chan []byte) {
+	for bytes := range events {
+		var event relayEvent
+		if err := json.Unmarshal(bytes, &event); err != nil {
+			logger.Error("could not JSON decode relay event", "err", err)
+			continue
+		}
+		cl.relayMutex.Lock()
+		q := cl.relayQueues[event.Match]
+		if q == nil {
+			q = &relayQueue{events: make(chan relayEvent, relayQueueSize), remotes: make(map[string]*remoteConn)}
+			cl.relayQueues[event.Match] = q
+			go cl.handleRelayQueue(event.Match, q)
+		}
+		q.pending++
+		cl.relayMutex.Unlock()
+		q.events <- event
+	}
+}
+
+// handle the match's relayed events until it has no relayed connections and no events waiting
+func (cl *Cluster) handleRelayQueue(name string, q *relayQueue) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		handled := 0
+		select {
+		case event := <-q.events:
+			cl.handleRelayEvent(event, q.remotes)
+			handled = 1
+		case <-ticker.C:
+			// relaying instance may have gone away without detaching
+			for connID, remote := range q.remotes {
+				if time.Since(remote.lastSeen) > pongWait {
+					delete(q.remotes, connID)
+					cl.detach(remote)
+				}
+			}
+		}
+		cl.relayMutex.Lock()
+		q.pending -= handled
+		if q.pending == 0 && len(q.remotes) == 0 {
+			delete(cl.relayQueues, name)
+			cl.relayMutex.Unlock()
+			return
+		}
+		cl.relayMutex.Unlock()
+	}
+}
+
+// remotes are the match's relayed connections
+func (cl *Cluster) handleRelayEvent(event relayEvent, remotes map[string]*remoteConn) {
+	switch event.Kind {
+	case attachEvent:
+		if remote := cl.attach(event); remote != nil {
+			remotes[event.ConnID] = remote
+		}
+		return
+	case adminEvent:
+		cl.handleAdminEvent(event)
+		return
+	case actionEvent:
+		if m, ok := cl.Matches.Load(event.Match); ok {
+			if err := cl.seatMessage(m, event.Color, event.UserID, event.Data); err != nil {
+				m.playerLogger(event.Color).Warn("dropped relayed action", "user", event.UserID, "err", err)
+			}
+		}
+		return
+	}
+	remote := remotes[event.ConnID]
+	if remote == nil {
+		return
+	}
+	remote.lastSeen = time.Now()
+	switch event.Kind {
+	case messageEvent:
+		if remote.color == "" {
+			spectatorMessage(event.Data, remote.match, remote.client)
+		} else if cl.processMessage(event.Data, remote.match, remote.color) {
+			cl.saveMatch(remote.match)
+		}
+	case limitedEvent:
+		rejectLimited(event.Data, remote.match, remote.color)
+	case detachEvent:
+		delete(remotes, event.ConnID)
+		cl.detach(remote)
+	}
+}
+
+// returns nil if the connection is refused
+func (cl *Cluster) attach(event relayEvent) *remoteConn {
+	conn := newRelayedClient(cl.Bus, event.ConnID, connLabel(event.Match, event.Color)+" (relayed)")
+	conn.Name = event.Name
+	if cl.shuttingDown() {
+		conn.close(closeRestartingCode, restartCloseText)
+		return nil
+	}
+	match, ok := cl.Matches.Load(event.Match)
+	if !ok {
+		// relaying instance should reconnect and find the current owner
+		conn.close(websocket.CloseTryAgainLater, "Match is not run by this server.")
+		return nil
+	}
+	match.Mutex.Lock()
+	if event.Color == "" {
+		if !match.canWatch(event.UserID, event.Grant) {
+			match.Mutex.Unlock()
+			conn.close(closeRejectedCode, "No match with id '"+event.Match+"' exists.")
+			return nil
+		}
+		if !match.addSpectator(conn, event.LastSeq) {
+			match.Mutex.Unlock()
+			conn.close(websocket.CloseTryAgainLater, "Match is at max spectators.")
+			return nil
+		}
+	} else {
+		if err := match.claimSeat(event.Color, event.UserID, event.Grant); err != nil {
+			match.Mutex.Unlock()
+			conn.close(closeRejectedCode, err.Error())
+			return nil
+		}
+		match.attachPlayer(event.Color, conn, event.LastSeq)
+	}
+	match.Mutex.Unlock()
+	cl.saveMatch(match)
+	return &remoteConn{conn, match, event.Color, time.Now()}
+}
+
+func (cl *Cluster) detach(remote *remoteConn) {
+	remote.match.Mutex.Lock()
+	if remote.color == "" {
+		remote.client.close(websocket.CloseNormalClosure, "")
+		remote.match.removeSpectator(remote.client)
+	} else {
+		remote.match.detachPlayer(remote.color, remote.client)
+	}
+	remote.match.Mutex.Unlock()
+	cl.saveMatch(remote.match)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// wait up to a second for done to hold
+func eventually(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !done(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// a match held up handling a relayed event doesn't hold up the others
+func TestDispatchPerMatch(t *testing.T) {
+	cl := &Cluster{
+		ID:          "test",
+		Store:       newMemoryStore(),
+		Bus:         newMemoryBus(),
+		Matches:     NewMatchMap(),
+		relayQueues: make(map[string]*relayQueue),
+		userBuckets: NewUserBuckets(),
+	}
+	slow, other := newMatch("a"), newMatch("b")
+	slow.Name, other.Name = "Slow-Match", "Other-Match"
+	cl.Matches.Store(slow)
+	cl.Matches.Store(other)
+	events := make(chan []byte)
+	defer close(events)
+	go cl.dispatch(events)
+	send := func(kind string, match string, connID string) {
+		bytes, err := json.Marshal(relayEvent{Kind: kind, ConnID: connID, Match: match, UserID: "u" + connID, LastSeq: -1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		events <- bytes
+	}
+	spectators := func(m *Match) int {
+		m.Mutex.RLock()
+		defer m.Mutex.RUnlock()
+		return len(m.Spectators)
+	}
+
+	slow.Mutex.Lock()
+	send(attachEvent, slow.Name, "1")
+	send(attachEvent, other.Name, "2")
+	eventually(t, "spectator of the other match", func() bool { return spectators(other) == 1 })
+	slow.Mutex.Unlock()
+	eventually(t, "spectator of the slow match", func() bool { return spectators(slow) == 1 })
+
+	send(detachEvent, slow.Name, "1")
+	send(detachEvent, other.Name, "2")
+	eventually(t, "queues to finish", func() bool {
+		cl.relayMutex.Lock()
+		defer cl.relayMutex.Unlock()
+		return len(cl.relayQueues) == 0
+	})
+	if spectators(slow) != 0 || spectators(other) != 0 {
+		t.Fatalf("%d and %d spectators left, want none", spectators(slow), spectators(other))
+	}
+}
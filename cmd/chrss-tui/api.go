@@ -0,0 +1,131 @@
+//go:build linux || dragonfly || freebsd || netbsd || openbsd
+// +build linux dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// requests to the server's JSON API (see api.go in the server), as one user
+type apiClient struct {
+	base   *url.URL
+	client *http.Client
+	header http.Header // Authorization, for a bot
+}
+
+// a seat as returned by the API
+type seatResponse struct {
+	Match      string `json:"match"`
+	Color      string `json:"color"`
+	Socket     string `json:"socket"`
+	InviteLink string `json:"inviteLink"`
+}
+
+type apiErrorResponse struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// session is a session cookie value and token a bot's API token (both may be empty, for a new anonymous user)
+func newAPIClient(server string, session string, token string) (*apiClient, error) {
+	base, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, errors.New("server must be an http or https URL")
+	}
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	if session != "" {
+		jar.SetCookies(base, []*http.Cookie{{Name: "session", Value: session, Path: "/"}})
+	}
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	return &apiClient{base, &http.Client{Jar: jar, Timeout: 10 * time.Second}, header}, nil
+}
+
+// POST body as JSON and decode the response into out
+func (a *apiClient) post(path string, body interface{}, out interface{}) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", a.base.ResolveReference(&url.URL{Path: path}).String(), bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	for key, values := range a.header {
+		request.Header[key] = values
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := a.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		var apiErr apiErrorResponse
+		if json.NewDecoder(response.Body).Decode(&apiErr) == nil && apiErr.Error.Message != "" {
+			return errors.New(apiErr.Error.Message)
+		}
+		return fmt.Errorf("%s %s: %s", request.Method, path, response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(out)
+}
+
+// create a match with the settings (as for POST /api/v1/matches)
+func (a *apiClient) createMatch(settings map[string]interface{}) (*seatResponse, error) {
+	seat := &seatResponse{}
+	return seat, a.post("/api/v1/matches", settings, seat)
+}
+
+// take the open seat of the match (or get the seat already held)
+func (a *apiClient) join(name string, invite string, password string) (*seatResponse, error) {
+	seat := &seatResponse{}
+	body := map[string]string{"invite": invite, "password": password}
+	return seat, a.post("/api/v1/matches/"+url.PathEscape(name)+"/join", body, seat)
+}
+
+// open a websocket; socket is a path with any query (e.g. a SeatResponse's socket)
+func (a *apiClient) dial(socket string, lastSeq int64) (*websocket.Conn, error) {
+	u, err := a.base.Parse(socket)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	if lastSeq > 0 {
+		query := u.Query()
+		query.Set("lastSeq", strconv.FormatInt(lastSeq, 10))
+		u.RawQuery = query.Encode()
+	}
+	dialer := websocket.Dialer{Jar: a.client.Jar, HandshakeTimeout: 10 * time.Second}
+	conn, response, err := dialer.Dial(u.String(), a.header)
+	if err != nil && response != nil {
+		// (the server explains a refused seat in the body)
+		buf := make([]byte, 512)
+		n, _ := response.Body.Read(buf)
+		if message := strings.TrimSpace(string(buf[:n])); message != "" {
+			return nil, errors.New(message)
+		}
+	}
+	return conn, err
+}
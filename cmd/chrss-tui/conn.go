@@ -0,0 +1,158 @@
+//go:build linux || dragonfly || freebsd || netbsd || openbsd
+// +build linux dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// server close codes (see the server's types.go)
+const (
+	closeReplacedCode   = 4001
+	closeRejectedCode   = 4002
+	closeMatchEndedCode = 4003
+	closeRestartingCode = 4004
+)
+
+const (
+	reconnectDelay = 3 * time.Second
+	readTimeout    = 75 * time.Second // the server pings more often than this
+	writeWait      = 10 * time.Second
+)
+
+var errNotConnected = errors.New("not connected")
+
+// what a seat's connection reports to the event loop
+type connEvent struct {
+	seat     *seat
+	msg      *serverMessage // nil for a change in the connection
+	status   string         // e.g. "connected" or why the connection closed
+	finished bool           // the connection closed for good
+}
+
+// a player seat played over its websocket (reconnecting as the site does when the server restarts
+// or the connection drops)
+type seat struct {
+	color  string
+	socket string // websocket path
+	view   seatView
+	// (the above and connStatus are only used by the event loop)
+	connStatus string
+	api        *apiClient
+	events     chan<- connEvent
+
+	mutex   sync.Mutex // guards the following
+	conn    *websocket.Conn
+	seq     int64 // of the last client message sent
+	lastSeq int64 // of the last server message received
+}
+
+// connect, and keep reconnecting until the connection is closed for good
+// (runs in its own goroutine)
+func (s *seat) run() {
+	for {
+		s.mutex.Lock()
+		lastSeq := s.lastSeq
+		s.mutex.Unlock()
+		conn, err := s.api.dial(s.socket, lastSeq)
+		if err != nil {
+			s.events <- connEvent{seat: s, status: "could not connect: " + err.Error(), finished: true}
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		conn.SetPingHandler(func(data string) error {
+			conn.SetReadDeadline(time.Now().Add(readTimeout))
+			return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeWait))
+		})
+		s.mutex.Lock()
+		s.conn = conn
+		s.mutex.Unlock()
+		s.events <- connEvent{seat: s, status: "connected"}
+
+		code, text := s.read(conn)
+
+		s.mutex.Lock()
+		s.conn = nil
+		s.mutex.Unlock()
+		conn.Close()
+		switch code {
+		case websocket.CloseNormalClosure, websocket.ClosePolicyViolation, closeReplacedCode, closeRejectedCode, closeMatchEndedCode:
+			s.events <- connEvent{seat: s, status: "disconnected: " + closeReason(code, text), finished: true}
+			return
+		}
+		s.events <- connEvent{seat: s, status: "reconnecting (" + closeReason(code, text) + ")"}
+		time.Sleep(reconnectDelay)
+	}
+}
+
+// pass server messages to the event loop until the connection closes
+// returns the close code and text
+func (s *seat) read(conn *websocket.Conn) (int, string) {
+	for {
+		_, bytes, err := conn.ReadMessage()
+		if err != nil {
+			if closeErr, ok := err.(*websocket.CloseError); ok {
+				return closeErr.Code, closeErr.Text
+			}
+			return websocket.CloseAbnormalClosure, err.Error()
+		}
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		msg := &serverMessage{}
+		if err := json.Unmarshal(bytes, msg); err != nil {
+			continue
+		}
+		s.mutex.Lock()
+		if msg.Seq > s.lastSeq {
+			s.lastSeq = msg.Seq
+		}
+		s.mutex.Unlock()
+		s.events <- connEvent{seat: s, msg: msg}
+	}
+}
+
+func closeReason(code int, text string) string {
+	if text != "" {
+		return text
+	}
+	switch code {
+	case closeRestartingCode:
+		return "server restarting"
+	case websocket.CloseAbnormalClosure:
+		return "connection lost"
+	}
+	return "closed"
+}
+
+// send a client message (payload may be nil)
+func (s *seat) send(msgType string, payload interface{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn == nil {
+		return errNotConnected
+	}
+	s.seq++
+	msg := map[string]interface{}{"v": 1, "type": msgType, "seq": s.seq}
+	if payload != nil {
+		msg["payload"] = payload
+	}
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return s.conn.WriteMessage(websocket.TextMessage, bytes)
+}
+
+func (s *seat) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn != nil {
+		s.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	}
+}
@@ -0,0 +1,408 @@
+//go:build linux || dragonfly || freebsd || netbsd || openbsd
+// +build linux dragonfly freebsd netbsd openbsd
+
+package main
+
+// Terminal client
+//
+// Plays a match over its websocket from a shell: the board (with each piece's HP, attack, pending damage,
+// and status effects), the hand, the clocks, chat, and the log, drawn with ANSI escapes. The client
+// creates or joins the match through the JSON API, then speaks the websocket protocol (see protocol.go in
+// the server). For example, against a local server (PORT=5000):
+//
+//	chrss-tui -new                                  create a match and play white
+//	chrss-tui -new -settings '{"ai": true}'         play the AI
+//	chrss-tui -match <name>                         take the open seat of a match (or rejoin your seat)
+//	chrss-tui -new -hotseat                         play both seats from one terminal, taking turns
+//
+// It plays as a new anonymous user, unless given -session (a browser's session cookie, to play as its
+// user) or -token (a bot's API token). In hot-seat mode, the client holds both seats of the match as the
+// one user, and shows whichever seat has something to do (s switches by hand).
+//
+// The client runs on Linux and the BSDs (it drives the terminal with termios); macOS (for which the
+// vendored golang.org/x/sys no longer builds) and Windows are not supported.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+const maxChatLength = 200 // runes (the server's limit)
+
+type game struct {
+	match       string
+	seats       []*seat
+	active      int // index of the seat shown
+	hotseat     bool
+	cursor      [2]int // screen row and column on the board
+	status      string // last error, notice, or connection change
+	chatting    bool
+	chatInput   []rune
+	resignArmed bool // R was pressed once
+	width       int
+	height      int
+}
+
+func main() {
+	server := flag.String("server", "http://localhost:5000", "server URL")
+	name := flag.String("match", "", "name of the match to join")
+	create := flag.Bool("new", false, "create a match")
+	settings := flag.String("settings", "{}", "settings of the created match, as a JSON object (see POST /api/v1/matches)")
+	hotseat := flag.Bool("hotseat", false, "play both seats")
+	invite := flag.String("invite", "", "invite token of a private match")
+	password := flag.String("password", "", "password of the match")
+	session := flag.String("session", "", "session cookie to play as (e.g. copied from a browser)")
+	token := flag.String("token", "", "API token of a bot to play as")
+	flag.Parse()
+	if *create == (*name != "") {
+		fmt.Fprintln(os.Stderr, "give either -new or -match")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	api, err := newAPIClient(*server, *session, *token)
+	if err != nil {
+		fatal(err)
+	}
+	var seat *seatResponse
+	if *create {
+		matchSettings := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(*settings), &matchSettings); err != nil {
+			fatal(fmt.Errorf("invalid -settings: %v", err))
+		}
+		if *password != "" {
+			matchSettings["password"] = *password
+		}
+		seat, err = api.createMatch(matchSettings)
+	} else {
+		seat, err = api.join(*name, *invite, *password)
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	events := make(chan connEvent)
+	g := &game{match: seat.Match, hotseat: *hotseat, cursor: [2]int{nRows - 1, 0}}
+	g.seats = append(g.seats, newSeat(seat.Color, seat.Socket, api, events))
+	if *hotseat {
+		// (the other seat is claimed for the same user when its socket connects)
+		other := otherColor(seat.Color)
+		g.seats = append(g.seats, newSeat(other, "/ws/"+seat.Match+"/"+other, api, events))
+	}
+	if seat.InviteLink != "" {
+		g.status = "invite your opponent: " + *server + seat.InviteLink
+	}
+
+	fd := int(os.Stdin.Fd())
+	restore, err := makeRaw(fd)
+	if err != nil {
+		fatal(fmt.Errorf("stdin is not a terminal: %v", err))
+	}
+	fmt.Print(altScreen + hideCursor)
+	defer func() {
+		fmt.Print(showCursor + mainScreen)
+		restore()
+		fmt.Println("match " + g.match)
+	}()
+	g.width, g.height = termSize(fd)
+
+	for _, s := range g.seats {
+		go s.run()
+	}
+	keys := make(chan []key)
+	go readKeys(os.Stdin, keys)
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, syscall.SIGWINCH)
+	ticker := time.NewTicker(time.Second) // (redraws the turn clock)
+	defer ticker.Stop()
+
+	finished := 0
+	for {
+		fmt.Print(g.render())
+		select {
+		case event := <-events:
+			if event.msg != nil {
+				g.handleMessage(event.seat, event.msg)
+				continue
+			}
+			event.seat.connStatus = event.status
+			if event.finished {
+				g.status = event.seat.color + " " + event.status
+				finished++
+				if finished == len(g.seats) && event.seat.view.state == nil {
+					return // (never got to play)
+				}
+			}
+		case pressed, ok := <-keys:
+			if !ok {
+				return
+			}
+			for _, k := range pressed {
+				if g.handleKey(k) {
+					for _, s := range g.seats {
+						s.close()
+					}
+					return
+				}
+			}
+		case <-resized:
+			g.width, g.height = termSize(fd)
+		case <-ticker.C:
+		}
+	}
+}
+
+func newSeat(color string, socket string, api *apiClient, events chan<- connEvent) *seat {
+	return &seat{color: color, socket: socket, api: api, events: events, connStatus: "connecting"}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "chrss-tui:", err)
+	os.Exit(1)
+}
+
+func (g *game) handleMessage(s *seat, msg *serverMessage) {
+	var err error
+	switch msg.Type {
+	case "snapshot":
+		var payload snapshotPayload
+		if err = json.Unmarshal(msg.Payload, &payload); err == nil {
+			err = s.view.applySnapshot(payload)
+		}
+	case "diff":
+		var payload diffPayload
+		if err = json.Unmarshal(msg.Payload, &payload); err == nil {
+			var applied bool
+			applied, err = s.view.applyDiff(payload)
+			if err == nil && !applied {
+				err = s.send("get_state", nil)
+			}
+		}
+	case "error":
+		var payload protocolError
+		if err = json.Unmarshal(msg.Payload, &payload); err == nil {
+			g.status = s.color + ": " + payload.Message
+		}
+	case "notice":
+		var payload struct {
+			Message string `json:"message"`
+		}
+		if err = json.Unmarshal(msg.Payload, &payload); err == nil {
+			g.status = "notice: " + payload.Message
+		}
+	}
+	if err != nil {
+		g.status = s.color + ": " + err.Error()
+		return
+	}
+	g.follow()
+}
+
+// in hot-seat mode, show the seat which has something to do
+func (g *game) follow() {
+	if !g.hotseat {
+		return
+	}
+	active := g.seats[g.active]
+	state := active.view.state
+	if state == nil {
+		return
+	}
+	target := ""
+	switch state.Phase {
+	case "readyUp":
+		if state.public(active.color).Ready {
+			target = otherColor(active.color)
+		}
+	case "kingPlacement":
+		if state.public(active.color).KingPlayed {
+			target = otherColor(active.color)
+		}
+	case "main":
+		target = state.Turn
+	}
+	for i, s := range g.seats {
+		if s.color == target && s.view.state != nil {
+			g.active = i
+		}
+	}
+}
+
+// returns true to quit
+func (g *game) handleKey(k key) bool {
+	if g.chatting {
+		g.chatKey(k)
+		return false
+	}
+	s := g.seats[g.active]
+	state := s.view.state
+	resignArmed := g.resignArmed
+	g.resignArmed = false
+	var err error
+	switch {
+	case k.r == 'q' || k.r == ctrlC:
+		return true
+	case k.name == "up" || k.r == 'k':
+		g.moveCursor(-1, 0)
+	case k.name == "down" || k.r == 'j':
+		g.moveCursor(1, 0)
+	case k.name == "left" || k.r == 'h':
+		g.moveCursor(0, -1)
+	case k.name == "right" || k.r == 'l':
+		g.moveCursor(0, 1)
+	case k.name == "enter" || k.r == ' ':
+		if state == nil {
+			break
+		}
+		idx := boardIndex(state.Color, g.cursor[0], g.cursor[1])
+		err = s.send("click_board", map[string]int{"x": idx % nColumns, "y": idx / nColumns})
+	case k.r >= '0' && k.r <= '9':
+		card := int(k.r - '1')
+		if k.r == '0' {
+			card = 9
+		}
+		err = s.send("click_card", map[string]int{"selectedCard": card})
+	case k.name == "tab":
+		if state == nil {
+			break
+		}
+		if card := nextPlayableCard(state.Private); card != -1 {
+			err = s.send("click_card", map[string]int{"selectedCard": card})
+		}
+	case k.r == 'p':
+		err = s.send("pass", nil)
+	case k.r == 'r':
+		err = s.send("ready", nil)
+	case k.r == 'o':
+		err = s.send("offer_draw", nil)
+	case k.r == 'a':
+		err = s.send("accept_draw", nil)
+	case k.r == 'x':
+		err = s.send("decline_draw", nil)
+	case k.r == 'R':
+		if resignArmed {
+			err = s.send("resign", nil)
+		} else {
+			g.resignArmed = true
+			g.status = "press R again to resign"
+		}
+	case k.r == 'm':
+		err = s.send("rematch", nil)
+	case k.r == 'M':
+		err = s.send("decline_rematch", nil)
+	case k.r == 'D':
+		err = s.send("decline_challenge", nil)
+	case k.r == 'g':
+		err = s.send("get_state", nil)
+	case k.r == 't':
+		g.chatting = true
+		g.chatInput = nil
+	case k.r == 's':
+		if len(g.seats) > 1 {
+			g.active = (g.active + 1) % len(g.seats)
+		}
+	}
+	if err != nil {
+		g.status = s.color + ": " + err.Error()
+	} else if k.r != 'R' {
+		g.status = ""
+	}
+	return false
+}
+
+func (g *game) chatKey(k key) {
+	switch {
+	case k.name == "esc":
+		g.chatting = false
+	case k.name == "enter":
+		g.chatting = false
+		if len(g.chatInput) > 0 {
+			if err := g.seats[g.active].send("chat", map[string]string{"text": string(g.chatInput)}); err != nil {
+				g.status = err.Error()
+			}
+		}
+	case k.name == "backspace":
+		if len(g.chatInput) > 0 {
+			g.chatInput = g.chatInput[:len(g.chatInput)-1]
+		}
+	case k.name == "" && k.r >= ' ' && len(g.chatInput) < maxChatLength:
+		g.chatInput = append(g.chatInput, k.r)
+	}
+}
+
+func (g *game) moveCursor(rows int, columns int) {
+	g.cursor[0] = (g.cursor[0] + rows + nRows) % nRows
+	g.cursor[1] = (g.cursor[1] + columns + nColumns) % nColumns
+}
+
+// the playable card after the selected one (wrapping around), or -1 if none
+func nextPlayableCard(private privateState) int {
+	n := len(private.PlayableCards)
+	for i := 1; i <= n; i++ {
+		card := (private.SelectedCard + i + n) % n
+		if private.SelectedCard == -1 {
+			card = i - 1
+		}
+		if private.PlayableCards[card] && card != private.SelectedCard {
+			return card
+		}
+	}
+	return -1
+}
+
+const ctrlC = 3
+
+// a key press: a rune, or a named key
+type key struct {
+	r    rune
+	name string // up, down, left, right, enter, tab, esc, or backspace ("" for a rune)
+}
+
+// pass key presses to the channel until stdin closes
+func readKeys(in *os.File, keys chan<- []key) {
+	defer close(keys)
+	buf := make([]byte, 256)
+	for {
+		n, err := in.Read(buf)
+		if err != nil {
+			return
+		}
+		keys <- parseKeys(buf[:n])
+	}
+}
+
+func parseKeys(b []byte) []key {
+	keys := []key{}
+	for len(b) > 0 {
+		switch {
+		case b[0] == 0x1b && len(b) >= 3 && (b[1] == '[' || b[1] == 'O'):
+			names := map[byte]string{'A': "up", 'B': "down", 'C': "right", 'D': "left"}
+			if name, ok := names[b[2]]; ok {
+				keys = append(keys, key{name: name})
+			}
+			b = b[3:]
+			continue
+		case b[0] == 0x1b:
+			keys = append(keys, key{name: "esc"})
+		case b[0] == '\r' || b[0] == '\n':
+			keys = append(keys, key{name: "enter"})
+		case b[0] == '\t':
+			keys = append(keys, key{name: "tab"})
+		case b[0] == 0x7f || b[0] == 0x08:
+			keys = append(keys, key{name: "backspace"})
+		default:
+			r, size := utf8.DecodeRune(b)
+			keys = append(keys, key{r: r})
+			b = b[size:]
+			continue
+		}
+		b = b[1:]
+	}
+	return keys
+}
@@ -0,0 +1,346 @@
+//go:build linux || dragonfly || freebsd || netbsd || openbsd
+// +build linux dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ANSI escape sequences
+const (
+	reset       = "\x1b[0m"
+	bold        = "\x1b[1m"
+	faint       = "\x1b[2m"
+	underline   = "\x1b[4m"
+	reverse     = "\x1b[7m"
+	red         = "\x1b[31m"
+	green       = "\x1b[32m"
+	yellow      = "\x1b[33m"
+	cyan        = "\x1b[36m"
+	clearLine   = "\x1b[K"
+	clearBelow  = "\x1b[J"
+	home        = "\x1b[H"
+	hideCursor  = "\x1b[?25l"
+	showCursor  = "\x1b[?25h"
+	altScreen   = "\x1b[?1049h"
+	mainScreen  = "\x1b[?1049l"
+	cellWidth   = 11
+	minLogLines = 3
+)
+
+const keyHelp = "arrows/hjkl move  enter place/play  1-9,0 card  tab next card  p pass  r ready  t chat  " +
+	"o/a/x offer/accept/decline draw  R resign  m/M rematch/decline  D decline challenge  g refresh  q quit"
+
+const statusLegend = "+A amplify  +I immune  +R armor  -V vulnerable  -D distracted  -U unreclaimable  " +
+	"-E enraged  -T transparent  -P poison  ~ distracting square  (-n: damage in the next combat)"
+
+var pieceColors = map[string]string{"white": bold + yellow, "black": bold + cyan}
+
+// the whole screen for the active seat
+func (g *game) render() string {
+	var lines []string
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	s := g.seats[g.active]
+	seatName := s.color
+	if g.hotseat {
+		seatName += " (hot-seat: s switches)"
+	}
+	add("%schrss%s  %s  playing %s  %s", bold, reset, g.match, seatName, s.connStatus)
+	state := s.view.state
+	if state == nil {
+		add("")
+		add("waiting for the match state...")
+		return g.frame(lines)
+	}
+	add("%s", matchLine(state))
+	opponent := otherColor(state.Color)
+	add("%s", playerLine(state, opponent, "opponent"))
+	lines = append(lines, g.renderBoard(state)...)
+	add("%s", playerLine(state, state.Color, "you"))
+	lines = append(lines, renderHand(state, g.width)...)
+	add("%s%s%s", faint, truncate(statusLegend, g.width), reset)
+	if len(state.Chat) > 0 {
+		for _, chat := range state.Chat[max(0, len(state.Chat)-2):] {
+			text := chat.Text
+			if chat.Emote != "" {
+				text = "(" + chat.Emote + ")"
+			}
+			add("%schat%s %s: %s", green, reset, chat.From, text)
+		}
+	}
+
+	// the log gets whatever rows are left
+	footer := 2
+	logLines := minLogLines
+	if g.height > 0 {
+		logLines = max(minLogLines, g.height-len(lines)-footer-1)
+	}
+	add("%slog%s", underline, reset)
+	log := state.log
+	if len(log) > logLines-1 {
+		log = log[len(log)-(logLines-1):]
+	}
+	for _, entry := range log {
+		add("  %s", entry)
+	}
+	return g.frame(lines)
+}
+
+// the lines, then the status and prompt lines, drawn over the previous frame
+func (g *game) frame(lines []string) string {
+	if g.status != "" {
+		lines = append(lines, yellow+g.status+reset)
+	} else {
+		lines = append(lines, "")
+	}
+	if g.chatting {
+		lines = append(lines, "say: "+string(g.chatInput)+"_")
+	} else {
+		lines = append(lines, faint+truncate(keyHelp, g.width)+reset)
+	}
+	var b strings.Builder
+	b.WriteString(home)
+	for i, line := range lines {
+		if g.height > 0 && i >= g.height {
+			break
+		}
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(line)
+		b.WriteString(clearLine)
+	}
+	b.WriteString(clearBelow)
+	return b.String()
+}
+
+func matchLine(state *matchState) string {
+	round := fmt.Sprintf("round %d", state.Round)
+	if state.MaxRounds > 0 {
+		round += fmt.Sprintf("/%d", state.MaxRounds)
+	}
+	line := state.Phase + "  " + round
+	switch state.Phase {
+	case "kingPlacement", "main":
+		turn := state.Turn + "'s turn"
+		if state.Phase == "kingPlacement" {
+			turn = "place your King"
+		} else if state.Turn == state.Color {
+			turn = bold + "your turn" + reset
+		}
+		line += "  " + turn + fmt.Sprintf("  %ds", int(state.turnRemaining()/time.Second))
+		if state.WhiteTimeBank != nil && state.BlackTimeBank != nil {
+			own, opponent := *state.WhiteTimeBank, *state.BlackTimeBank
+			if state.Color == "black" {
+				own, opponent = opponent, own
+			}
+			line += "  bank you " + fmtClock(own) + " / opp " + fmtClock(opponent)
+		}
+		switch state.DrawOffer {
+		case state.Color:
+			line += "  (you offered a draw)"
+		case otherColor(state.Color):
+			line += "  " + bold + "opponent offers a draw (a accepts, x declines)" + reset
+		}
+	case "gameover":
+		switch state.Winner {
+		case "white", "black":
+			line += "  " + bold + state.Winner + " wins by " + state.EndReason + reset
+		case "draw":
+			line += "  " + bold + "draw by " + state.EndReason + reset
+		default:
+			line += "  " + bold + "match ended by " + state.EndReason + reset
+		}
+		switch {
+		case state.Rematch != "":
+			line += "  rematch: " + state.Rematch
+		case state.RematchOffer == state.Color:
+			line += "  (you asked for a rematch)"
+		case state.RematchOffer == otherColor(state.Color):
+			line += "  opponent asks for a rematch (m accepts, M declines)"
+		}
+		if state.Series.Games > 1 {
+			line += fmt.Sprintf("  series: white %d - %d black", state.Series.WhiteWins, state.Series.BlackWins)
+		}
+	case "readyUp":
+		if state.InviteLink != "" {
+			line += "  invite: " + state.InviteLink
+		}
+	}
+	return line
+}
+
+func playerLine(state *matchState, color string, who string) string {
+	public := state.public(color)
+	presence := state.WhitePresence
+	if color == "black" {
+		presence = state.BlackPresence
+	}
+	line := fmt.Sprintf("%s%s%s (%s) %s", pieceColors[color], color, reset, who, presence)
+	switch state.Phase {
+	case "readyUp":
+		if public.Ready {
+			line += "  ready"
+		} else {
+			line += "  not ready"
+		}
+	case "main":
+		line += fmt.Sprintf("  plays left %d (vassal %d, soldier %d, command %d)  pawns %d",
+			public.Turns, public.VassalTurns, public.SoldierTurns, public.CommandTurns, public.NumPawns)
+	}
+	return line
+}
+
+// the board from the seat's side (its own rows at the bottom, as on the site)
+func (g *game) renderBoard(state *matchState) []string {
+	border := "+" + strings.Repeat(strings.Repeat("-", cellWidth)+"+", nColumns)
+	lines := []string{}
+	for row := 0; row < nRows; row++ {
+		lines = append(lines, border)
+		cells := [3][]string{}
+		for column := 0; column < nColumns; column++ {
+			idx := boardIndex(state.Color, row, column)
+			text := cellText(state.board[idx], state.statuses[idx])
+			style := ""
+			if p := state.board[idx]; p != nil {
+				style = pieceColors[p.Color]
+			}
+			switch state.Private.Highlights[idx] {
+			case highlightDim:
+				style = faint
+			case highlightOn:
+				style += underline
+			}
+			if g.cursor == [2]int{row, column} {
+				style += reverse
+			}
+			for i := range cells {
+				cells[i] = append(cells[i], style+text[i]+reset)
+			}
+		}
+		for i := range cells {
+			lines = append(lines, "|"+strings.Join(cells[i], "|")+"|")
+		}
+	}
+	return append(lines, border)
+}
+
+// board index of the square at the screen row and column for the seat
+// (white sees the board turned around, as on the site)
+func boardIndex(color string, row int, column int) int {
+	idx := row*nColumns + column
+	if color == "white" {
+		return nColumns*nRows - 1 - idx
+	}
+	return idx
+}
+
+// three lines of cellWidth: name and owner, HP and attack, then pending damage and status effects
+func cellText(p *piece, square squareStatus) [3]string {
+	text := [3]string{}
+	marks := []string{}
+	if p != nil {
+		text[0] = fmt.Sprintf("%-9.9s %s", p.Name, initial(p.Color))
+		text[1] = fmt.Sprintf("%dhp %datk", p.HP, p.Attack)
+		if p.Damage > 0 {
+			marks = append(marks, fmt.Sprintf("-%d", p.Damage))
+		}
+		if status := p.Status; status != nil {
+			if positive := status.Positive; positive != nil {
+				marks = appendMark(marks, "+A", positive.Amplify)
+				marks = appendMark(marks, "+I", positive.DamageImmune)
+				marks = appendMark(marks, "+R", positive.Armor)
+			}
+			if negative := status.Negative; negative != nil {
+				marks = appendMark(marks, "-V", negative.Vulnerability)
+				marks = appendMark(marks, "-D", negative.Distracted)
+				marks = appendMark(marks, "-U", negative.Unreclaimable)
+				marks = appendMark(marks, "-E", negative.Enraged)
+				marks = appendMark(marks, "-T", negative.Transparent)
+				marks = appendMark(marks, "-P", negative.Poison)
+			}
+		}
+	}
+	if square.Negative != nil && square.Negative.Distracted {
+		marks = append(marks, "~")
+	}
+	text[2] = strings.Join(marks, " ")
+	for i := range text {
+		text[i] = fmt.Sprintf("%-*.*s", cellWidth, cellWidth, text[i])
+	}
+	return text
+}
+
+func appendMark(marks []string, mark string, value int) []string {
+	if value > 0 {
+		return append(marks, mark)
+	}
+	return marks
+}
+
+// the cards, numbered for selection: unplayable ones faint, the selected one reversed
+func renderHand(state *matchState, width int) []string {
+	if width <= 0 {
+		width = 80
+	}
+	private := state.Private
+	lines := []string{}
+	line, length := "hand:", len("hand:")
+	for i, c := range private.Cards {
+		label := fmt.Sprintf("%d %s (%s%d)", (i+1)%10, c.Name, initial(c.Type), c.Rank)
+		if i >= 10 {
+			label = fmt.Sprintf("- %s (%s%d)", c.Name, initial(c.Type), c.Rank)
+		}
+		style := ""
+		if i < len(private.PlayableCards) && !private.PlayableCards[i] {
+			style = faint
+		}
+		if i == private.SelectedCard {
+			style += reverse
+		}
+		if length+2+len(label) > width {
+			lines = append(lines, line)
+			line, length = "     ", 5
+		}
+		line += "  " + style + label + reset
+		length += 2 + len(label)
+	}
+	if len(private.Cards) == 0 {
+		line += "  (no cards)"
+	}
+	return append(lines, line)
+}
+
+func fmtClock(milliseconds int64) string {
+	if milliseconds < 0 {
+		milliseconds = 0
+	}
+	seconds := milliseconds / 1000
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+func initial(s string) string {
+	if s == "" {
+		return ""
+	}
+	return s[:1]
+}
+
+func truncate(s string, width int) string {
+	if width > 0 && len(s) > width {
+		return s[:width]
+	}
+	return s
+}
+
+func max(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
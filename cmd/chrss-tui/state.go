@@ -0,0 +1,276 @@
+//go:build linux || dragonfly || freebsd || netbsd || openbsd
+// +build linux dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+const (
+	nColumns = 6
+	nRows    = 6
+)
+
+// highlights (see the server's PrivateState)
+const (
+	highlightOff = iota
+	highlightOn
+	highlightDim
+)
+
+type serverMessage struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	Seq     int64           `json:"seq"`
+	ReplyTo int64           `json:"replyTo"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type snapshotPayload struct {
+	Seq   int64                      `json:"seq"`
+	State map[string]json.RawMessage `json:"state"`
+}
+
+type diffPayload struct {
+	Seq      int64                      `json:"seq"`
+	BaseSeq  int64                      `json:"baseSeq"`
+	Fields   map[string]json.RawMessage `json:"fields"`
+	Squares  map[string]json.RawMessage `json:"squares"`
+	Statuses map[string]json.RawMessage `json:"statuses"`
+	Log      []string                   `json:"log"`
+}
+
+type protocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type piece struct {
+	Name   string       `json:"name"`
+	Color  string       `json:"color"`
+	HP     int          `json:"hp"`
+	Attack int          `json:"attack"`
+	Damage int          `json:"damage"` // taken in the next combat
+	Status *pieceStatus `json:"status"`
+}
+
+type pieceStatus struct {
+	Negative *struct {
+		Vulnerability int `json:"vulnerability"`
+		Distracted    int `json:"distracted"`
+		Unreclaimable int `json:"unreclaimable"`
+		Enraged       int `json:"enraged"`
+		Transparent   int `json:"transparent"`
+		Poison        int `json:"poison"`
+	} `json:"negative"`
+	Positive *struct {
+		Amplify      int `json:"amplify"`
+		DamageImmune int `json:"damageImmune"`
+		Armor        int `json:"armor"`
+	} `json:"positive"`
+}
+
+type squareStatus struct {
+	Negative *struct {
+		Distracted bool `json:"distracted"`
+	} `json:"negative"`
+}
+
+type card struct {
+	Name string `json:"name"`
+	Rank int    `json:"rank"`
+	Type string `json:"type"` // vassal, soldier, or command
+}
+
+type privateState struct {
+	Cards         []card                `json:"cards"`
+	SelectedCard  int                   `json:"selectedCard"`
+	PlayableCards []bool                `json:"playableCards"`
+	Highlights    [nColumns * nRows]int `json:"highlights"`
+}
+
+type publicState struct {
+	Ready        bool `json:"ready"`
+	KingPlayed   bool `json:"kingPlayed"`
+	Turns        int  `json:"turns"`
+	VassalTurns  int  `json:"vassalTurns"`
+	SoldierTurns int  `json:"soldierTurns"`
+	CommandTurns int  `json:"commandTurns"`
+	NumPawns     int  `json:"numPawns"`
+}
+
+type chatMessage struct {
+	From  string `json:"from"`
+	Text  string `json:"text"`
+	Emote string `json:"emote"`
+}
+
+type series struct {
+	Games     int `json:"games"`
+	WhiteWins int `json:"whiteWins"`
+	BlackWins int `json:"blackWins"`
+	Draws     int `json:"draws"`
+}
+
+type legalAction struct {
+	Type string `json:"type"`
+}
+
+// the fields of a player's state drawn by the client (see the server's playerState)
+type matchState struct {
+	Color         string        `json:"color"`
+	Phase         string        `json:"phase"`
+	Turn          string        `json:"turn"`
+	Round         int           `json:"round"`
+	MaxRounds     int           `json:"maxRounds"`
+	Winner        string        `json:"winner"`
+	EndReason     string        `json:"endReason"`
+	DrawOffer     string        `json:"drawOffer"`
+	TurnRemaining int64         `json:"turnRemainingMilliseconds"`
+	WhiteTimeBank *int64        `json:"whiteTimeBankMilliseconds"`
+	BlackTimeBank *int64        `json:"blackTimeBankMilliseconds"`
+	Private       privateState  `json:"private"`
+	WhitePublic   publicState   `json:"whitePublic"`
+	BlackPublic   publicState   `json:"blackPublic"`
+	WhitePresence string        `json:"whitePresence"`
+	BlackPresence string        `json:"blackPresence"`
+	Spectators    int           `json:"spectators"`
+	InviteLink    string        `json:"inviteLink"`
+	Chat          []chatMessage `json:"chat"`
+	RematchOffer  string        `json:"rematchOffer"`
+	Rematch       string        `json:"rematch"`
+	Series        series        `json:"series"`
+	LegalActions  []legalAction `json:"legalActions"`
+	board         [nColumns * nRows]*piece
+	statuses      [nColumns * nRows]squareStatus
+	log           []string
+	receivedAt    time.Time // when TurnRemaining was sent
+}
+
+// a seat's state as built up from snapshots and diffs
+type seatView struct {
+	seq      int64 // of the last state message applied (0 before the first snapshot)
+	fields   map[string]json.RawMessage
+	squares  [nColumns * nRows]json.RawMessage
+	statuses [nColumns * nRows]json.RawMessage
+	log      []string
+	state    *matchState // decoded from the above after each message
+}
+
+func (v *seatView) applySnapshot(payload snapshotPayload) error {
+	v.fields = make(map[string]json.RawMessage)
+	v.log = nil
+	for key, value := range payload.State {
+		switch key {
+		case "board":
+			var squares [nColumns * nRows]json.RawMessage
+			if err := json.Unmarshal(value, &squares); err != nil {
+				return err
+			}
+			v.squares = squares
+		case "boardStatus":
+			var statuses [nColumns * nRows]json.RawMessage
+			if err := json.Unmarshal(value, &statuses); err != nil {
+				return err
+			}
+			v.statuses = statuses
+		case "log":
+			if err := json.Unmarshal(value, &v.log); err != nil {
+				return err
+			}
+		default:
+			v.fields[key] = value
+		}
+	}
+	v.seq = payload.Seq
+	return v.decode()
+}
+
+// returns false if the diff doesn't apply to the state we have (so the client should send get_state)
+func (v *seatView) applyDiff(payload diffPayload) (bool, error) {
+	if v.seq == 0 || payload.BaseSeq != v.seq {
+		return false, nil
+	}
+	for key, value := range payload.Fields {
+		v.fields[key] = value
+	}
+	for idx, value := range payload.Squares {
+		i, err := strconv.Atoi(idx)
+		if err != nil || i < 0 || i >= len(v.squares) {
+			continue
+		}
+		v.squares[i] = value
+	}
+	for idx, value := range payload.Statuses {
+		i, err := strconv.Atoi(idx)
+		if err != nil || i < 0 || i >= len(v.statuses) {
+			continue
+		}
+		v.statuses[i] = value
+	}
+	v.log = append(v.log, payload.Log...)
+	v.seq = payload.Seq
+	return true, v.decode()
+}
+
+func (v *seatView) decode() error {
+	encoded, err := json.Marshal(v.fields)
+	if err != nil {
+		return err
+	}
+	state := &matchState{}
+	if err := json.Unmarshal(encoded, state); err != nil {
+		return err
+	}
+	for i := range v.squares {
+		if len(v.squares[i]) > 0 {
+			if err := json.Unmarshal(v.squares[i], &state.board[i]); err != nil {
+				return err
+			}
+		}
+		if len(v.statuses[i]) > 0 {
+			if err := json.Unmarshal(v.statuses[i], &state.statuses[i]); err != nil {
+				return err
+			}
+		}
+	}
+	state.log = v.log
+	state.receivedAt = time.Now()
+	v.state = state
+	return nil
+}
+
+// the turn clock as of now
+func (s *matchState) turnRemaining() time.Duration {
+	remaining := time.Duration(s.TurnRemaining)*time.Millisecond - time.Since(s.receivedAt)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+func (s *matchState) public(color string) *publicState {
+	if color == "black" {
+		return &s.BlackPublic
+	}
+	return &s.WhitePublic
+}
+
+func (s *matchState) legal(actionType string) bool {
+	for _, action := range s.LegalActions {
+		if action.Type == actionType {
+			return true
+		}
+	}
+	return false
+}
+
+func otherColor(color string) string {
+	if color == "black" {
+		return "white"
+	}
+	return "black"
+}
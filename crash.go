@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Panic isolation
+//
+// Match code (events, AI turns, and the clock) runs under guard, so a bug which panics in one match
+// ends only that match: its state is written to a crash dump, and the match is aborted with a message
+// to both players. Crash dumps go to the directory in CRASH_DIR (by default, chrss-crashes in the
+// system temp directory).
+
+const crashLogEntries = 20 // recent log entries included in a crash dump
+
+type CrashDump struct {
+	Match     string
+	Time      int64  // unix nano
+	Where     string // what the match was doing
+	Panic     string
+	Stack     string
+	RecentLog []string
+	State     json.RawMessage // null if the state could not be encoded
+}
+
+func crashDir() string {
+	if dir := os.Getenv("CRASH_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "chrss-crashes")
+}
+
+// run f, and if it panics, abort the match rather than let the panic take down the server
+// returns true if f panicked
+// assumes match mutex is held (and it remains held)
+func (m *Match) guard(where string, f func()) (crashed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			crashed = true
+			m.crashed(where, r, debug.Stack())
+		}
+	}()
+	f()
+	return false
+}
+
+// assumes match mutex is held
+func (m *Match) crashed(where string, r interface{}, stack []byte) {
+	m.logger().Error("panic", "where", where, "panic", r, "stack", string(stack))
+	m.writeCrashDump(where, r, stack)
+	// the state may be inconsistent, so we do no more with it than mark it over
+	// (and if even that panics, the server still keeps running)
+	defer func() {
+		if r := recover(); r != nil {
+			m.logger().Error("panic aborting match", "panic", r)
+		}
+	}()
+	m.endMatch(none, crashReason)
+	err := protocolError(serverError, "The match was aborted because of a server error.")
+	for _, color := range []string{white, black} {
+		m.sendError(color, 0, err)
+		m.sendState(color, false, false)
+	}
+	m.sendSpectators(false, false)
+}
+
+// assumes match mutex is held
+func (m *Match) writeCrashDump(where string, r interface{}, stack []byte) {
+	dump := CrashDump{
+		Match: m.Name,
+		Time:  time.Now().UnixNano(),
+		Where: where,
+		Panic: fmt.Sprint(r),
+		Stack: string(stack),
+	}
+	if n := len(m.Log); n > crashLogEntries {
+		dump.RecentLog = m.Log[n-crashLogEntries:]
+	} else {
+		dump.RecentLog = m.Log
+	}
+	func() {
+		// (encoding may itself panic if the panic left the state broken)
+		defer func() {
+			if r := recover(); r != nil {
+				m.logger().Error("could not JSON encode state of crashed match", "err", r)
+			}
+		}()
+		state, err := json.Marshal(m)
+		if err != nil {
+			m.logger().Error("could not JSON encode state of crashed match", "err", err)
+			return
+		}
+		dump.State = state
+	}()
+	bytes, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		m.logger().Error("could not JSON encode crash dump", "err", err)
+		return
+	}
+	dir := crashDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logger.Error("could not create crash dump directory", "err", err)
+		return
+	}
+	name := m.Name + "-" + strings.Replace(time.Now().UTC().Format(time.RFC3339), ":", "", -1) + ".json"
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, bytes, 0600); err != nil {
+		logger.Error("could not write crash dump", "err", err)
+		return
+	}
+	m.logger().Info("wrote crash dump", "path", path)
+}
+
+// for goroutines which work with a match outside of its mutex (e.g. recording its result):
+// logs a panic rather than letting it take down the server
+// (use as: defer recoverPanic(...))
+func recoverPanic(where string) {
+	if r := recover(); r != nil {
+		logger.Error("panic", "where", where, "panic", r, "stack", string(debug.Stack()))
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fields of the state which are flags for the event that produced the message
+// (always sent in a diff, even if unchanged)
+var eventFields = []string{"newTurn", "newRound", "turnRemainingMilliseconds"}
+
+// what a recipient was last sent, so that the next message need only contain changes
+// (each field is kept in its JSON encoding)
+type clientView struct {
+	seq      int64 // seq of last state message sent
+	fields   map[string]string
+	squares  [nColumns * nRows]string
+	statuses [nColumns * nRows]string
+	logLen   int
+}
+
+type SnapshotPayload struct {
+	Seq   int64 `json:"seq"`
+	State gin.H `json:"state"`
+}
+
+type DiffPayload struct {
+	Seq      int64                      `json:"seq"`
+	BaseSeq  int64                      `json:"baseSeq"` // diff applies to the state as of this seq
+	Fields   map[string]json.RawMessage `json:"fields,omitempty"`
+	Squares  map[string]json.RawMessage `json:"squares,omitempty"`  // board index -> piece (null for empty square)
+	Statuses map[string]json.RawMessage `json:"statuses,omitempty"` // board index -> square status
+	Log      []string                   `json:"log,omitempty"`      // entries appended since base
+}
+
+func mustEncode(v interface{}) string {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		panic(err) // state is built only from types which always encode
+	}
+	return string(bytes)
+}
+
+// record state as the view and return the full snapshot
+func (v *clientView) snapshot(state gin.H) SnapshotPayload {
+	v.seq++
+	v.fields = make(map[string]string)
+	for k, val := range state {
+		switch k {
+		case "board", "boardStatus", "log":
+		default:
+			v.fields[k] = mustEncode(val)
+		}
+	}
+	pieces := state["board"].([nColumns * nRows]*Piece)
+	for i, p := range pieces {
+		v.squares[i] = mustEncode(p)
+	}
+	statuses := state["boardStatus"].([nColumns * nRows]SquareStatus)
+	for i, status := range statuses {
+		v.statuses[i] = mustEncode(status)
+	}
+	v.logLen = len(state["log"].([]string))
+	return SnapshotPayload{v.seq, state}
+}
+
+// record state as the view and return only what changed since the last message
+func (v *clientView) diff(state gin.H) DiffPayload {
+	payload := DiffPayload{
+		Seq:      v.seq + 1,
+		BaseSeq:  v.seq,
+		Fields:   make(map[string]json.RawMessage),
+		Squares:  make(map[string]json.RawMessage),
+		Statuses: make(map[string]json.RawMessage),
+	}
+	v.seq++
+	for k, val := range state {
+		switch k {
+		case "board", "boardStatus", "log":
+			continue
+		}
+		encoded := mustEncode(val)
+		if v.fields[k] != encoded || stringInSlice(k, eventFields) {
+			payload.Fields[k] = json.RawMessage(encoded)
+			v.fields[k] = encoded
+		}
+	}
+	pieces := state["board"].([nColumns * nRows]*Piece)
+	for i, p := range pieces {
+		encoded := mustEncode(p)
+		if v.squares[i] != encoded {
+			payload.Squares[strconv.Itoa(i)] = json.RawMessage(encoded)
+			v.squares[i] = encoded
+		}
+	}
+	statuses := state["boardStatus"].([nColumns * nRows]SquareStatus)
+	for i, status := range statuses {
+		encoded := mustEncode(status)
+		if v.statuses[i] != encoded {
+			payload.Statuses[strconv.Itoa(i)] = json.RawMessage(encoded)
+			v.statuses[i] = encoded
+		}
+	}
+	log := state["log"].([]string)
+	if len(log) > v.logLen {
+		payload.Log = log[v.logLen:]
+	}
+	v.logLen = len(log)
+	return payload
+}
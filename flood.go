@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Flood protection
+//
+// Every message a client sends takes a token from its connection's bucket and from its user's bucket
+// (shared by all of the user's connections to this instance). A message which finds either bucket
+// empty is dropped (a player is sent a rate_limited error in reply) and counts as a strike, and a
+// client with too many strikes is cut off. So is a client which sends a message larger than
+// maxMessageSize.
+
+const (
+	maxMessageSize    = 4096 // bytes
+	connMessageRate   = 10.0 // tokens added per second
+	connMessageBurst  = 30.0 // bucket capacity
+	userMessageRate   = 20.0
+	userMessageBurst  = 60.0
+	maxStrikes        = 20
+	maxIdleUserBucket = 10 * time.Minute // full buckets idle this long are discarded
+)
+
+type tokenBucket struct {
+	tokens float64
+	rate   float64
+	burst  float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	return &tokenBucket{tokens: burst, rate: rate, burst: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) take(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// message buckets of the users connected to this instance
+type UserBuckets struct {
+	sync.Mutex
+	internal map[string]*tokenBucket
+}
+
+func NewUserBuckets() *UserBuckets {
+	return &UserBuckets{internal: make(map[string]*tokenBucket)}
+}
+
+// take a token from the user's bucket
+func (ub *UserBuckets) take(userID string) bool {
+	now := time.Now()
+	ub.Lock()
+	defer ub.Unlock()
+	bucket := ub.internal[userID]
+	if bucket == nil {
+		// (discard buckets of users who have gone quiet, so the map doesn't grow without bound)
+		for id, b := range ub.internal {
+			if now.Sub(b.last) > maxIdleUserBucket {
+				delete(ub.internal, id)
+			}
+		}
+		bucket = newTokenBucket(userMessageRate, userMessageBurst)
+		ub.internal[userID] = bucket
+	}
+	return bucket.take(now)
+}
+
+// read messages from the socket until it closes (or the client is cut off), passing each
+// message within the limits to handle, and each dropped message to limited (if not nil)
+// (userID may be empty, in which case only the connection's limit applies)
+func (cl *Cluster) readMessages(wsConn *websocket.Conn, conn *Client, userID string, handle func([]byte),
+	limited func([]byte)) {
+	wsConn.SetReadLimit(maxMessageSize)
+	bucket := newTokenBucket(connMessageRate, connMessageBurst)
+	strikes := 0
+	for {
+		_, msg, err := wsConn.ReadMessage()
+		if err == websocket.ErrReadLimit {
+			cl.cutOff(conn, userID, "message larger than "+fmt.Sprint(maxMessageSize)+" bytes")
+			return
+		}
+		if err != nil {
+			return
+		}
+		messagesReceived.Inc()
+		now := time.Now()
+		connOK := bucket.take(now)
+		if connOK && (userID == "" || cl.userBuckets.take(userID)) {
+			handle(msg)
+			continue
+		}
+		messagesDropped.Inc()
+		if limited != nil {
+			limited(msg)
+		}
+		strikes++
+		if strikes >= maxStrikes {
+			cl.cutOff(conn, userID, "sending messages too fast")
+			return
+		}
+	}
+}
+
+// reply to a player's message dropped by the limits (so the client isn't left waiting for the ack)
+func rejectLimited(data []byte, match *Match, player string) {
+	var msg ClientMessage
+	json.Unmarshal(data, &msg) // (replyTo is 0 if the message is not a valid envelope)
+	match.Mutex.Lock()
+	match.sendError(player, msg.Seq, protocolError(rateLimitedError, "sending messages too fast"))
+	match.Mutex.Unlock()
+}
+
+func (cl *Cluster) cutOff(conn *Client, userID string, reason string) {
+	logger.Warn("cut off client", "conn", conn.Label, "user", userID, "reason", reason)
+	conn.close(websocket.ClosePolicyViolation, "Disconnected: "+reason+".")
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Match history
+//
+// When a match ends, each human player gets a record of it, from which their profile's stats are computed.
+// As a match is played, its owner also records a replay: a frame of the spectators' view each time
+// something happens (i.e. each time the log grows), each frame with just the log entries since the last.
+// The replay is shown only once the match has ended (so it can't be used to watch a match live, around
+// the spectator delay), and the replay of a private match only to its players.
+
+const (
+	maxMatchRecords    = 500 // per user (profile stats cover only these)
+	replayRetention    = 30 * 24 * time.Hour
+	topCardsShown      = 5
+	recentMatchesShown = 5 // on the home page
+)
+
+// results (besides win, loss, and draw)
+const noResult = "none" // match ended without a winner (e.g. abandoned)
+
+// a finished match from one player's perspective (served as is by the JSON API)
+type MatchRecord struct {
+	Match      string         `json:"match"`
+	StartTime  int64          `json:"startTime"` // unix nano
+	Time       int64          `json:"time"`      // unix nano when the match ended
+	Color      string         `json:"color"`
+	Opponent   string         `json:"opponent"`   // name
+	OpponentID string         `json:"opponentId"` // "" for the AI
+	AILevel    string         `json:"aiLevel"`    // "" unless the opponent was the AI
+	Result     string         `json:"result"`     // win, loss, draw, or none
+	Reason     string         `json:"reason"`
+	Rounds     int            `json:"rounds"`
+	Rated      bool           `json:"rated"`
+	Pool       string         `json:"pool"`
+	Cards      map[string]int `json:"cards"` // cards played by the player: name -> times played
+}
+
+func (r MatchRecord) Length() string {
+	return fmtDuration(time.Duration(r.Time - r.StartTime))
+}
+
+func aiName(level string) string {
+	return "AI (" + level + ")"
+}
+
+// add a replay frame if the log has grown since the last
+// assumes match mutex is held
+func (m *Match) recordReplayFrame() {
+	if len(m.Log) <= m.ReplayLogLength {
+		return
+	}
+	state := m.spectatorState(false, false)
+	for _, field := range []string{"turnRemainingMilliseconds", "spectators", "newTurn", "newRound", "rematch", "chat"} {
+		delete(state, field)
+	}
+	state["log"] = m.Log[m.ReplayLogLength:]
+	state["elapsedMilliseconds"] = (time.Now().UnixNano() - m.StartTime) / int64(time.Millisecond)
+	bytes, err := json.Marshal(state)
+	if err != nil {
+		logger.Error("could not JSON encode replay frame", "err", err)
+		return
+	}
+	m.replayFrames = append(m.replayFrames, bytes)
+	m.ReplayLogLength = len(m.Log)
+}
+
+// who may see a finished match's replay
+type ReplayAccess struct {
+	Private       bool
+	WhitePlayerID string
+	BlackPlayerID string
+}
+
+func (a *ReplayAccess) allows(userID string) bool {
+	return !a.Private || userID == a.WhitePlayerID || userID == a.BlackPlayerID
+}
+
+// nil if the match hasn't ended (or its replay has expired)
+func (cl *Cluster) loadReplayAccess(name string) (*ReplayAccess, error) {
+	bytes, err := cl.Store.LoadReplayAccess(name)
+	if err != nil || bytes == nil {
+		return nil, err
+	}
+	access := &ReplayAccess{}
+	if err := json.Unmarshal(bytes, access); err != nil {
+		return nil, err
+	}
+	return access, nil
+}
+
+// the match's replay if the user may see it: once the match has ended, and only to its players if it
+// was private (nil otherwise, or if there is no replay)
+func (cl *Cluster) replayFor(name string, userID string) ([]byte, error) {
+	access, err := cl.loadReplayAccess(name)
+	if err != nil || access == nil || !access.allows(userID) {
+		return nil, err
+	}
+	return cl.replay(name)
+}
+
+// JSON array of the match's replay frames (nil if there is no replay)
+func (cl *Cluster) replay(name string) ([]byte, error) {
+	frames, err := cl.Store.ListReplayFrames(name)
+	if err != nil || len(frames) == 0 {
+		return nil, err
+	}
+	replay := []byte{'['}
+	for i, frame := range frames {
+		if i > 0 {
+			replay = append(replay, ',')
+		}
+		replay = append(replay, frame...)
+	}
+	return append(replay, ']'), nil
+}
+
+// called by the match clock once it sees the match is over
+// (the store ensures a match's result is recorded only once, even if another instance takes the match over)
+func (cl *Cluster) matchOver(m *Match) {
+	defer recoverPanic("recording result of match " + m.Name)
+	cl.saveMatch(m) // adds the last replay frames
+	m.Mutex.RLock()
+	name, devMode := m.Name, m.DevMode
+	access := ReplayAccess{m.Private, m.WhitePlayerID, m.BlackPlayerID}
+	m.Mutex.RUnlock()
+	bytes, err := json.Marshal(access)
+	if err == nil {
+		err = cl.Store.SaveReplayAccess(name, bytes)
+	}
+	if err != nil {
+		logger.Error("could not save replay access", "match", name, "err", err)
+	}
+	if devMode {
+		return
+	}
+	claimed, err := cl.Store.ClaimResult(name)
+	if err != nil {
+		logger.Error("could not claim result", "match", name, "err", err)
+		return
+	}
+	if !claimed {
+		return
+	}
+	cl.recordHistory(m)
+	cl.recordResult(m)
+}
+
+// add the finished match to its players' histories
+func (cl *Cluster) recordHistory(m *Match) {
+	m.Mutex.RLock()
+	base := MatchRecord{
+		Match:     m.Name,
+		StartTime: m.StartTime,
+		Time:      m.EndTime,
+		Reason:    m.EndReason,
+		Rounds:    m.Round,
+		Rated:     m.Rated,
+		Pool:      m.ratingPool(),
+	}
+	winner := m.Winner
+	ids := map[string]string{white: m.WhitePlayerID, black: m.BlackPlayerID}
+	ais := map[string]bool{white: m.WhiteAI && !m.WhiteAITakeover, black: m.BlackAI && !m.BlackAITakeover}
+	levels := map[string]string{white: m.aiLevel(white), black: m.aiLevel(black)}
+	cards := map[string]map[string]int{white: m.WhiteCardsPlayed, black: m.BlackCardsPlayed}
+	m.Mutex.RUnlock()
+
+	// a match against oneself is not a result
+	if !ais[white] && !ais[black] && ids[white] == ids[black] {
+		return
+	}
+	for _, color := range []string{white, black} {
+		opponent := otherColor(color)
+		if ais[color] || ids[color] == "" {
+			continue
+		}
+		record := base
+		record.Color = color
+		record.Cards = cards[color]
+		switch winner {
+		case color:
+			record.Result = win
+		case opponent:
+			record.Result = loss
+		case draw:
+			record.Result = draw
+		default:
+			record.Result = noResult
+		}
+		if ais[opponent] {
+			record.AILevel = levels[opponent]
+			record.Opponent = aiName(record.AILevel)
+		} else {
+			record.OpponentID = ids[opponent]
+			if user, err := cl.loadUser(ids[opponent]); err == nil && user != nil {
+				record.Opponent = user.Name
+			}
+		}
+		bytes, err := json.Marshal(record)
+		if err == nil {
+			err = cl.Store.AddMatchRecord(ids[color], bytes)
+		}
+		if err != nil {
+			logger.Error("could not save match record", "user", ids[color], "err", err)
+		}
+	}
+}
+
+// most recent first
+func (cl *Cluster) listMatchRecords(userID string) ([]MatchRecord, error) {
+	list, err := cl.Store.ListMatchRecords(userID)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]MatchRecord, 0, len(list))
+	for i := len(list) - 1; i >= 0; i-- {
+		var record MatchRecord
+		if err := json.Unmarshal(list[i], &record); err != nil {
+			logger.Error("could not JSON decode match record", "err", err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+type Record struct {
+	Wins   int
+	Losses int
+	Draws  int
+}
+
+func (r *Record) add(result string) {
+	switch result {
+	case win:
+		r.Wins++
+	case loss:
+		r.Losses++
+	case draw:
+		r.Draws++
+	}
+}
+
+func (r Record) Games() int {
+	return r.Wins + r.Losses + r.Draws
+}
+
+// e.g. "55%" ("-" if no games)
+func (r Record) WinRate() string {
+	if r.Games() == 0 {
+		return "-"
+	}
+	return strconv.Itoa(r.Wins*100/r.Games()) + "%"
+}
+
+type CardCount struct {
+	Name  string
+	Count int
+}
+
+type ProfileStats struct {
+	Games         int // including matches without a result
+	White         Record
+	Black         Record
+	TopCards      []CardCount // most played first
+	AverageRounds string
+	VsAI          map[string]*Record // by AI level
+}
+
+func profileStats(records []MatchRecord) ProfileStats {
+	stats := ProfileStats{Games: len(records), VsAI: make(map[string]*Record)}
+	counts := make(map[string]int)
+	rounds := 0
+	for _, record := range records {
+		if record.Color == white {
+			stats.White.add(record.Result)
+		} else {
+			stats.Black.add(record.Result)
+		}
+		if record.AILevel != "" {
+			if stats.VsAI[record.AILevel] == nil {
+				stats.VsAI[record.AILevel] = &Record{}
+			}
+			stats.VsAI[record.AILevel].add(record.Result)
+		}
+		for name, n := range record.Cards {
+			counts[name] += n
+		}
+		rounds += record.Rounds
+	}
+	for name, n := range counts {
+		stats.TopCards = append(stats.TopCards, CardCount{name, n})
+	}
+	sort.Slice(stats.TopCards, func(i, j int) bool {
+		if stats.TopCards[i].Count != stats.TopCards[j].Count {
+			return stats.TopCards[i].Count > stats.TopCards[j].Count
+		}
+		return stats.TopCards[i].Name < stats.TopCards[j].Name
+	})
+	if len(stats.TopCards) > topCardsShown {
+		stats.TopCards = stats.TopCards[:topCardsShown]
+	}
+	stats.AverageRounds = "-"
+	if len(records) > 0 {
+		stats.AverageRounds = strconv.FormatFloat(float64(rounds)/float64(len(records)), 'f', 1, 64)
+	}
+	return stats
+}
+
+// merge lists of JSON values (each with a Time field), oldest first
+func mergeByTime(lists ...[][]byte) [][]byte {
+	type timed struct {
+		Time  int64
+		bytes []byte
+	}
+	all := []timed{}
+	for _, list := range lists {
+		for _, bytes := range list {
+			t := timed{bytes: bytes}
+			json.Unmarshal(bytes, &t)
+			all = append(all, t)
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Time < all[j].Time })
+	merged := make([][]byte, len(all))
+	for i, t := range all {
+		merged[i] = t.bytes
+	}
+	return merged
+}
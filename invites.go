@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Private and password protected matches
+//
+// A private match is left out of the lobby, and its open seat can be taken only by following its invite
+// link (/join/:name?invite=<token>). A match with a password may be listed, but its open seat can be
+// taken only by someone who gives the password. Either way, the join page checks the invite and password
+// and then sends the player on to the match with a grant: a signature of the match's token, the seat, and
+// the user, which the owner of the match checks when the player claims the seat. A private match can be
+// watched only by its players and by those with the invite (/watch/:name?invite=<token>).
+
+const (
+	inviteTokenBytes  = 18
+	maxPasswordLength = 72       // bytes (the most bcrypt takes)
+	randomColor       = "random" // creator's color, chosen when the match is created
+)
+
+var (
+	errSeatTaken      = errors.New("Another player is already playing that color.")
+	errInviteRequired = errors.New("This match can only be joined through its invite link.")
+)
+
+// what the join page needs to know of a match
+type joinInfo struct {
+	Name        string
+	CreatorName string
+	OpenColor   string // "" if neither seat can be taken
+	WhiteID     string
+	BlackID     string
+	Private     bool
+	InviteToken string
+	Locked      bool   // has a password
+	hash        string // bcrypt hash of the password
+}
+
+func randomToken(n int) string {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+// make the match private and/or give it a password ("" for none)
+// (every restricted match gets a token, which grants are tied to)
+func (m *Match) restrict(private bool, password string) error {
+	m.Private = private
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		m.PasswordHash = string(hash)
+	}
+	if m.restricted() {
+		m.InviteToken = randomToken(inviteTokenBytes)
+	}
+	return nil
+}
+
+func (m *Match) restricted() bool {
+	return m.Private || m.PasswordHash != ""
+}
+
+// color of the seat a player can join ("" if none)
+func (m *Match) openColor() string {
+	if m.IsFinished() {
+		return ""
+	}
+	if m.WhitePlayerID == "" && !m.WhiteAI {
+		return white
+	}
+	if m.BlackPlayerID == "" && !m.BlackAI {
+		return black
+	}
+	return ""
+}
+
+// path of the page for joining the match's open seat
+func (m *Match) inviteLink() string {
+	link := "/join/" + m.Name
+	if m.Private {
+		link += "?invite=" + url.QueryEscape(m.InviteToken)
+	}
+	return link
+}
+
+// assumes match mutex is held
+func (m *Match) joinInfo() *joinInfo {
+	return &joinInfo{
+		Name:        m.Name,
+		CreatorName: m.CreatorName,
+		OpenColor:   m.openColor(),
+		WhiteID:     m.WhitePlayerID,
+		BlackID:     m.BlackPlayerID,
+		Private:     m.Private,
+		InviteToken: m.InviteToken,
+		Locked:      m.PasswordHash != "",
+		hash:        m.PasswordHash,
+	}
+}
+
+// seat the user already has in the match ("" if none)
+func (info *joinInfo) seat(userID string) string {
+	if info.WhiteID == userID {
+		return white
+	}
+	if info.BlackID == userID {
+		return black
+	}
+	return ""
+}
+
+func (info *joinInfo) validInvite(token string) bool {
+	return !info.Private || hmac.Equal([]byte(token), []byte(info.InviteToken))
+}
+
+func (info *joinInfo) canWatch(userID string, invite string) bool {
+	return info.seat(userID) != "" || info.validInvite(invite)
+}
+
+// assumes match mutex is held
+func (m *Match) canWatch(userID string, invite string) bool {
+	return m.joinInfo().canWatch(userID, invite)
+}
+
+func (info *joinInfo) validPassword(password string) bool {
+	return !info.Locked || bcrypt.CompareHashAndPassword([]byte(info.hash), []byte(password)) == nil
+}
+
+// nil if no such match
+func (cl *Cluster) loadJoinInfo(name string) (*joinInfo, error) {
+	if m, ok := cl.Matches.Load(name); ok {
+		m.Mutex.RLock()
+		defer m.Mutex.RUnlock()
+		return m.joinInfo(), nil
+	}
+	state, err := cl.Store.LoadMatch(name)
+	if err != nil || state == nil {
+		return nil, err
+	}
+	m := &Match{}
+	if err := json.Unmarshal(state, m); err != nil {
+		return nil, err
+	}
+	return m.joinInfo(), nil
+}
+
+func seatGrant(inviteToken string, color string, userID string) string {
+	return sessionSignature("seat." + inviteToken + "." + color + "." + userID)
+}
+
+func validSeatGrant(inviteToken string, color string, userID string, grant string) bool {
+	return hmac.Equal([]byte(grant), []byte(seatGrant(inviteToken, color, userID)))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Logging
+//
+// Each log line is logfmt: time, level, and message, then the logger's fields and the call's fields as
+// key=value pairs, e.g.
+//
+//	time=2019-01-09T01:32:44.123Z level=warn msg="slow client disconnected" match=Happy-Hippo color=white
+//
+// Loggers for a match (and for a player in it) carry the match's name (and the color) as fields. LOG_LEVEL
+// (debug, info, warn, or error) sets the least severe level logged; the default is info.
+
+type logLevel int
+
+const (
+	debugLevel logLevel = iota
+	infoLevel
+	warnLevel
+	errorLevel
+)
+
+var logLevelNames = map[logLevel]string{
+	debugLevel: "debug",
+	infoLevel:  "info",
+	warnLevel:  "warn",
+	errorLevel: "error",
+}
+
+var minLogLevel = infoLevel
+
+// serializes writes, so lines from different goroutines don't interleave
+var logMutex sync.Mutex
+
+type Logger struct {
+	fields []interface{} // alternating keys and values
+}
+
+// root logger (no fields)
+var logger = &Logger{}
+
+func initLogging() {
+	name := strings.ToLower(os.Getenv("LOG_LEVEL"))
+	if name == "" {
+		return
+	}
+	for level, levelName := range logLevelNames {
+		if levelName == name {
+			minLogLevel = level
+			return
+		}
+	}
+	logger.Warn("invalid LOG_LEVEL: logging at info", "level", name)
+}
+
+// logger whose lines also carry the given fields (alternating keys and values)
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{fields}
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.log(debugLevel, msg, keyvals) }
+func (l *Logger) Info(msg string, keyvals ...interface{})  { l.log(infoLevel, msg, keyvals) }
+func (l *Logger) Warn(msg string, keyvals ...interface{})  { l.log(warnLevel, msg, keyvals) }
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.log(errorLevel, msg, keyvals) }
+
+func (l *Logger) log(level logLevel, msg string, keyvals []interface{}) {
+	if level < minLogLevel {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("time=")
+	b.WriteString(time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+	b.WriteString(" level=")
+	b.WriteString(logLevelNames[level])
+	b.WriteString(" msg=")
+	b.WriteString(logfmtValue(msg))
+	writeFields(&b, l.fields)
+	writeFields(&b, keyvals)
+	b.WriteByte('\n')
+	logMutex.Lock()
+	os.Stdout.WriteString(b.String())
+	logMutex.Unlock()
+}
+
+func writeFields(b *strings.Builder, keyvals []interface{}) {
+	for i := 0; i < len(keyvals); i += 2 {
+		b.WriteByte(' ')
+		b.WriteString(fmt.Sprint(keyvals[i]))
+		b.WriteByte('=')
+		if i+1 < len(keyvals) {
+			b.WriteString(logfmtValue(keyvals[i+1]))
+		} else {
+			b.WriteString(`"(missing)"`)
+		}
+	}
+}
+
+// quoted if needed (empty, or has spaces, quotes, equals signs, or control characters)
+func logfmtValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case error:
+		s = fmt.Sprintf("%+v", v)
+	case time.Duration:
+		s = v.String()
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.IndexFunc(s, func(r rune) bool { return r <= ' ' || r == '"' || r == '=' || r == 0x7f }) != -1 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// logs each request (path only: query strings may hold invites and grants)
+func requestLogger(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	level := infoLevel
+	if c.Writer.Status() >= http.StatusInternalServerError {
+		level = errorLevel
+	}
+	logger.log(level, "request", []interface{}{
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"status", c.Writer.Status(),
+		"duration", time.Since(start),
+		"ip", c.ClientIP(),
+	})
+}
+
+// logger for the match (its lines carry the match's name)
+func (m *Match) logger() *Logger {
+	return logger.With("match", m.Name)
+}
+
+// logger for a player in the match (its lines carry the match's name and the player's color)
+func (m *Match) playerLogger(color string) *Logger {
+	return logger.With("match", m.Name, "color", color)
+}
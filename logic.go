@@ -1,21 +1,21 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
 	"math/rand"
 	"strconv"
 	"time"
 )
 
 func initMatch(m *Match) {
-	// random adjective-animal
-	m.Name = adjectives[rand.Intn(len(adjectives))] + "-" + animals[rand.Intn(len(animals))]
 	m.LastMoveTime = time.Now().UnixNano()
 	m.StartTime = m.LastMoveTime
 	m.Turn = white
 	m.Winner = none
+	m.DrawOffer = none
+	m.RematchOffer = none
 	m.MaxRank = 1
+	m.WhiteTimeBank = m.TimeBank
+	m.BlackTimeBank = m.TimeBank
 
 	public := &m.WhitePublic
 	public.Color = white
@@ -564,6 +564,18 @@ func (m *Match) states(color string) (*PublicState, *PrivateState) {
 	}
 }
 
+func (m *Match) countCardPlayed(color string, cardName string) {
+	counts := &m.WhiteCardsPlayed
+	if color == black {
+		counts = &m.BlackCardsPlayed
+	}
+	if *counts == nil {
+		*counts = make(map[string]int)
+	}
+	(*counts)[cardName]++
+	cardsPlayed.Inc(cardName)
+}
+
 // determine which cards are playable for each player given state of board
 func (m *Match) PlayableCards(board *Board) {
 	public, private := m.states(white)
@@ -801,25 +813,30 @@ func advanceablePieces(board *Board) []int {
 	return indexes
 }
 
-func (m *Match) clickCard(player string, public *PublicState, private *PrivateState, cardIdx int) {
+func (m *Match) clickCard(player string, public *PublicState, private *PrivateState, cardIdx int) error {
 	switch m.Phase {
 	case mainPhase:
-		// ignore if not the player's turn
 		if player != m.Turn {
-			return
+			return protocolError(notYourTurnError, "cannot select card on opponent's turn")
 		}
-		if private.PlayableCards[cardIdx] {
-			if cardIdx == private.SelectedCard {
-				private.SelectedCard = -1
-				highlightsOff(private.Highlights[:])
-			} else {
-				card := private.Cards[cardIdx]
-				private.SelectedCard = cardIdx
-				idxs := validCardPositions(card.Name, player, m, &m.Board)
-				dimAllBut(idxs, private.Highlights[:])
-			}
+		if cardIdx < 0 || cardIdx >= len(private.Cards) {
+			return protocolError(badPayloadError, "no card at index "+strconv.Itoa(cardIdx))
+		}
+		if !private.PlayableCards[cardIdx] {
+			return protocolError(illegalMoveError, private.Cards[cardIdx].Name+" cannot be played now")
+		}
+		if cardIdx == private.SelectedCard {
+			private.SelectedCard = -1
+			highlightsOff(private.Highlights[:])
+		} else {
+			card := private.Cards[cardIdx]
+			private.SelectedCard = cardIdx
+			idxs := validCardPositions(card.Name, player, m, &m.Board)
+			dimAllBut(idxs, private.Highlights[:])
 		}
+		return nil
 	}
+	return protocolError(invalidActionError, "cards can only be selected in the main phase")
 }
 
 // assumes we have already checked that the move is playable
@@ -828,6 +845,9 @@ func playCard(m *Match, card string, player string, public *PublicState, p Pos,
 	piece := getPieceSafe(p, board)
 	switch card {
 	case castleCard:
+		if piece == nil {
+			break // (canPlayCard should have ruled this out)
+		}
 		// find rook of same color as clicked king
 		var rookPiece *Piece
 		for _, p := range board.Pieces {
@@ -836,6 +856,9 @@ func playCard(m *Match, card string, player string, public *PublicState, p Pos,
 				break
 			}
 		}
+		if rookPiece == nil {
+			break
+		}
 		swap := *rookPiece
 		*rookPiece = *piece
 		*piece = swap
@@ -1122,18 +1145,23 @@ func validCardPositions(cardName string, color string, m *Match, board *Board) [
 }
 
 func canPlayCard(m *Match, card string, cardType string, player string, public *PublicState, p Pos, board *Board) bool {
+	return cardPlayProblem(m, card, cardType, player, public, p, board) == ""
+}
+
+// returns reason why the card cannot be played at the position (empty string if it can be played)
+func cardPlayProblem(m *Match, card string, cardType string, player string, public *PublicState, p Pos, board *Board) string {
 	switch cardType {
 	case vassalCard:
 		if public.NumVassalTurns == 0 {
-			return false
+			return "no vassal plays left this round"
 		}
 	case soldierCard:
 		if public.NumSoldierTurns == 0 {
-			return false
+			return "no soldier plays left this round"
 		}
 	case commandCard:
 		if public.NumCommandTurns == 0 {
-			return false
+			return "no command plays left this round"
 		}
 	}
 
@@ -1141,7 +1169,7 @@ func canPlayCard(m *Match, card string, cardType string, player string, public *
 	switch card {
 	case castleCard:
 		if piece == nil || piece.Name != king {
-			return false
+			return "must click a King"
 		}
 		// find rook of same color as clicked king
 		var rookPiece *Piece
@@ -1152,155 +1180,166 @@ func canPlayCard(m *Match, card string, cardType string, player string, public *
 			}
 		}
 		if rookPiece == nil {
-			return false // no rook of matching color found
+			return "no Rook of the King's color on the board" // no rook of matching color found
 		}
 	case reclaimVassalCard:
 		if piece == nil || piece.Color != player {
-			return false
+			return "must click an ally vassal"
 		}
 		switch piece.Name {
 		case bishop:
 		case knight:
 		case rook:
 		default:
-			return false
+			return "must click an ally vassal"
 		}
 	case swapFrontLinesCard:
 		if piece == nil || piece.Name != king {
-			return false
+			return "must click a King"
 		}
 	case removePawnCard:
 		if piece == nil || piece.Name != pawn {
-			return false
+			return "must click a Pawn"
 		}
 	case forceCombatCard:
 		if piece == nil || piece.Name != king || piece.Color != player {
-			return false
+			return "must click your King"
 		}
 	case dispellCard:
 		if piece == nil || piece.Status == nil {
-			return false
+			return "must click a piece with status effects"
 		}
 	case dodgeCard:
 		if piece == nil || piece.Color != player {
-			return false
+			return "must click an ally piece"
 		}
 		idx := p.getBoardIdx()
 		for _, val := range dodgeablePieces(player, board) {
 			if val == idx {
-				return true
+				return ""
 			}
 		}
-		return false
+		return "piece is not under threat or has no free adjacent square"
 	case mirrorCard:
 		// (assumes board has even number of rows)
 		if piece == nil || piece.Name != king {
-			return false
+			return "must click a King"
 		}
 	case healCard:
 		if piece == nil || piece.Name == king || piece.Color != player {
-			return false
+			return "must click an ally piece other than the King"
 		}
 	case poisonCard:
 		if piece == nil || piece.Color == player || piece.Name == king {
-			return false
+			return "must click an enemy piece other than the King"
 		}
 	case togglePawnCard:
 		if piece == nil || piece.Name != pawn {
-			return false
+			return "must click a Pawn"
 		}
 		idx := p.getBoardIdx()
 		for _, val := range toggleablePawns(board) {
 			if idx == val {
-				return true
+				return ""
 			}
 		}
-		return false
+		return "Pawn cannot be toggled"
 	case nukeCard:
 		if piece == nil || piece.Name != king {
-			return false
+			return "must click a King"
 		}
 	case vulnerabilityCard:
 		if piece == nil || piece.Color == player {
-			return false
+			return "must click an enemy piece"
 		}
 	case amplifyCard:
 		if piece == nil || piece.Color != player {
-			return false
+			return "must click an ally piece"
 		}
 	case transparencyCard:
 		if piece == nil || piece.Color == player {
-			return false
+			return "must click an enemy piece"
 		}
 	case stunVassalCard:
 		if piece == nil || piece.Color == player ||
 			(piece.Name != knight && piece.Name != bishop && piece.Name != rook) {
-			return false
+			return "must click an enemy vassal"
 		}
 	case enrageCard:
 		if piece == nil || piece.Color == player {
-			return false
+			return "must click an enemy piece"
 		}
 	case armorCard:
 		if piece == nil || piece.Color != player || piece.Name == king {
-			return false
+			return "must click an ally piece other than the King"
 		}
 	case shoveCard:
 		if piece == nil {
-			return false
+			return "must click a piece"
 		}
 		idx := p.getBoardIdx()
 		for _, val := range shoveablePieces(board) {
 			if idx == val {
-				return true
+				return ""
 			}
 		}
-		return false
+		return "piece cannot be shoved"
 	case advanceCard:
 		if piece == nil {
-			return false
+			return "must click a piece"
 		}
 		idx := p.getBoardIdx()
 		for _, val := range advanceablePieces(board) {
 			if idx == val {
-				return true
+				return ""
 			}
 		}
-		return false
+		return "piece cannot advance"
 	case summonPawnCard:
 		if piece == nil || piece.Name != king || piece.Color != player {
-			return false
+			return "must click your King"
+		}
+		if !SpawnSinglePawn(player, public, true, board) {
+			return "no free column for a Pawn"
 		}
-		return SpawnSinglePawn(player, public, true, board)
 	case resurrectVassalCard:
 		if piece == nil || piece.Name != king || piece.Color != public.Color {
-			return false
+			return "must click your King"
 		}
 	case bishop, knight, rook, queen, jester:
 		// ignore clicks on occupied spaces
 		if getPieceSafe(p, board) != nil {
-			return false
+			return "square is occupied"
 		}
 		// square must be on player's side of board
 		if player == white && p.Y >= nColumns/2 {
-			return false
+			return "must place on your side of the board"
 		}
 		if player == black && p.Y < nColumns/2 {
-			return false
+			return "must place on your side of the board"
 		}
 	}
-	return true
+	return ""
 }
 
-func (m *Match) clickBoard(player string, public *PublicState, private *PrivateState, p Pos, board *Board) (newTurn bool, notifyOpponent bool) {
+func (m *Match) clickBoard(player string, public *PublicState, private *PrivateState, p Pos, board *Board) (newTurn bool, notifyOpponent bool, err error) {
+	if p.getBoardIdx() == -1 {
+		err = protocolError(badPayloadError, "position is off the board")
+		return
+	}
 	switch m.Phase {
 	case mainPhase:
-		// ignore if not the player's turn and/or no card selected
-		if player != m.Turn || private.SelectedCard == -1 {
+		if player != m.Turn {
+			err = protocolError(notYourTurnError, "cannot play card on opponent's turn")
+			return
+		}
+		if private.SelectedCard == -1 {
+			err = protocolError(invalidActionError, "no card selected")
 			return
 		}
 		card := private.Cards[private.SelectedCard]
-		if !canPlayCard(m, card.Name, card.Type, player, public, p, board) {
+		if problem := cardPlayProblem(m, card.Name, card.Type, player, public, p, board); problem != "" {
+			err = protocolError(illegalMoveError, card.Name+": "+problem)
 			return
 		}
 		forceCombat := playCard(m, card.Name, player, public, p, board)
@@ -1313,6 +1352,7 @@ func (m *Match) clickBoard(player string, public *PublicState, private *PrivateS
 			public.NumCommandTurns--
 		}
 		m.Log = append(m.Log, player+" played "+card.Name)
+		m.countCardPlayed(player, card.Name)
 		private.RemoveCard(private.SelectedCard)
 		m.PlayableCards(board)
 		if forceCombat {
@@ -1324,17 +1364,16 @@ func (m *Match) clickBoard(player string, public *PublicState, private *PrivateS
 		notifyOpponent = true
 	case kingPlacementPhase:
 		if public.KingPlayed {
+			err = protocolError(invalidActionError, "King already placed")
 			break
 		}
-		// ignore clicks on occupied spaces
 		if getPieceSafe(p, board) != nil {
+			err = protocolError(illegalMoveError, "King: square is occupied")
 			break
 		}
 		// square must be on player's side of board
-		if player == white && p.Y >= nColumns/2 {
-			break
-		}
-		if player == black && p.Y < nColumns/2 {
+		if (player == white && p.Y >= nColumns/2) || (player == black && p.Y < nColumns/2) {
+			err = protocolError(illegalMoveError, "King: must place on your side of the board")
 			break
 		}
 		public.KingPlayed = true
@@ -1342,6 +1381,8 @@ func (m *Match) clickBoard(player string, public *PublicState, private *PrivateS
 		private.KingPos = &p
 		newTurn = m.EndKingPlacement()
 		notifyOpponent = true
+	default:
+		err = protocolError(invalidActionError, "board cannot be clicked in "+string(m.Phase)+" phase")
 	}
 	return
 }
@@ -1460,21 +1501,62 @@ func (m *Match) checkWinCondition() bool {
 	whiteLose := w.King.HP <= 0 || whiteDeadVassals >= 2
 	blackLose := b.King.HP <= 0 || blackDeadVassals >= 2
 	if whiteLose && blackLose {
-		m.Winner = draw
-		m.Phase = gameoverPhase
+		m.endMatch(draw, checkmateReason)
 		return true
 	} else if whiteLose {
-		m.Winner = black
-		m.Phase = gameoverPhase
+		m.endMatch(black, checkmateReason)
 		return true
 	} else if blackLose {
-		m.Winner = white
-		m.Phase = gameoverPhase
+		m.endMatch(white, checkmateReason)
 		return true
 	}
 	return false
 }
 
+// winner is white, black, draw, or none (match ended without a result)
+func (m *Match) endMatch(winner string, reason string) {
+	m.Winner = winner
+	m.EndReason = reason
+	m.DrawOffer = none
+	m.Phase = gameoverPhase
+	m.EndTime = time.Now().UnixNano()
+	matchesEnded.Inc(reason)
+	switch winner {
+	case white, black:
+		m.Log = append(m.Log, winner+" wins by "+reason)
+	case draw:
+		m.Log = append(m.Log, "draw by "+reason)
+	default:
+		m.Log = append(m.Log, "match ended by "+reason)
+	}
+}
+
+// sum of king and living vassal HP (including vassals off the board)
+func tiebreakScore(public *PublicState) int {
+	score := 0
+	for _, p := range []*Piece{public.King, public.Bishop, public.Knight, public.Rook} {
+		if p.HP > 0 {
+			score += p.HP
+		}
+	}
+	return score
+}
+
+// decide winner of match which reached its round limit
+func (m *Match) roundLimitTiebreak() {
+	whiteScore := tiebreakScore(&m.WhitePublic)
+	blackScore := tiebreakScore(&m.BlackPublic)
+	m.Log = append(m.Log, "round limit reached: white "+strconv.Itoa(whiteScore)+
+		" HP, black "+strconv.Itoa(blackScore)+" HP")
+	if whiteScore > blackScore {
+		m.endMatch(white, roundLimitReason)
+	} else if blackScore > whiteScore {
+		m.endMatch(black, roundLimitReason)
+	} else {
+		m.endMatch(draw, roundLimitReason)
+	}
+}
+
 // panics if i or j are out of bounds
 func swapBoardIndex(i, j int, b *Board) {
 	if i == j {
@@ -1525,7 +1607,12 @@ func ReclaimPieces(board *Board, whitePublic *PublicState, blackPublic *PublicSt
 
 func (m *Match) EndRound() {
 	m.LastMoveTime = time.Now().UnixNano()
+	if m.RoundStartTime != 0 {
+		roundDuration.Observe(float64(m.LastMoveTime-m.RoundStartTime) / float64(time.Second))
+	}
+	m.RoundStartTime = m.LastMoveTime
 	m.Round++
+	m.DrawOffer = none // offers do not carry over into the next round
 	m.Log = append(m.Log, "Round "+strconv.Itoa(m.Round))
 
 	if m.FirstTurnColor == black {
@@ -1804,6 +1891,7 @@ func (p *PrivateState) dimUnreclaimable(board *Board) {
 
 // end = force end round; player = color whose turn is ending
 func (m *Match) EndTurn(end bool, player string) {
+	m.chargeTimeBank(player)
 	m.LastMoveTime = time.Now().UnixNano()
 	m.UpdateStatusAndDamage()
 
@@ -1819,7 +1907,11 @@ func (m *Match) EndTurn(end bool, player string) {
 
 		if !m.checkWinCondition() {
 			tickdownStatusEffects(false, board)
-			m.EndRound()
+			if m.MaxRounds > 0 && m.Round >= m.MaxRounds {
+				m.roundLimitTiebreak()
+			} else {
+				m.EndRound()
+			}
 		}
 	} else {
 		if m.Turn == black {
@@ -1887,10 +1979,6 @@ func (m *Match) IsOpen() bool {
 	return (m.WhiteConn == nil || m.BlackConn == nil) && m.Winner == none
 }
 
-func (m *Match) IsBlackOpen() bool {
-	return m.BlackPlayerID == "" && m.Winner == none && m.BlackAI == false
-}
-
 func (m *Match) IsWhiteOpen() bool {
 	return m.WhiteConn == nil && m.Winner == none
 }
@@ -1899,8 +1987,14 @@ func (m *Match) IsFull() bool {
 	return (m.WhiteConn != nil && m.BlackConn != nil) && m.Winner == none
 }
 
+// in progress with both seats taken
+func (m *Match) IsLive() bool {
+	return (m.Phase == kingPlacementPhase || m.Phase == mainPhase) &&
+		(m.BlackPlayerID != "" || m.BlackAI) && (m.WhitePlayerID != "" || m.WhiteAI)
+}
+
 func (m *Match) IsFinished() bool {
-	return m.Winner != none
+	return m.Winner != none || m.Phase == gameoverPhase
 }
 
 // panics if out of bounds
@@ -1976,95 +2070,137 @@ func (p *Piece) isEnraged() bool {
 	return p.Status.Negative.Enraged > 0
 }
 
-func (m *Match) processEvent(event string, player string, msg []byte) (notifyOpponent bool, newTurn bool) {
-	if m.Phase == gameoverPhase {
+// payload is the message payload (may be empty for events that take none)
+func (m *Match) processEvent(event string, player string, payload []byte) (notifyOpponent bool, newTurn bool, err error) {
+	if m.Phase == gameoverPhase && event != "get_state" && event != "rematch" && event != "decline_rematch" &&
+		event != "chat" && event != "mute" {
+		err = protocolError(gameOverError, "match is over")
 		return
 	}
 	public, private := m.states(player)
+	inPlay := m.Phase == kingPlacementPhase || m.Phase == mainPhase
 	switch event {
 	case "get_state":
 		// doesn't change anything, just fetches current state
 	case "ready":
-		switch m.Phase {
-		case readyUpPhase:
-			public.Ready = true
-			if m.BlackPublic.Ready && m.WhitePublic.Ready {
-				m.Phase = kingPlacementPhase
-				m.Round = 1 // by incrementing from 0, will sound new round fanfare
-				m.LastMoveTime = time.Now().UnixNano()
-			}
-			notifyOpponent = true
+		if m.Phase != readyUpPhase {
+			err = protocolError(invalidActionError, "match has already started")
+			break
+		}
+		public.Ready = true
+		if m.BlackPublic.Ready && m.WhitePublic.Ready {
+			m.Phase = kingPlacementPhase
+			m.Round = 1 // by incrementing from 0, will sound new round fanfare
+			m.LastMoveTime = time.Now().UnixNano()
+			m.RoundStartTime = m.LastMoveTime
+			m.StartTime = m.LastMoveTime
 		}
+		notifyOpponent = true
 	case "time_expired":
-		switch m.Phase {
-		case mainPhase:
-			turnElapsed := time.Now().UnixNano() - m.LastMoveTime
-			remainingTurnTime := m.TurnTimer - turnElapsed
-			if remainingTurnTime > 0 {
-				break // ignore if time hasn't actually expired
-			}
-			// actual elapsed time is checked on server, but we rely upon clients to notify
-			// (not ideal because both clients might fail, but then we have bigger problem)
-			// Cheater could supress sending time_expired event from their client, but
-			// opponent also sends the event (and has interest to do so).
-			m.Log = append(m.Log, m.Turn+" passed")
-			m.EndTurn(false, m.Turn)
+		// the server clock advances the turn on its own, but a client may still
+		// report expiry to receive the new state without waiting for the next tick
+		if m.checkClock() {
 			newTurn = true
 			notifyOpponent = true
-		case kingPlacementPhase:
-			turnElapsed := time.Now().UnixNano() - m.LastMoveTime
-			remainingTurnTime := m.TurnTimer - turnElapsed
-			if remainingTurnTime > 0 {
-				break // ignore if time hasn't actually expired
-			}
-			for _, color := range []string{black, white} {
-				public, _ := m.states(color)
-				if !public.KingPlayed {
-					// randomly place king in free square
-					// Because we must have reclaimed the King, there will always be a free square at this point
-					pos, _ := RandomFreeSquare(color, &m.Board)
-					setPiece(pos, *public.King, &m.Board)
-					public.KingPlayed = true
-					m.Log = append(m.Log, color+" played King")
-				}
-			}
-			newTurn = m.EndKingPlacement()
-			notifyOpponent = true
 		}
 	case "click_card":
-		type ClickCardEvent struct {
-			SelectedCard int
-		}
-		var event ClickCardEvent
-		err := json.Unmarshal(msg, &event)
-		if err != nil {
-			fmt.Println("unmarshalling click_card error", err)
-			break // todo: send error response
+		var event ClickCardPayload
+		if err = decodePayload(payload, &event); err != nil {
+			break
 		}
-		m.clickCard(player, public, private, event.SelectedCard)
+		err = m.clickCard(player, public, private, event.SelectedCard)
 	case "click_board":
 		var pos Pos
-		err := json.Unmarshal(msg, &pos)
+		if err = decodePayload(payload, &pos); err != nil {
+			break
+		}
+		newTurn, notifyOpponent, err = m.clickBoard(player, public, private, pos, &m.Board)
+	case "play_card":
+		var event PlayCardPayload
+		if err = decodePayload(payload, &event); err != nil {
+			break
+		}
+		if private.SelectedCard != event.Card {
+			if err = m.clickCard(player, public, private, event.Card); err != nil {
+				break
+			}
+		}
+		newTurn, notifyOpponent, err = m.clickBoard(player, public, private, event.Pos, &m.Board)
 		if err != nil {
-			break // todo: send error response
+			// (no card is left selected by a rejected play)
+			private.SelectedCard = -1
+			highlightsOff(private.Highlights[:])
+		}
+	case "decline_challenge":
+		err = m.declineChallenge(player)
+		notifyOpponent = true
+	case "resign":
+		if !inPlay {
+			err = protocolError(invalidActionError, "cannot resign before match has started")
+			break
 		}
-		newTurn, notifyOpponent = m.clickBoard(player, public, private, pos, &m.Board)
+		m.Log = append(m.Log, player+" resigned")
+		m.endMatch(otherColor(player), resignReason)
+		notifyOpponent = true
+	case "offer_draw":
+		if !inPlay {
+			err = protocolError(invalidActionError, "cannot offer draw before match has started")
+			break
+		}
+		if m.DrawOffer != none {
+			err = protocolError(invalidActionError, "a draw offer is already outstanding")
+			break
+		}
+		m.DrawOffer = player
+		m.Log = append(m.Log, player+" offered a draw")
+		notifyOpponent = true
+	case "accept_draw":
+		// can only accept opponent's offer
+		if m.DrawOffer != otherColor(player) {
+			err = protocolError(invalidActionError, "opponent has not offered a draw")
+			break
+		}
+		m.Log = append(m.Log, player+" accepted the draw")
+		m.endMatch(draw, agreementReason)
+		notifyOpponent = true
+	case "decline_draw":
+		if m.DrawOffer != otherColor(player) {
+			err = protocolError(invalidActionError, "opponent has not offered a draw")
+			break
+		}
+		m.DrawOffer = none
+		m.Log = append(m.Log, player+" declined the draw")
+		notifyOpponent = true
+	case "chat":
+		err = m.playerChat(player, payload)
+		notifyOpponent = true
+	case "mute":
+		err = m.mute(player, payload)
+	case "rematch":
+		err = m.requestRematch(player)
+		notifyOpponent = true
+	case "decline_rematch":
+		err = m.declineRematch(player)
+		notifyOpponent = true
 	case "pass":
-		switch m.Phase {
-		case mainPhase:
-			if player != m.Turn {
-				break // ignore if not the player's turn
-			}
-			if !public.KingPlayed {
-				break // cannot pass when king has not been played
-			}
-			m.Log = append(m.Log, player+" passed")
-			m.EndTurn(false, player)
-			newTurn = true
-			notifyOpponent = true
+		if m.Phase != mainPhase {
+			err = protocolError(invalidActionError, "can only pass in the main phase")
+			break
 		}
+		if player != m.Turn {
+			err = protocolError(notYourTurnError, "cannot pass on opponent's turn")
+			break
+		}
+		if !public.KingPlayed {
+			err = protocolError(invalidActionError, "cannot pass when King has not been played")
+			break
+		}
+		m.Log = append(m.Log, player+" passed")
+		m.EndTurn(false, player)
+		newTurn = true
+		notifyOpponent = true
 	default:
-		fmt.Println("bad event: ", event, msg) // todo: better error reporting
+		err = protocolError(unknownTypeError, "unknown message type '"+event+"'")
 	}
 	return
 }
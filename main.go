@@ -1,19 +1,19 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
-	uuid "github.com/satori/go.uuid"
-
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	_ "github.com/heroku/x/hmetrics/onload"
@@ -38,69 +38,147 @@ func randSelect(n int, candidates []int) []int {
 	return candidates[:n]
 }
 
-func processMessage(msg []byte, match *Match, player string) {
-	currentRound := match.Round
-	var event string
-	idx := 0
-	for ; idx < len(msg); idx++ {
-		if msg[idx] == ' ' {
-			event = string(msg[:idx])
-			msg = msg[idx+1:]
-		}
+// returns true if the message changed the match (and so it should be saved)
+func (cl *Cluster) processMessage(data []byte, match *Match, player string) bool {
+	var msg ClientMessage
+	err := json.Unmarshal(data, &msg)
+	if err == nil && msg.V != protocolVersion {
+		err = protocolError(unsupportedVersionError, "server speaks protocol version "+strconv.Itoa(protocolVersion))
+	} else if err != nil {
+		err = protocolError(badMessageError, "message is not a valid JSON envelope")
 	}
-	if event == "ping" {
-		// used for keep alive (heroku timesout connections with no activity for 55 seconds)
-		// Needn't send response to keep connection alive as long as one side of connection is active
-		return
+	if err != nil {
+		countEventError(msg.Type, err)
+		match.playerLogger(player).Debug("rejected message", "err", err)
+		match.Mutex.Lock()
+		match.sendError(player, msg.Seq, err)
+		match.Mutex.Unlock()
+		return false
 	}
 	match.Mutex.Lock()
-	notifyOpponent, newTurn := match.processEvent(event, player, msg)
-	processConnection := func(conn *websocket.Conn, color string, private *PrivateState, newTurn bool) {
-		turnElapsed := time.Now().UnixNano() - match.LastMoveTime
-		remainingTurnTime := (match.TurnTimer - turnElapsed) / 1000000
-		if conn != nil {
-			response := gin.H{
-				"turnRemainingMilliseconds": remainingTurnTime,
-				"color":                     color,
-				"board":                     match.Board.Pieces,
-				"boardStatus":               match.SquareStatuses,
-				"private":                   private,
-				"turn":                      match.Turn,
-				"newTurn":                   newTurn,
-				"winner":                    match.Winner,
-				"round":                     match.Round,
-				"newRound":                  match.Round > currentRound,
-				"lastMoveTime":              match.LastMoveTime,
-				"blackPublic":               match.BlackPublic,
-				"whitePublic":               match.WhitePublic,
-				"phase":                     match.Phase,
-				"firstTurnColor":            match.FirstTurnColor,
-				"log":                       match.Log,
-			}
-			bytes, err := json.Marshal(response)
-			if err != nil {
-				fmt.Printf("Error JSON encoding state: %+v", err)
-			}
-			err = conn.WriteMessage(websocket.TextMessage, bytes)
-			if err != nil {
-				if !websocket.IsCloseError(err) {
-					fmt.Printf("Error writing message to %+v connection: %+v", color, err)
-				}
-			}
-		}
+	if match.stopped() {
+		// (the client reconnects to whichever instance runs the match now)
+		match.Mutex.Unlock()
+		return false
 	}
-	if player == black {
-		processConnection(match.BlackConn, black, &match.BlackPrivate, newTurn)
-		if notifyOpponent {
-			processConnection(match.WhiteConn, white, &match.WhitePrivate, newTurn)
-		}
+	currentRound := match.Round
+	var notifyOpponent, newTurn bool
+	crashed := match.guard("event "+msg.Type+" from "+player, func() {
+		notifyOpponent, newTurn, err = match.processEvent(msg.Type, player, msg.Payload)
+	})
+	if crashed {
+		match.Mutex.Unlock()
+		return false
+	}
+	if err != nil {
+		countEventError(msg.Type, err)
+		match.playerLogger(player).Debug("rejected event", "event", msg.Type, "err", err)
+		match.sendError(player, msg.Seq, err)
+		match.Mutex.Unlock()
+		return false
+	}
+	match.sendMessage(player, ackMsg, msg.Seq, nil)
+	newRound := match.Round > currentRound
+	if msg.Type == "get_state" {
+		match.sendSnapshot(player)
 	} else {
-		processConnection(match.WhiteConn, white, &match.WhitePrivate, newTurn)
-		if notifyOpponent {
-			processConnection(match.BlackConn, black, &match.BlackPrivate, newTurn)
-		}
+		match.sendState(player, newTurn, newRound)
+	}
+	if notifyOpponent {
+		match.sendState(otherColor(player), newTurn, newRound)
+		match.sendSpectators(newTurn, newRound)
 	}
+	rematch := match.RematchAccepted && match.Rematch == ""
 	match.Mutex.Unlock()
+	if rematch {
+		cl.startRematch(match)
+	}
+	// (get_state, and a report of time expiry which the clock has already handled, change nothing)
+	return msg.Type != "get_state" && (msg.Type != "time_expired" || newTurn)
+}
+
+// send the match state as seen by the player (does nothing if player not connected)
+// assumes match mutex is held
+func (m *Match) sendState(color string, newTurn bool, newRound bool) {
+	conn, view := m.WhiteConn, &m.whiteView
+	if color == black {
+		conn, view = m.BlackConn, &m.blackView
+	}
+	// once a player has been sent a snapshot, we keep sending diffs while they are
+	// disconnected so the diffs can be replayed when they reconnect
+	if *view == nil && conn == nil {
+		return
+	}
+	state := m.playerState(color, newTurn, newRound)
+	if *view == nil {
+		*view = &clientView{}
+		m.sendMessage(color, snapshotMsg, 0, (*view).snapshot(state))
+		return
+	}
+	m.sendMessage(color, diffMsg, 0, (*view).diff(state))
+}
+
+// send the full match state as seen by the player, replacing whatever the client had
+// assumes match mutex is held
+func (m *Match) sendSnapshot(color string) {
+	if color == black {
+		m.blackView = nil
+	} else {
+		m.whiteView = nil
+	}
+	m.sendState(color, false, false)
+}
+
+func (m *Match) playerState(color string, newTurn bool, newRound bool) gin.H {
+	private := &m.WhitePrivate
+	if color == black {
+		private = &m.BlackPrivate
+	}
+	muted := m.WhiteMutedOpponent
+	if color == black {
+		muted = m.BlackMutedOpponent
+	}
+	// so the player can invite an opponent
+	inviteLink := ""
+	if m.openColor() != "" {
+		inviteLink = m.inviteLink()
+	}
+	response := gin.H{
+		"turnRemainingMilliseconds": m.turnRemaining() / int64(time.Millisecond),
+		"color":                     color,
+		"board":                     m.Board.Pieces,
+		"boardStatus":               m.SquareStatuses,
+		"private":                   private,
+		"turn":                      m.Turn,
+		"newTurn":                   newTurn,
+		"winner":                    m.Winner,
+		"endReason":                 m.EndReason,
+		"drawOffer":                 m.DrawOffer,
+		"maxRounds":                 m.MaxRounds,
+		"round":                     m.Round,
+		"newRound":                  newRound,
+		"lastMoveTime":              m.LastMoveTime,
+		"blackPublic":               m.BlackPublic,
+		"whitePublic":               m.WhitePublic,
+		"phase":                     m.Phase,
+		"firstTurnColor":            m.FirstTurnColor,
+		"log":                       m.Log,
+		"whitePresence":             m.presence(white),
+		"blackPresence":             m.presence(black),
+		"spectators":                len(m.Spectators),
+		"inviteLink":                inviteLink,
+		"chat":                      m.chatFor(color),
+		"muted":                     muted,
+		"rematchOffer":              m.RematchOffer,
+		"rematch":                   m.Rematch,
+		"series":                    m.seriesScore(),
+		"legalActions":              m.legalActions(color),
+	}
+	if m.TimeBank > 0 {
+		response["whiteTimeBankMilliseconds"] = m.timeBankRemaining(white) / int64(time.Millisecond)
+		response["blackTimeBankMilliseconds"] = m.timeBankRemaining(black) / int64(time.Millisecond)
+	}
+	return response
 }
 
 func fmtDuration(d time.Duration) string {
@@ -141,123 +219,264 @@ func (mm *MatchMap) Store(match *Match) {
 	mm.Unlock()
 }
 
-func NewUserMap() *UserMap {
-	return &UserMap{
-		internal: make(map[string]bool),
+func (mm *MatchMap) List() []*Match {
+	mm.RLock()
+	matches := make([]*Match, 0, len(mm.internal))
+	for _, m := range mm.internal {
+		matches = append(matches, m)
 	}
+	mm.RUnlock()
+	return matches
 }
 
-func (um *UserMap) Exists(key string) bool {
-	um.RLock()
-	_, ok := um.internal[key]
-	um.RUnlock()
-	return ok
-}
-
-func (um *UserMap) Delete(key string) {
-	um.Lock()
-	delete(um.internal, key)
-	um.Unlock()
+// a match setting that is not valid (the request is at fault)
+type settingError struct {
+	message string
 }
 
-func (um *UserMap) Store(userID string) {
-	um.Lock()
-	um.internal[userID] = true
-	um.Unlock()
+func (e *settingError) Error() string {
+	return e.message
 }
 
-var userNumber = 1 // used for default user names
-// returns userID (which may be new if argument does not exist
-func validateUser(c *gin.Context, userID string, userName string, users *UserMap) (string, string, error) {
-	users.Lock()
-	if !users.internal[userID] {
-		u2, err := uuid.NewV4()
-		if err != nil {
-			users.Unlock()
-			return "", "", err
-		}
-		userID = u2.String()
-		const tenYears = 10 * 365 * 24 * 60 * 60
-		c.SetCookie("user_id", userID, tenYears, "/", "", false, false)
-		userName = strconv.Itoa(userNumber)
-		c.SetCookie("user_name", strconv.Itoa(userNumber), tenYears, "/", "", false, false)
-		userNumber++
-	}
-	users.internal[userID] = true
-	users.Unlock()
-	return userID, userName, nil
+func invalidSetting(format string, args ...interface{}) error {
+	return &settingError{fmt.Sprintf(format, args...)}
 }
 
-func createMatch(c *gin.Context, liveMatches *MatchMap, users *UserMap) (string, error) {
-	userID, err := c.Cookie("user_id")
-	userName, _ := c.Cookie("user_name")
-	userID, userName, err = validateUser(c, userID, userName, users)
-	if err != nil {
-		return "", err
+// status and message of the response to a failed match creation
+func createMatchFailure(err error) (int, string) {
+	switch err.(type) {
+	case *settingError:
+		return http.StatusBadRequest, err.Error()
 	}
+	switch err {
+	case errMaxMatches:
+		return http.StatusInternalServerError, "Cannot create match. Server currently at max number of matches."
+	case errShuttingDown:
+		return http.StatusServiceUnavailable, err.Error()
+	}
+	return http.StatusInternalServerError, "Cannot create match."
+}
 
-	name := adjectives[rand.Intn(len(adjectives))] + "-" + animals[rand.Intn(len(animals))]
-
-	liveMatches.Lock()
-	// if name collision with existing match, randomly generate new names until finding one that's not in use
-	// (not ideal, but this is partly why we limit number of active matches)
-	for _, ok := liveMatches.internal[name]; ok; {
-		name = adjectives[rand.Intn(len(adjectives))] + "-" + animals[rand.Intn(len(animals))]
+// create and start a match with the settings given by param (e.g. param("maxRounds"))
+// returns the match and the creator's color
+func (cl *Cluster) createMatch(user *User, param func(string) string, password string) (*Match, string, error) {
+	userID, userName := user.ID, user.Name
+	match := newMatch(userName)
+	color := param("color")
+	switch color {
+	case "", white, black:
+	case randomColor:
+		color = white
+		if rand.Intn(2) == 0 {
+			color = black
+		}
+	default:
+		return nil, "", invalidSetting("Invalid color: '%s'.", color)
 	}
-	match := &Match{
-		Name:          name,
-		WhitePlayerID: userID,
-		BlackPlayerID: userID,
-		CreatorName:   userName,
-		TurnTimer:     turnTimer,
-		Phase:         readyUpPhase,
-		Round:         0, // when incrementing from 0, will sound new round fanfare
+	if color == black {
+		match.BlackPlayerID = userID
+	} else {
+		color = white
+		match.WhitePlayerID = userID
 	}
-	if c.Query("dev") == "true" {
+	if param("dev") == "true" {
 		match.TurnTimer = turnTimerDev
 		match.DevMode = true
 		match.Phase = kingPlacementPhase
 		match.Round = 1
 		match.LastMoveTime = time.Now().UnixNano()
+		match.RoundStartTime = match.LastMoveTime
 	}
-	if c.Query("ai") == "true" {
-		match.BlackAI = true
+	if param("ai") == "true" {
+		if color == white {
+			match.BlackAI = true
+		} else {
+			match.WhiteAI = true
+		}
+		switch level := param("aiLevel"); level {
+		case "":
+			match.AILevel = normalAI
+		case easyAI, normalAI:
+			match.AILevel = level
+		default:
+			return nil, "", invalidSetting("Invalid aiLevel: '%s'.", level)
+		}
 		match.Phase = kingPlacementPhase
 		match.Round = 1
 		match.LastMoveTime = time.Now().UnixNano()
+		match.RoundStartTime = match.LastMoveTime
+	}
+	if opponent := param("opponent"); opponent != "" {
+		if err := cl.challenge(match, user, color, opponent); err != nil {
+			return nil, "", err
+		}
+	}
+	if param("rated") == "true" {
+		if match.DevMode {
+			return nil, "", invalidSetting("Dev mode matches cannot be rated.")
+		}
+		match.Rated = true
+	}
+	switch ruleset := param("ruleset"); ruleset {
+	case "", standardRuleset:
+	case shortRuleset:
+		match.MaxRounds = shortRulesetRounds
+	default:
+		return nil, "", invalidSetting("Invalid ruleset: '%s'.", ruleset)
+	}
+	// (overrides the ruleset's)
+	if maxRounds := param("maxRounds"); maxRounds != "" {
+		n, err := strconv.Atoi(maxRounds)
+		if err != nil || n < 0 || n > maxRoundsLimit {
+			return nil, "", invalidSetting("Invalid maxRounds: '%s'.", maxRounds)
+		}
+		match.MaxRounds = n
+	}
+	if grace := param("grace"); grace != "" {
+		seconds, err := strconv.Atoi(grace)
+		if err != nil || seconds < 0 || int64(seconds)*int64(time.Second) > maxDisconnectGrace {
+			return nil, "", invalidSetting("Invalid grace: '%s'.", grace)
+		}
+		match.DisconnectGrace = int64(seconds) * int64(time.Second)
+	}
+	switch policy := param("onDisconnect"); policy {
+	case "":
+	case forfeitOnDisconnect, aiTakeoverOnDisconnect:
+		match.DisconnectPolicy = policy
+	default:
+		return nil, "", invalidSetting("Invalid onDisconnect: '%s'.", policy)
+	}
+	if delay := param("spectatorDelay"); delay != "" {
+		seconds, err := strconv.Atoi(delay)
+		if err != nil || seconds < 0 || int64(seconds)*int64(time.Second) > maxSpectatorDelay {
+			return nil, "", invalidSetting("Invalid spectatorDelay: '%s'.", delay)
+		}
+		match.SpectatorDelay = int64(seconds) * int64(time.Second)
+	}
+	if timeBank := param("timeBank"); timeBank != "" {
+		seconds, err := strconv.Atoi(timeBank)
+		if err != nil || seconds < 0 || int64(seconds)*int64(time.Second) > maxTimeBank {
+			return nil, "", invalidSetting("Invalid timeBank: '%s'.", timeBank)
+		}
+		match.TimeBank = int64(seconds) * int64(time.Second)
+	}
+	// (rating pools are by whole minutes of time bank)
+	if match.Rated && match.TimeBank%int64(time.Minute) != 0 {
+		return nil, "", invalidSetting("The timeBank of a rated match must be whole minutes.")
+	}
+	if increment := param("increment"); increment != "" {
+		seconds, err := strconv.Atoi(increment)
+		if err != nil || seconds < 0 || int64(seconds)*int64(time.Second) > maxTimeIncrement {
+			return nil, "", invalidSetting("Invalid increment: '%s'.", increment)
+		}
+		match.TimeIncrement = int64(seconds) * int64(time.Second)
+	}
+	if len(password) > maxPasswordLength {
+		return nil, "", invalidSetting("Password is too long.")
+	}
+	if err := match.restrict(param("private") == "true", password); err != nil {
+		return nil, "", err
+	}
+
+	if err := cl.startMatch(match); err != nil {
+		return nil, "", err
+	}
+	return match, color, nil
+}
+
+// create a match with the settings in the query string (or the form on the home page)
+// returns name of the match and the creator's color
+func createMatch(c *gin.Context, cl *Cluster) (string, string, error) {
+	user, err := cl.currentUser(c)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Could not identify user.")
+		return "", "", err
+	}
+	// (the password is taken only from a posted form, to keep it out of URLs and logs)
+	match, color, err := cl.createMatch(user, c.Request.FormValue, c.Request.PostFormValue("password"))
+	if err != nil {
+		status, message := createMatchFailure(err)
+		c.String(status, "%s", message)
+		return "", "", err
+	}
+	return match.Name, color, nil
+}
+
+// match with default settings, not yet started
+func newMatch(creatorName string) *Match {
+	return &Match{
+		CreatorName:      creatorName,
+		TurnTimer:        turnTimer,
+		Phase:            readyUpPhase,
+		Round:            0, // when incrementing from 0, will sound new round fanfare
+		DisconnectGrace:  defaultDisconnectGrace,
+		DisconnectPolicy: forfeitOnDisconnect,
 	}
+}
 
-	// clean up any dead or timedout matches
-	for name, match := range liveMatches.internal {
-		exceededTimeout := time.Now().UnixNano() > match.LastMoveTime+matchTimeout
-		if match.Phase == gameoverPhase || exceededTimeout {
-			liveMatches.internal[name].Mutex.Lock()
-			delete(liveMatches.internal, name)
+var errMaxMatches = errors.New("At max matches. Cannot create an additional match.")
+var errMatchCrashed = errors.New("Match could not be started because of a server error.")
+
+// reserve a name for the match, initialize it, and start running it
+func (cl *Cluster) startMatch(match *Match) error {
+	if cl.shuttingDown() {
+		return errShuttingDown
+	}
+	liveMatches := cl.Matches
+	// if name collision with existing match (on any instance), randomly generate new names until finding one that's not in use
+	// (not ideal, but this is partly why we limit number of active matches)
+	// taking the lease reserves the name
+	var name string
+	for {
+		name = adjectives[rand.Intn(len(adjectives))] + "-" + animals[rand.Intn(len(animals))]
+		existing, err := cl.Store.LoadMatchSummary(name)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			continue
+		}
+		owner, err := cl.Store.AcquireMatch(name, cl.ID, leaseTTL)
+		if err != nil {
+			return err
+		}
+		if owner == cl.ID {
+			break
 		}
 	}
-	nMatches := len(liveMatches.internal)
-	liveMatches.Unlock()
+	match.Name = name
 
+	// (finished and timed out matches are cleaned up by the reaper)
+	liveMatches.RLock()
+	nMatches := len(liveMatches.internal)
+	liveMatches.RUnlock()
 	if nMatches >= maxConcurrentMatches {
-		c.String(http.StatusInternalServerError, "Cannot create match. Server currently at max number of matches.")
-		return "", errors.New("At max matches. Cannot create an additional match.")
+		cl.Store.ReleaseMatch(name, cl.ID)
+		return errMaxMatches
 	}
 
-	initMatch(match)
+	match.Mutex.Lock()
+	crashed := match.guard("initialization", func() {
+		initMatch(match)
+	})
+	match.Mutex.Unlock()
+	if crashed {
+		cl.Store.ReleaseMatch(name, cl.ID)
+		return errMatchCrashed
+	}
 	liveMatches.Store(match)
-	return match.Name, nil
-}
-
-func timeTrack(start time.Time, name string) {
-	elapsed := time.Since(start)
-	log.Printf("%s took %s\n", name, elapsed)
+	cl.saveMatch(match)
+	go runMatchClock(match, cl.matchOver)
+	return nil
 }
 
 func main() {
 	rand.Seed(time.Now().UnixNano())
+	initLogging()
 	port := os.Getenv("PORT")
 	if port == "" {
-		log.Fatal("$PORT must be set")
+		logger.Error("$PORT must be set")
+		os.Exit(1)
 	}
 	sort.Slice(allCards, func(i, j int) bool {
 		return allCards[i].Rank < allCards[j].Rank
@@ -277,7 +496,7 @@ func main() {
 		}
 	}
 	cardRankCount = append(cardRankCount, i)
-	fmt.Println("cardRankCount", cardRankCount)
+	logger.Debug("counted cards by rank", "cardRankCount", cardRankCount)
 	liveMatches := NewMatchMap()
 	{
 		x := 0
@@ -291,22 +510,44 @@ func main() {
 			}
 		}
 	}
-	users := NewUserMap()
+	var store MatchStore
+	var bus MessageBus
+	// instances sharing a redis run as one server
+	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+		store = newRedisStore(redisURL)
+		bus = newRedisBus(redisURL)
+	} else {
+		// (what the last run left at shutdown)
+		memory := newMemoryStore()
+		if err := memory.readSnapshot(storeSnapshotPath()); err != nil {
+			logger.Error("could not read store snapshot", "path", storeSnapshotPath(), "err", err)
+		}
+		store = memory
+		bus = newMemoryBus()
+	}
+	cl, err := newCluster(store, bus, liveMatches)
+	if err != nil {
+		logger.Error("could not start cluster", "err", err)
+		os.Exit(1)
+	}
+	cl.restoreMatches()
+	initSessionSecret()
+	initAdmins()
 	router := gin.New()
-	router.Use(gin.Logger())
+	router.Use(requestLogger)
 	router.LoadHTMLGlob("templates/*.tmpl")
 	router.Static("/static", "static")
 
 	router.GET("/", func(c *gin.Context) {
-		userID, err := c.Cookie("user_id")
-		userName, _ := c.Cookie("user_name")
-		userID, userName, err = validateUser(c, userID, userName, users)
+		user, err := cl.currentUser(c)
 		if err != nil {
-			fmt.Printf("Error generating UUIDv4: %s", err)
+			logger.Error("could not identify user", "err", err)
+			c.String(http.StatusInternalServerError, "Could not identify user.")
 			return
 		}
+		userID, userName := user.ID, user.Name
 
-		fmt.Printf("User id: %s User name: %s \n", userID, userName)
+		logger.Debug("home page", "user", userID, "name", userName)
 
 		now := time.Now()
 		type match struct {
@@ -315,49 +556,357 @@ func main() {
 			StartTime   int64
 			Elapsed     string
 			Color       string
+			Spectators  int
+			Locked      bool // has a password
+		}
+		summaries, err := cl.listSummaries()
+		if err != nil {
+			logger.Error("could not list matches", "err", err)
+			c.String(http.StatusInternalServerError, "Could not list matches.")
+			return
 		}
-		liveMatches.Lock()
 		matches := []match{}
 		playerMatches := []match{}
-		for _, m := range liveMatches.internal {
+		liveGames := []match{}
+		for _, m := range summaries {
 			elapsed := fmtDuration(now.Sub(time.Unix(0, m.StartTime)))
-			if m.IsBlackOpen() && m.DevMode == false {
-				matches = append(matches, match{m.Name, m.CreatorName, m.StartTime, elapsed, none})
+			if m.Open && m.DevMode == false {
+				matches = append(matches, match{m.Name, m.CreatorName, m.StartTime, elapsed, m.OpenColor, 0, m.Locked})
+			}
+			if m.Live && m.DevMode == false && !m.Private {
+				liveGames = append(liveGames, match{m.Name, m.CreatorName, m.StartTime, elapsed, none, m.Spectators, false})
 			}
 			if m.BlackPlayerID == userID {
-				playerMatches = append(playerMatches, match{m.Name, m.CreatorName, m.StartTime, elapsed, black})
+				playerMatches = append(playerMatches, match{m.Name, m.CreatorName, m.StartTime, elapsed, black, 0, m.Locked})
 			} else if m.WhitePlayerID == userID {
-				playerMatches = append(playerMatches, match{m.Name, m.CreatorName, m.StartTime, elapsed, white})
+				playerMatches = append(playerMatches, match{m.Name, m.CreatorName, m.StartTime, elapsed, white, 0, m.Locked})
 			}
 		}
 		sort.Slice(matches, func(i, j int) bool { return matches[i].StartTime > matches[j].StartTime })
-		liveMatches.Unlock()
+		sort.Slice(liveGames, func(i, j int) bool { return liveGames[i].StartTime > liveGames[j].StartTime })
+		recent, err := cl.listMatchRecords(userID)
+		if err != nil {
+			logger.Error("could not list match records", "err", err)
+		}
+		if len(recent) > recentMatchesShown {
+			recent = recent[:recentMatchesShown]
+		}
 
 		c.HTML(http.StatusOK, "home.tmpl", struct {
 			ID            string
 			Name          string
+			Registered    bool
 			Matches       []match
 			PlayerMatches []match
-		}{userID, userName, matches, playerMatches})
+			LiveGames     []match
+			RecentMatches []MatchRecord
+		}{userID, userName, user.Registered(), matches, playerMatches, liveGames, recent})
 	})
 
 	router.GET("/guide", func(c *gin.Context) {
 		c.HTML(http.StatusOK, "guide.tmpl", nil)
 	})
 
-	router.GET("/createMatch", func(c *gin.Context) {
-		name, err := createMatch(c, liveMatches, users)
+	router.GET("/leaderboard", func(c *gin.Context) {
+		pools, err := cl.Store.ListRatingPools()
+		if err != nil {
+			logger.Error("could not list rating pools", "err", err)
+			c.String(http.StatusInternalServerError, "Could not list ratings.")
+			return
+		}
+		sort.Strings(pools)
+		pool := c.Query("pool")
+		if pool == "" {
+			pool = ratingPool(0, 0, 0)
+		}
+		ratings, err := cl.listRatings(pool)
+		if err != nil {
+			logger.Error("could not list ratings", "err", err)
+			c.String(http.StatusInternalServerError, "Could not list ratings.")
+			return
+		}
+		established := []*Rating{}
+		for _, rating := range ratings {
+			if !rating.Provisional() {
+				established = append(established, rating)
+			}
+		}
+		sort.Slice(established, func(i, j int) bool { return established[i].Rating > established[j].Rating })
+		if len(established) > leaderboardSize {
+			established = established[:leaderboardSize]
+		}
+		type row struct {
+			Rank int
+			*Rating
+		}
+		rows := make([]row, len(established))
+		for i, rating := range established {
+			rows[i] = row{i + 1, rating}
+		}
+		c.HTML(http.StatusOK, "leaderboard.tmpl", gin.H{
+			"Pool":        pool,
+			"Pools":       pools,
+			"Ratings":     rows,
+			"Provisional": len(ratings) - len(established),
+		})
+	})
+
+	// a registered user's stats and match history
+	router.GET("/u/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		userID, err := cl.Store.LookupUserKey(nameIndex, strings.ToLower(name))
+		var user *User
+		if err == nil && userID != "" {
+			user, err = cl.loadUser(userID)
+		}
+		if err != nil {
+			logger.Error("could not load user", "err", err)
+			c.String(http.StatusInternalServerError, "Could not load user.")
+			return
+		}
+		if user == nil {
+			c.String(http.StatusNotFound, "No user named '%s' exists.", name)
+			return
+		}
+		records, err := cl.listMatchRecords(user.ID)
+		if err != nil {
+			logger.Error("could not list match records", "err", err)
+			c.String(http.StatusInternalServerError, "Could not list matches.")
+			return
+		}
+		c.HTML(http.StatusOK, "profile.tmpl", gin.H{
+			"User":    user,
+			"Stats":   profileStats(records),
+			"Records": records,
+		})
+	})
+
+	router.GET("/replay/:name", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "index.tmpl", nil)
+	})
+
+	router.GET("/replay/:name/frames", func(c *gin.Context) {
+		name := c.Param("name")
+		user, err := cl.currentUser(c)
+		if err != nil {
+			logger.Error("could not identify user", "err", err)
+			c.String(http.StatusInternalServerError, "Could not identify user.")
+			return
+		}
+		replay, err := cl.replayFor(name, user.ID)
+		if err != nil {
+			logger.Error("could not load replay", "err", err)
+			c.String(http.StatusInternalServerError, "Could not load replay.")
+			return
+		}
+		if replay == nil {
+			c.String(http.StatusNotFound, "No replay of match '%s' exists.", name)
+			return
+		}
+		c.Data(http.StatusOK, "application/json", replay)
+	})
+
+	router.GET("/ratings/:id", func(c *gin.Context) {
+		userID := c.Param("id")
+		user, err := cl.loadUser(userID)
+		if err != nil {
+			logger.Error("could not load user", "err", err)
+			c.String(http.StatusInternalServerError, "Could not load user.")
+			return
+		}
+		if user == nil {
+			c.String(http.StatusNotFound, "No user with id '%s' exists.", userID)
+			return
+		}
+		pools, err := cl.Store.ListRatingPools()
+		if err != nil {
+			logger.Error("could not list rating pools", "err", err)
+			c.String(http.StatusInternalServerError, "Could not list ratings.")
+			return
+		}
+		sort.Strings(pools)
+		ratings := []*Rating{}
+		for _, pool := range pools {
+			rating, err := cl.loadRating(pool, userID)
+			if err != nil {
+				logger.Error("could not load rating", "err", err)
+				continue
+			}
+			if rating.Games > 0 {
+				ratings = append(ratings, rating)
+			}
+		}
+		changes, err := cl.listRatingChanges(userID)
+		if err != nil {
+			logger.Error("could not list rating changes", "err", err)
+		}
+		c.HTML(http.StatusOK, "ratings.tmpl", gin.H{
+			"Name":    user.Name,
+			"Ratings": ratings,
+			"Changes": changes,
+		})
+	})
+
+	router.GET("/account", func(c *gin.Context) {
+		user, err := cl.currentUser(c)
+		if err != nil {
+			logger.Error("could not identify user", "err", err)
+			c.String(http.StatusInternalServerError, "Could not identify user.")
+			return
+		}
+		c.HTML(http.StatusOK, "account.tmpl", gin.H{"User": user, "Bots": cl.listBots(user)})
+	})
+
+	// account forms render the account page with the outcome
+	accountResult := func(c *gin.Context, user *User, message string, err error) {
+		status := http.StatusOK
+		if err != nil {
+			status = http.StatusBadRequest
+			message = err.Error()
+		}
+		bots := []*User{}
+		if user != nil {
+			bots = cl.listBots(user)
+		}
+		c.HTML(status, "account.tmpl", gin.H{"User": user, "Message": message, "Bots": bots})
+	}
+
+	router.POST("/register", func(c *gin.Context) {
+		user, err := cl.currentUser(c)
+		if err != nil {
+			logger.Error("could not identify user", "err", err)
+			c.String(http.StatusInternalServerError, "Could not identify user.")
+			return
+		}
+		email := c.PostForm("email")
+		err = cl.requestRegistration(c, c.PostForm("name"), email)
+		accountResult(c, user, "We sent a link to "+email+". Open it in this browser to finish registering.", err)
+	})
+
+	router.POST("/login", func(c *gin.Context) {
+		user, err := cl.currentUser(c)
+		if err != nil {
+			logger.Error("could not identify user", "err", err)
+			c.String(http.StatusInternalServerError, "Could not identify user.")
+			return
+		}
+		email := c.PostForm("email")
+		err = cl.requestLogin(c, email)
+		accountResult(c, user, "If "+email+" has an account, we sent it a login link.", err)
+	})
+
+	// emailed login link
+	router.GET("/login/:token", func(c *gin.Context) {
+		if _, err := cl.completeLogin(c, c.Param("token")); err != nil {
+			logger.Error("could not complete login", "err", err)
+			accountResult(c, nil, "", err)
+			return
+		}
+		c.Redirect(http.StatusSeeOther, "/account")
+	})
+
+	router.POST("/logout", func(c *gin.Context) {
+		clearSession(c)
+		c.Redirect(http.StatusSeeOther, "/")
+	})
+
+	router.POST("/account/name", func(c *gin.Context) {
+		user, err := cl.currentUser(c)
+		if err != nil {
+			logger.Error("could not identify user", "err", err)
+			c.String(http.StatusInternalServerError, "Could not identify user.")
+			return
+		}
+		err = cl.rename(user, c.PostForm("name"))
+		accountResult(c, user, "Your name is now "+user.Name+".", err)
+	})
+
+	// (a bot's token is shown only once, here; see bots.go)
+	router.POST("/account/bots", func(c *gin.Context) {
+		user, err := cl.currentUser(c)
+		if err != nil {
+			logger.Error("could not identify user", "err", err)
+			c.String(http.StatusInternalServerError, "Could not identify user.")
+			return
+		}
+		bot, token, err := cl.createBot(user, c.PostForm("name"))
+		message := ""
+		if err == nil {
+			message = "Created " + bot.Name + ". Its API token (which won't be shown again) is " + token
+		}
+		accountResult(c, user, message, err)
+	})
+
+	router.POST("/account/bots/:name/token", func(c *gin.Context) {
+		user, err := cl.currentUser(c)
+		if err != nil {
+			logger.Error("could not identify user", "err", err)
+			c.String(http.StatusInternalServerError, "Could not identify user.")
+			return
+		}
+		bot := cl.ownedBot(user, c.Param("name"))
+		if bot == nil {
+			c.String(http.StatusNotFound, "You have no bot named '%s'.", c.Param("name"))
+			return
+		}
+		token, err := cl.issueBotToken(bot)
+		accountResult(c, user, "The new API token of "+bot.Name+" (which won't be shown again) is "+token+". The old token no longer works.", err)
+	})
+
+	router.GET("/queue", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "queue.tmpl", nil)
+	})
+
+	// wait in the matchmaking queue
+	router.GET("/ws-queue", cl.authenticateBot, func(c *gin.Context) {
+		if cl.shuttingDown() {
+			c.String(http.StatusServiceUnavailable, errShuttingDown.Error())
+			return
+		}
+		user, err := cl.currentUser(c)
+		if err != nil {
+			logger.Error("could not identify user", "err", err)
+			c.String(http.StatusInternalServerError, "Could not identify user.")
+			return
+		}
+		userID, userName := user.ID, user.Name
+		entry, err := newQueueEntry(c, userID, userName)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		if entry.Rated {
+			rating, err := cl.loadRating(entry.pool(), userID)
+			if err != nil {
+				logger.Error("could not load rating", "err", err)
+				c.String(http.StatusInternalServerError, "Could not load rating.")
+				return
+			}
+			entry.Rating = rating.Rating
+		}
+		wsConn, err := wsupgrader.Upgrade(c.Writer, c.Request, nil)
 		if err != nil {
-			fmt.Printf(err.Error())
+			logger.Error("could not upgrade to websocket", "err", err)
 			return
 		}
-		c.Redirect(http.StatusSeeOther, "/match/"+name+"/white")
+		cl.queuePlayer(wsConn, entry)
 	})
 
+	createMatchHandler := func(c *gin.Context) {
+		name, color, err := createMatch(c, cl)
+		if err != nil {
+			logger.Warn("could not create match", "err", err)
+			return
+		}
+		c.Redirect(http.StatusSeeOther, "/match/"+name+"/"+color)
+	}
+	router.GET("/createMatch", createMatchHandler)
+	router.POST("/createMatch", createMatchHandler)
+
 	router.GET("/dev", func(c *gin.Context) {
-		name, err := createMatch(c, liveMatches, users)
+		name, _, err := createMatch(c, cl)
 		if err != nil {
-			fmt.Printf(err.Error())
+			logger.Warn("could not create match", "err", err)
 			return
 		}
 		c.Redirect(http.StatusSeeOther, "/dev/"+name)
@@ -369,13 +918,13 @@ func main() {
 	})
 
 	router.GET("/match/:name/:color", func(c *gin.Context) {
-		userID, err := c.Cookie("user_id")
-		userName, _ := c.Cookie("user_name")
-		userID, userName, err = validateUser(c, userID, userName, users)
+		user, err := cl.currentUser(c)
 		if err != nil {
-			fmt.Printf("Error generating UUIDv4: %s", err)
+			logger.Error("could not identify user", "err", err)
+			c.String(http.StatusInternalServerError, "Could not identify user.")
 			return
 		}
+		userID := user.ID
 
 		name := c.Param("name")
 		color := c.Param("color")
@@ -383,48 +932,130 @@ func main() {
 			c.String(http.StatusNotFound, "Must specify black or white. Invalid match color: '%s'.", color)
 			return
 		}
-		log.Printf("joining match: %v\n", name)
 
 		match, ok := liveMatches.Load(name)
-		match.Mutex.Lock()
 		if !ok {
-			c.String(http.StatusNotFound, "No match with id '%s' exists.", name)
+			// run by another instance (or by none, if it went away): seat is claimed when the websocket connects
+			summary, err := cl.loadSummary(name)
+			if err != nil {
+				logger.Error("could not load match", "match", name, "err", err)
+			}
+			if summary == nil {
+				c.String(http.StatusNotFound, "No match with id '%s' exists.", name)
+				return
+			}
+			playerID := summary.WhitePlayerID
+			if color == black {
+				playerID = summary.BlackPlayerID
+			}
+			// (the owner checks the grant itself)
+			err = nil
+			if playerID == "" && (summary.Private || summary.Locked) && c.Query("grant") == "" {
+				err = errInviteRequired
+			} else if playerID != "" && playerID != userID {
+				err = errSeatTaken
+			}
+			if err != nil {
+				c.String(http.StatusBadRequest, "Cannot join match '%s' as %s. %s", name, color, err)
+				return
+			}
+			c.HTML(http.StatusOK, "index.tmpl", nil)
+			return
+		}
+		match.Mutex.Lock()
+		if err := match.claimSeat(color, userID, c.Query("grant")); err != nil {
+			c.String(http.StatusBadRequest, "Cannot join match '%s' as %s. %s", name, color, err)
 			match.Mutex.Unlock()
 			return
 		}
-		if color == "black" {
-			if match.BlackPlayerID == "" {
-				match.BlackPlayerID = userID
-			} else if match.BlackPlayerID != userID {
-				c.String(http.StatusBadRequest,
-					"Cannot join match '%s' as black. Another player is already playing that color.", name,
-				)
-				match.Mutex.Unlock()
+		match.Mutex.Unlock()
+		c.HTML(http.StatusOK, "index.tmpl", nil)
+	})
+
+	// checks the invite (and password) and sends the player on to the open seat with a grant
+	join := func(c *gin.Context) {
+		user, err := cl.currentUser(c)
+		if err != nil {
+			logger.Error("could not identify user", "err", err)
+			c.String(http.StatusInternalServerError, "Could not identify user.")
+			return
+		}
+		name := c.Param("name")
+		info, err := cl.loadJoinInfo(name)
+		if err != nil {
+			logger.Error("could not load match", "match", name, "err", err)
+		}
+		if info != nil {
+			if color := info.seat(user.ID); color != "" {
+				c.Redirect(http.StatusSeeOther, "/match/"+name+"/"+color)
 				return
 			}
-		} else {
-			if match.WhitePlayerID == "" {
-				match.WhitePlayerID = userID
-			} else if match.WhitePlayerID != userID {
-				c.String(http.StatusBadRequest,
-					"Cannot join match '%s' as white. Another player is already playing that color.", name,
-				)
-				match.Mutex.Unlock()
+		}
+		invite := c.Request.FormValue("invite")
+		// a private match doesn't exist for those without the invite
+		if info == nil || !info.validInvite(invite) {
+			c.String(http.StatusNotFound, "No match with id '%s' exists.", name)
+			return
+		}
+		if info.OpenColor == "" {
+			c.String(http.StatusBadRequest, "Cannot join match '%s'. Both seats are taken.", name)
+			return
+		}
+		message := ""
+		if info.Locked {
+			password := c.Request.PostFormValue("password")
+			if c.Request.Method == http.MethodPost && !info.validPassword(password) {
+				message = "Wrong password."
+			}
+			if c.Request.Method != http.MethodPost || message != "" {
+				c.HTML(http.StatusOK, "join.tmpl", gin.H{"Match": info, "Invite": invite, "Message": message})
 				return
 			}
 		}
-		match.Mutex.Unlock()
+		path := "/match/" + name + "/" + info.OpenColor
+		if info.InviteToken != "" {
+			path += "?grant=" + url.QueryEscape(seatGrant(info.InviteToken, info.OpenColor, user.ID))
+		}
+		c.Redirect(http.StatusSeeOther, path)
+	}
+	router.GET("/join/:name", join)
+	router.POST("/join/:name", join)
+
+	router.GET("/watch/:name", func(c *gin.Context) {
+		user, err := cl.currentUser(c)
+		if err != nil {
+			logger.Error("could not identify user", "err", err)
+			c.String(http.StatusInternalServerError, "Could not identify user.")
+			return
+		}
+		name := c.Param("name")
+		info, err := cl.loadJoinInfo(name)
+		if err != nil {
+			logger.Error("could not load match", "match", name, "err", err)
+		}
+		// a private match doesn't exist for those without the invite
+		if info == nil || !info.canWatch(user.ID, c.Query("invite")) {
+			c.String(http.StatusNotFound, "No match with id '%s' exists.", name)
+			return
+		}
 		c.HTML(http.StatusOK, "index.tmpl", nil)
 	})
 
-	router.GET("/ws/:name/:color", func(c *gin.Context) {
-		userID, err := c.Cookie("user_id")
-		userName, _ := c.Cookie("user_name")
-		userID, userName, err = validateUser(c, userID, userName, users)
+	// read-only connection for spectators
+	router.GET("/ws-watch/:name", cl.authenticateBot, cl.watchSocket)
+
+	router.GET("/ws/:name/:color", cl.authenticateBot, func(c *gin.Context) {
+		if cl.shuttingDown() {
+			c.String(http.StatusServiceUnavailable, errShuttingDown.Error())
+			return
+		}
+		user, err := cl.currentUser(c)
 		if err != nil {
-			fmt.Printf("Error generating UUIDv4: %s", err)
+			logger.Error("could not identify user", "err", err)
+			c.String(http.StatusInternalServerError, "Could not identify user.")
 			return
 		}
+		userID := user.ID
 
 		name := c.Param("name")
 		color := c.Param("color")
@@ -432,77 +1063,167 @@ func main() {
 			c.String(http.StatusNotFound, "Must specify black or white. Invalid match color: '%s'.", color)
 			return
 		}
-		log.Printf("joining match: %v\n", name)
 
-		match, ok := liveMatches.Load(name)
-		if !ok {
+		match, owner, err := cl.localMatch(name)
+		if err != nil {
+			logger.Error("could not load match", "match", name, "err", err)
+		}
+		if match == nil && owner == "" {
 			c.String(http.StatusNotFound, "No match with id '%s' exists.", name)
 			return
 		}
-		match.Mutex.Lock()
-		if color == "black" {
-			if match.BlackPlayerID != userID {
-				c.String(http.StatusBadRequest,
-					"Cannot join match '%s' as black. Another player is already playing that color.", name,
-				)
-				match.Mutex.Unlock()
-				return
-			}
-		} else {
-			if match.WhitePlayerID != userID {
-				c.String(http.StatusBadRequest,
-					"Cannot join match '%s' as white. Another player is already playing that color.", name,
-				)
-				match.Mutex.Unlock()
+		lastSeq := parseLastSeq(c.Query("lastSeq"))
+		if match == nil {
+			// the owner checks the seat
+			wsConn, err := wsupgrader.Upgrade(c.Writer, c.Request, nil)
+			if err != nil {
+				logger.Error("could not upgrade to websocket", "err", err)
 				return
 			}
+			conn := newClient(wsConn, connLabel(name, color)+" (relayed)")
+			cl.relay(conn, func(handle func([]byte), limited func([]byte)) {
+				cl.readMessages(wsConn, conn, userID, handle, limited)
+			}, name, owner, color, userID, user.Name, c.Query("grant"), lastSeq)
+			return
+		}
+		match.Mutex.Lock()
+		if err := match.claimSeat(color, userID, c.Query("grant")); err != nil {
+			c.String(http.StatusBadRequest, "Cannot join match '%s' as %s. %s", name, color, err)
+			match.Mutex.Unlock()
+			return
 		}
 
-		conn, err := wsupgrader.Upgrade(c.Writer, c.Request, nil)
+		wsConn, err := wsupgrader.Upgrade(c.Writer, c.Request, nil)
 		if err != nil {
-			fmt.Printf("Failed to set websocket upgrade: %+v", err)
+			logger.Error("could not upgrade to websocket", "err", err)
 			match.Mutex.Unlock()
 			return
 		}
-		// if client is valid, we kill previous websocket to start new one
-		if color == black {
-			if match.BlackConn != nil {
-				match.BlackConn.Close()
-				fmt.Printf("Closed black connection in match '%s' ", match.Name)
-			}
-			match.BlackConn = conn
-		} else {
-			if match.WhiteConn != nil {
-				match.WhiteConn.Close()
-				fmt.Printf("Closed white connection in match '%s' ", match.Name)
-			}
-			match.WhiteConn = conn
-		}
+		conn := newClient(wsConn, connLabel(name, color))
+		match.attachPlayer(color, conn, lastSeq)
 		match.Mutex.Unlock()
+		cl.saveMatch(match)
 
-		for {
-			_, msg, err := conn.ReadMessage()
-			if err != nil {
-				break
+		cl.readMessages(wsConn, conn, userID, func(msg []byte) {
+			if cl.processMessage(msg, match, color) {
+				cl.saveMatch(match)
 			}
-			processMessage(msg, match, color)
-		}
+		}, func(msg []byte) {
+			rejectLimited(msg, match, color)
+		})
 
 		match.Mutex.Lock()
-		conn.Close()
-		if color == black {
-			// a subsequent request may have replaced this conn, so we check
-			if match.BlackConn == conn {
-				match.BlackConn = nil
-			}
-		} else if color == white {
-			if match.WhiteConn == conn {
-				match.WhiteConn = nil
-			}
-		}
-		fmt.Printf("Closed connection '%s' in match %s ", color, match.Name)
+		match.detachPlayer(color, conn)
 		match.Mutex.Unlock()
+		cl.saveMatch(match)
+	})
+
+	// for Prometheus (see metrics.go)
+	metricsToken := os.Getenv("METRICS_TOKEN")
+	router.GET("/metrics", func(c *gin.Context) {
+		auth := []byte(c.GetHeader("Authorization"))
+		if metricsToken != "" && subtle.ConstantTimeCompare(auth, []byte("Bearer "+metricsToken)) != 1 {
+			c.String(http.StatusUnauthorized, "Missing or wrong metrics token.")
+			return
+		}
+		c.Header("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(c.Writer)
+	})
+
+	// JSON API (see api.go)
+	api := router.Group("/api/v1", cl.authenticateBot)
+	api.GET("/matches", cl.apiLobby)
+	api.POST("/matches", cl.apiCreateMatch)
+	api.GET("/matches/:name", cl.apiMatchState)
+	api.POST("/matches/:name/join", cl.apiJoin)
+	api.GET("/matches/:name/result", cl.apiResult)
+	api.GET("/matches/:name/replay", cl.apiReplay)
+	api.GET("/users/:name/matches", cl.apiUserMatches)
+	api.GET("/challenges", cl.apiChallenges)
+	// bots only (see bots.go)
+	bot := api.Group("/bot", requireBot)
+	bot.GET("/matches/:name/:color/stream", cl.botStream)
+	bot.POST("/matches/:name/:color/actions", cl.botAction)
+
+	// operators only (see requireAdmin)
+	admin := router.Group("/admin", cl.requireAdmin)
+
+	// console renders its pages with the outcome of the admin's last action
+	adminHome := func(c *gin.Context, message string, err error) {
+		status := http.StatusOK
+		if err != nil {
+			status = http.StatusBadRequest
+			message = err.Error()
+		}
+		rows, err := cl.adminMatchRows()
+		if err != nil {
+			logger.Error("could not list matches", "err", err)
+			c.String(http.StatusInternalServerError, "Could not list matches.")
+			return
+		}
+		c.HTML(status, "admin.tmpl", gin.H{"Matches": rows, "Instance": cl.ID, "Message": message})
+	}
+	adminMatch := func(c *gin.Context, message string, err error) {
+		status := http.StatusOK
+		if err != nil {
+			status = http.StatusBadRequest
+			message = err.Error()
+		}
+		name := c.Param("name")
+		state, spectators, err := cl.adminMatchState(name)
+		if err != nil {
+			logger.Error("could not load match", "match", name, "err", err)
+			c.String(http.StatusInternalServerError, "Could not load match.")
+			return
+		}
+		if state == nil {
+			c.String(http.StatusNotFound, "No match with id '%s' exists.", name)
+			return
+		}
+		summary, err := cl.loadSummary(name)
+		if err != nil {
+			logger.Error("could not load match", "match", name, "err", err)
+		}
+		owner, err := cl.Store.MatchOwner(name)
+		if err != nil {
+			logger.Error("could not load match owner", "match", name, "err", err)
+		}
+		c.HTML(status, "admin_match.tmpl", gin.H{
+			"Name":       name,
+			"Summary":    summary,
+			"Owner":      owner,
+			"Local":      owner == cl.ID,
+			"Spectators": spectators,
+			"State":      string(state),
+			"Message":    message,
+		})
+	}
+
+	admin.GET("", func(c *gin.Context) {
+		adminHome(c, "", nil)
+	})
+
+	admin.POST("/notice", func(c *gin.Context) {
+		err := cl.broadcastNotice(c.PostForm("message"))
+		adminHome(c, "Notice sent to all connected players and spectators.", err)
+	})
+
+	admin.GET("/match/:name", func(c *gin.Context) {
+		adminMatch(c, "", nil)
+	})
+
+	admin.POST("/match/:name", func(c *gin.Context) {
+		user := c.MustGet(adminUserKey).(*User)
+		action := AdminAction{
+			Action: c.PostForm("action"),
+			Winner: c.PostForm("winner"),
+			Target: c.PostForm("target"),
+			Color:  c.PostForm("color"),
+			Admin:  user.Name,
+		}
+		message, err := cl.adminAction(c.Param("name"), action)
+		adminMatch(c, message, err)
 	})
 
-	router.Run(":" + port)
+	cl.serve(&http.Server{Addr: ":" + port, Handler: router})
 }
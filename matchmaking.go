@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Matchmaking
+//
+// Players wait in a queue shared by all instances, each connected by a websocket to whichever
+// instance they landed on. The matchmaker runs on one instance at a time (whichever holds its lease).
+// It pairs players with the same preferences whose ratings are close, allowing a wider gap the longer
+// they have waited, then creates the match and tells both players (via their tickets' bus channels)
+// where to go.
+
+// rulesets
+const (
+	standardRuleset = "standard"
+	shortRuleset    = "short" // match ends after shortRulesetRounds
+)
+
+const shortRulesetRounds = 10
+
+const (
+	matchmakingInterval = 2 * time.Second
+	matchmakerLease     = "matchmaker" // lease name (can't collide with a match name, which always has a hyphen)
+	defaultRating       = 1500.0
+	baseRatingWindow    = 100.0 // max rating gap between paired players who have only just joined the queue
+	ratingWindowGrowth  = 10.0  // added to the max rating gap for each second waited
+)
+
+type QueueEntry struct {
+	Ticket      string // identifies this wait in the queue (and the bus channel of the player's connection)
+	UserID      string
+	UserName    string
+	Ruleset     string
+	Rated       bool
+	TimeControl string // see parseTimeControl
+	Rating      float64
+	JoinTime    int64 // unix nano
+	LastSeen    int64 // unix nano; refreshed while the player's connection is open
+}
+
+func ticketChannel(ticket string) string {
+	return "chrss:ticket:" + ticket
+}
+
+// "none" or "<minutes>+<seconds>": minutes in each player's time bank and seconds of increment per turn
+// returns time bank and increment in nanoseconds
+func parseTimeControl(s string) (int64, int64, error) {
+	if s == "none" {
+		return 0, 0, nil
+	}
+	parts := strings.Split(s, "+")
+	if len(parts) != 2 {
+		return 0, 0, errors.New("Invalid time control: " + s)
+	}
+	minutes, err := strconv.Atoi(parts[0])
+	if err != nil || minutes <= 0 || int64(minutes)*int64(time.Minute) > maxTimeBank {
+		return 0, 0, errors.New("Invalid time control: " + s)
+	}
+	seconds, err := strconv.Atoi(parts[1])
+	if err != nil || seconds < 0 || int64(seconds)*int64(time.Second) > maxTimeIncrement {
+		return 0, 0, errors.New("Invalid time control: " + s)
+	}
+	return int64(minutes) * int64(time.Minute), int64(seconds) * int64(time.Second), nil
+}
+
+// preferences from query: ruleset, rated, and timeControl
+func newQueueEntry(c *gin.Context, userID string, userName string) (*QueueEntry, error) {
+	ticket, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UnixNano()
+	entry := &QueueEntry{
+		Ticket:      ticket.String(),
+		UserID:      userID,
+		UserName:    userName,
+		Ruleset:     c.DefaultQuery("ruleset", standardRuleset),
+		Rated:       c.Query("rated") == "true",
+		TimeControl: c.DefaultQuery("timeControl", "none"),
+		Rating:      defaultRating,
+		JoinTime:    now,
+		LastSeen:    now,
+	}
+	if entry.Ruleset != standardRuleset && entry.Ruleset != shortRuleset {
+		return nil, errors.New("Invalid ruleset: " + entry.Ruleset)
+	}
+	if _, _, err := parseTimeControl(entry.TimeControl); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// rating pool of the match the player wants
+func (entry *QueueEntry) pool() string {
+	maxRounds := 0
+	if entry.Ruleset == shortRuleset {
+		maxRounds = shortRulesetRounds
+	}
+	timeBank, timeIncrement, _ := parseTimeControl(entry.TimeControl)
+	return ratingPool(maxRounds, timeBank, timeIncrement)
+}
+
+func (cl *Cluster) listQueue() ([]QueueEntry, error) {
+	list, err := cl.Store.ListQueueEntries()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]QueueEntry, 0, len(list))
+	for _, bytes := range list {
+		var entry QueueEntry
+		if err := json.Unmarshal(bytes, &entry); err != nil {
+			logger.Error("could not JSON decode queue entry", "err", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// keep player in the queue until matched or their connection closes
+func (cl *Cluster) queuePlayer(wsConn *websocket.Conn, entry *QueueEntry) {
+	conn := newClient(wsConn, "queue connection of user "+entry.UserName)
+	frames, unsubscribe, err := cl.Bus.Subscribe(ticketChannel(entry.Ticket))
+	if err != nil {
+		logger.Error("could not subscribe to ticket channel", "err", err)
+		conn.close(websocket.CloseTryAgainLater, "")
+		return
+	}
+	defer unsubscribe()
+	go forwardFrames(frames, conn)
+
+	// a player waits in the queue only once (e.g. if they queue again in another tab)
+	entries, err := cl.listQueue()
+	if err != nil {
+		logger.Error("could not list queue", "err", err)
+	}
+	for _, other := range entries {
+		if other.UserID == entry.UserID {
+			if removed, _ := cl.Store.RemoveQueueEntry(other.Ticket); removed {
+				publishFrame(cl.Bus, ticketChannel(other.Ticket), relayFrame{CloseCode: closeReplacedCode, CloseText: "replaced by a newer connection"})
+			}
+		}
+	}
+	bytes, err := json.Marshal(entry)
+	if err == nil {
+		err = cl.Store.AddQueueEntry(entry.Ticket, bytes)
+	}
+	if err != nil {
+		logger.Error("could not add to queue", "err", err)
+		conn.close(websocket.CloseTryAgainLater, "Could not join the queue.")
+		return
+	}
+	queued, err := encodeServerMessage(queuedMsg, 1, 0, QueuedPayload{len(entries) + 1})
+	if err == nil {
+		conn.queue(queued)
+	}
+
+	// let the matchmaker know we're still here
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(pingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				entry.LastSeen = time.Now().UnixNano()
+				if bytes, err := json.Marshal(entry); err == nil {
+					cl.Store.UpdateQueueEntry(entry.Ticket, bytes)
+				}
+			}
+		}
+	}()
+
+	// client sends nothing: it leaves the queue by closing the connection
+	cl.readMessages(wsConn, conn, entry.UserID, func([]byte) {}, nil)
+	cl.Store.RemoveQueueEntry(entry.Ticket)
+	conn.close(websocket.CloseNormalClosure, "")
+}
+
+func publishFrame(bus MessageBus, channel string, frame relayFrame) error {
+	bytes, err := json.Marshal(frame)
+	if err == nil {
+		err = bus.Publish(channel, bytes)
+	}
+	return err
+}
+
+func (cl *Cluster) runMatchmaker() {
+	ticker := time.NewTicker(matchmakingInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if cl.shuttingDown() {
+			return
+		}
+		owner, err := cl.Store.AcquireMatch(matchmakerLease, cl.ID, leaseTTL)
+		if err != nil {
+			logger.Error("could not acquire matchmaker lease", "err", err)
+			continue
+		}
+		if owner == cl.ID {
+			cl.matchmake()
+		}
+	}
+}
+
+// max rating gap the player will accept
+func ratingWindow(entry QueueEntry, now int64) float64 {
+	waited := time.Duration(now - entry.JoinTime).Seconds()
+	return baseRatingWindow + ratingWindowGrowth*waited
+}
+
+func canPair(a QueueEntry, b QueueEntry, now int64) bool {
+	if a.UserID == b.UserID || a.Ruleset != b.Ruleset || a.Rated != b.Rated || a.TimeControl != b.TimeControl {
+		return false
+	}
+	gap := math.Abs(a.Rating - b.Rating)
+	return gap <= math.Max(ratingWindow(a, now), ratingWindow(b, now))
+}
+
+// pair off waiting players, longest waiting first, each with the closest rated player they can be paired with
+func (cl *Cluster) matchmake() {
+	entries, err := cl.listQueue()
+	if err != nil {
+		logger.Error("could not list queue", "err", err)
+		return
+	}
+	now := time.Now().UnixNano()
+	waiting := []QueueEntry{}
+	for _, entry := range entries {
+		// instance holding the player's connection went away
+		if now-entry.LastSeen > int64(pongWait) {
+			cl.Store.RemoveQueueEntry(entry.Ticket)
+			continue
+		}
+		waiting = append(waiting, entry)
+	}
+	sort.Slice(waiting, func(i, j int) bool { return waiting[i].JoinTime < waiting[j].JoinTime })
+	paired := make(map[string]bool)
+	for i, a := range waiting {
+		if paired[a.Ticket] {
+			continue
+		}
+		best := -1
+		for j := i + 1; j < len(waiting); j++ {
+			b := waiting[j]
+			if paired[b.Ticket] || !canPair(a, b, now) {
+				continue
+			}
+			if best == -1 || math.Abs(a.Rating-b.Rating) < math.Abs(a.Rating-waiting[best].Rating) {
+				best = j
+			}
+		}
+		if best == -1 {
+			continue
+		}
+		b := waiting[best]
+		paired[a.Ticket] = true
+		paired[b.Ticket] = true
+		cl.startQueuedMatch(a, b)
+	}
+}
+
+func (cl *Cluster) startQueuedMatch(a QueueEntry, b QueueEntry) {
+	// either player may have left the queue since we listed it
+	if removed, err := cl.Store.RemoveQueueEntry(a.Ticket); err != nil || !removed {
+		return
+	}
+	if removed, err := cl.Store.RemoveQueueEntry(b.Ticket); err != nil || !removed {
+		if bytes, err := json.Marshal(a); err == nil {
+			cl.Store.AddQueueEntry(a.Ticket, bytes)
+		}
+		return
+	}
+	// toss for colors
+	if rand.Intn(2) == 0 {
+		a, b = b, a
+	}
+	match := newMatch(a.UserName)
+	match.WhitePlayerID = a.UserID
+	match.BlackPlayerID = b.UserID
+	match.Rated = a.Rated
+	if a.Ruleset == shortRuleset {
+		match.MaxRounds = shortRulesetRounds
+	}
+	match.TimeBank, match.TimeIncrement, _ = parseTimeControl(a.TimeControl)
+	if err := cl.startMatch(match); err != nil {
+		logger.Error("could not start matched players' match", "err", err)
+		for _, ticket := range []string{a.Ticket, b.Ticket} {
+			publishFrame(cl.Bus, ticketChannel(ticket), relayFrame{CloseCode: websocket.CloseTryAgainLater, CloseText: "Could not create match."})
+		}
+		return
+	}
+	match.logger().Info("matched players", "white", a.UserName, "black", b.UserName)
+	for _, seat := range []struct {
+		ticket string
+		color  string
+	}{{a.Ticket, white}, {b.Ticket, black}} {
+		msg, err := encodeServerMessage(matchedMsg, 2, 0, MatchedPayload{match.Name, seat.color})
+		if err != nil {
+			logger.Error("could not JSON encode matched message", "err", err)
+			continue
+		}
+		publishFrame(cl.Bus, ticketChannel(seat.ticket), relayFrame{Data: msg})
+		publishFrame(cl.Bus, ticketChannel(seat.ticket), relayFrame{CloseCode: websocket.CloseNormalClosure, CloseText: "matched"})
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics
+//
+// /metrics serves this instance's metrics in the Prometheus text format. If METRICS_TOKEN is set,
+// scrapes must send it as a bearer token. Labels are only ever given values from fixed sets (card names,
+// event types, error codes), never anything a client makes up, so the number of series stays bounded.
+
+// counter, or counters split by labels
+type Counter struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64 // joined label values -> count
+}
+
+// histogram, or histograms split by labels
+type Histogram struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64 // upper bounds, ascending (+Inf is implied)
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // per bucket (not cumulative)
+	sum    float64
+	count  uint64
+}
+
+// value read when scraped
+type Gauge struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+// (registered in the order they are written)
+var metrics []interface{}
+
+func newCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	metrics = append(metrics, c)
+	return c
+}
+
+func newHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+	metrics = append(metrics, h)
+	return h
+}
+
+func newGauge(name string, help string, value func() float64) *Gauge {
+	g := &Gauge{name, help, value}
+	metrics = append(metrics, g)
+	return g
+}
+
+// (label values, in the order of the labels)
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(n float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.Lock()
+	c.values[key] += n
+	c.Unlock()
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.Lock()
+	defer h.Unlock()
+	s := h.series[key]
+	if s == nil {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	i := sort.SearchFloat64s(h.buckets, v) // first bucket with upper bound >= v
+	if i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+// e.g. {event="pass",code="not_your_turn"} ("" if no labels)
+func labelSet(names []string, key string, extra ...string) string {
+	pairs := []string{}
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			if i < len(names) {
+				pairs = append(pairs, names[i]+"="+strconv.Quote(value))
+			}
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch m := m.(type) {
+	case map[string]float64:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]*histogramSeries:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (c *Counter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.Lock()
+	defer c.Unlock()
+	if len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.values[""]))
+		return
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelSet(c.labels, key), formatFloat(c.values[key]))
+	}
+}
+
+func (h *Histogram) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.Lock()
+	defer h.Unlock()
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelSet(h.labels, key, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelSet(h.labels, key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelSet(h.labels, key), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelSet(h.labels, key), s.count)
+	}
+}
+
+func (g *Gauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.value()))
+}
+
+func writeMetrics(w io.Writer) {
+	buffered := bufio.NewWriter(w)
+	for _, metric := range metrics {
+		switch metric := metric.(type) {
+		case *Counter:
+			metric.write(buffered)
+		case *Histogram:
+			metric.write(buffered)
+		case *Gauge:
+			metric.write(buffered)
+		}
+	}
+	buffered.Flush()
+}
+
+var (
+	messagesReceived = newCounter("chrss_messages_received_total",
+		"Messages received from clients (including those dropped by flood protection).")
+	messagesDropped = newCounter("chrss_messages_dropped_total",
+		"Messages dropped by flood protection.")
+	messagesSent = newCounter("chrss_messages_sent_total",
+		"Messages queued for clients.")
+	eventErrors = newCounter("chrss_event_errors_total",
+		"Client events rejected, by event type and error code.", "event", "code")
+	cardsPlayed = newCounter("chrss_cards_played_total",
+		"Cards played, by card.", "card")
+	matchesEnded = newCounter("chrss_matches_ended_total",
+		"Matches ended, by reason.", "reason")
+	aiThinkTime = newHistogram("chrss_ai_think_seconds",
+		"Time the AI takes to play a turn, by AI level.",
+		[]float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}, "level")
+	roundDuration = newHistogram("chrss_round_duration_seconds",
+		"Time from the start of a round to the start of the next.",
+		[]float64{15, 30, 60, 120, 180, 300, 600, 1200})
+)
+
+// gauges which read the cluster
+func (cl *Cluster) registerGauges() {
+	newGauge("chrss_live_matches", "Matches run by this instance.", func() float64 {
+		cl.Matches.RLock()
+		defer cl.Matches.RUnlock()
+		return float64(len(cl.Matches.internal))
+	})
+	newGauge("chrss_connected_sockets", "Websockets open to this instance.", func() float64 {
+		return float64(openSocketCount())
+	})
+}
+
+// (event types clients may send, so a made up type can't add a series)
+var knownEvents = map[string]bool{
+	"get_state": true, "ready": true, "click_card": true, "click_board": true, "pass": true,
+	"resign": true, "offer_draw": true, "accept_draw": true, "decline_draw": true, "rematch": true,
+	"decline_rematch": true, "chat": true, "mute": true, "time_expired": true,
+	"play_card": true, "decline_challenge": true,
+}
+
+func countEventError(event string, err error) {
+	if !knownEvents[event] {
+		event = "unknown"
+	}
+	code := invalidActionError
+	if protoErr, ok := err.(*ProtocolError); ok {
+		code = protoErr.Code
+	}
+	eventErrors.Inc(event, code)
+}
+
+func observeAITurn(level string, start time.Time) {
+	aiThinkTime.Observe(time.Since(start).Seconds(), level)
+}
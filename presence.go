@@ -0,0 +1,194 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// how a match handles a player who stays disconnected past the grace period
+const (
+	forfeitOnDisconnect    = "forfeit"
+	aiTakeoverOnDisconnect = "ai"
+)
+
+// connected, disconnected, or ai
+func (m *Match) presence(color string) string {
+	conn, isAI := m.WhiteConn, m.WhiteAI
+	if color == black {
+		conn, isAI = m.BlackConn, m.BlackAI
+	}
+	if conn != nil {
+		return "connected"
+	}
+	if isAI {
+		return "ai"
+	}
+	return "disconnected"
+}
+
+// returns pointers to the player's disconnect time and AI takeover flag
+func (m *Match) disconnectState(color string) (*int64, *bool) {
+	if color == black {
+		return &m.BlackDisconnectTime, &m.BlackAITakeover
+	}
+	return &m.WhiteDisconnectTime, &m.WhiteAITakeover
+}
+
+// assumes match mutex is held
+func (m *Match) playerConnected(color string) {
+	disconnectTime, takeover := m.disconnectState(color)
+	*disconnectTime = 0
+	if *takeover {
+		*takeover = false
+		if color == black {
+			m.BlackAI = false
+		} else {
+			m.WhiteAI = false
+		}
+		m.Log = append(m.Log, color+" returned and took back control from the AI")
+	}
+}
+
+// assumes match mutex is held
+func (m *Match) playerDisconnected(color string) {
+	disconnectTime, _ := m.disconnectState(color)
+	*disconnectTime = time.Now().UnixNano()
+}
+
+// forfeit or hand to the AI any seat whose player has been gone longer than the grace period
+// returns true if state changed
+// assumes match mutex is held
+func (m *Match) checkDisconnects() bool {
+	if m.Phase != kingPlacementPhase && m.Phase != mainPhase {
+		return false
+	}
+	now := time.Now().UnixNano()
+	expired := func(color string) bool {
+		disconnectTime, takeover := m.disconnectState(color)
+		return *disconnectTime != 0 && !*takeover && now-*disconnectTime > m.DisconnectGrace
+	}
+	whiteGone, blackGone := expired(white), expired(black)
+	if whiteGone && blackGone {
+		m.endMatch(none, abandonmentReason)
+		return true
+	}
+	changed := false
+	for _, color := range []string{white, black} {
+		if !expired(color) {
+			continue
+		}
+		otherAI, otherTakeover := m.WhiteAI, m.WhiteAITakeover
+		if color == white {
+			otherAI, otherTakeover = m.BlackAI, m.BlackAITakeover
+		}
+		switch {
+		case m.DisconnectPolicy != aiTakeoverOnDisconnect || (otherAI && !otherTakeover):
+			// (against the AI, the seat isn't handed to the AI to play out the match against itself)
+			m.Log = append(m.Log, color+" disconnected and forfeits")
+			m.endMatch(otherColor(color), abandonmentReason)
+			return true
+		case otherTakeover:
+			// the AI already plays for the other player, who is gone too
+			m.Log = append(m.Log, color+" disconnected")
+			m.endMatch(none, abandonmentReason)
+			return true
+		}
+		m.aiTakeover(color)
+		changed = true
+	}
+	return changed
+}
+
+// switch seat to AI until the player reconnects
+// (the other seat must not be AI)
+func (m *Match) aiTakeover(color string) {
+	_, takeover := m.disconnectState(color)
+	*takeover = true
+	if color == black {
+		m.BlackAI = true
+	} else {
+		m.WhiteAI = true
+	}
+	m.Log = append(m.Log, color+" disconnected; AI takes over")
+	public, private := m.states(color)
+	switch m.Phase {
+	case kingPlacementPhase:
+		if !public.KingPlayed {
+			pos := kingPlacementAI(color, &m.Board)
+			private.KingPos = &pos
+			public.KingPlayed = true
+			m.Log = append(m.Log, color+" played King")
+			highlightsOff(private.Highlights[:])
+			m.EndKingPlacement()
+		}
+	case mainPhase:
+		if m.Turn == color {
+			playTurnAI(color, m)
+		}
+	}
+}
+
+// claim seat for the user if no one has it
+// (in a private or password protected match, only with a grant from the join page)
+// returns error if another user has it or the user may not take it
+// assumes match mutex is held
+func (m *Match) claimSeat(color string, userID string, grant string) error {
+	playerID := &m.WhitePlayerID
+	if color == black {
+		playerID = &m.BlackPlayerID
+	}
+	if *playerID == "" {
+		if m.restricted() && !validSeatGrant(m.InviteToken, color, userID, grant) {
+			return errInviteRequired
+		}
+		*playerID = userID
+	}
+	if *playerID != userID {
+		return errSeatTaken
+	}
+	return nil
+}
+
+// make conn the player's connection, replacing any previous one
+// lastSeq is seq of last message seen by a reconnecting client (-1 for new client)
+// assumes match mutex is held
+func (m *Match) attachPlayer(color string, conn *Client, lastSeq int64) {
+	// if client is valid, we kill previous websocket to start new one
+	if color == black {
+		if m.BlackConn != nil {
+			closeReplaced(m.BlackConn)
+		}
+		m.BlackConn = conn
+	} else {
+		if m.WhiteConn != nil {
+			closeReplaced(m.WhiteConn)
+		}
+		m.WhiteConn = conn
+	}
+	m.playerConnected(color)
+	m.playerLogger(color).Info("player connected", "conn", conn.Label)
+	if !m.resume(color, lastSeq) {
+		m.sendSnapshot(color)
+	}
+	m.sendState(otherColor(color), false, false) // show opponent we're present
+	m.sendSpectators(false, false)
+}
+
+// assumes match mutex is held
+func (m *Match) detachPlayer(color string, conn *Client) {
+	conn.close(websocket.CloseNormalClosure, "")
+	// a subsequent request may have replaced this conn, so we check
+	if color == black && m.BlackConn == conn {
+		m.BlackConn = nil
+		m.playerDisconnected(color)
+		m.sendState(white, false, false)
+		m.sendSpectators(false, false)
+	} else if color == white && m.WhiteConn == conn {
+		m.WhiteConn = nil
+		m.playerDisconnected(color)
+		m.sendState(black, false, false)
+		m.sendSpectators(false, false)
+	}
+	m.playerLogger(color).Info("closed player connection", "conn", conn.Label)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// Websocket protocol
+//
+// Every message in either direction is a JSON envelope:
+//
+//	{"v": 1, "type": "<type>", "seq": <n>, "payload": <type-specific>}
+//
+// Client messages (seq is chosen by client; replies carry it back as replyTo):
+//
+//	get_state          no payload; server replies with ack then snapshot (used to resync after a gap)
+//	ready              no payload (readyUp phase)
+//	click_card         ClickCardPayload (main phase, player's turn)
+//	click_board        Pos (kingPlacement phase, or main phase with a card selected)
+//	play_card          PlayCardPayload (main phase, player's turn); selects the card and plays it at pos
+//	pass               no payload (main phase, player's turn)
+//	resign             no payload
+//	offer_draw         no payload
+//	accept_draw        no payload (only when opponent has offered)
+//	decline_draw       no payload (only when opponent has offered)
+//	rematch            no payload (gameover phase); asks for a rematch, or accepts the opponent's request
+//	decline_rematch    no payload (only when opponent has asked)
+//	decline_challenge  no payload (readyUp phase, only by the user challenged to the match; see bots.go)
+//	chat               ChatPayload (text, or emote code); players and spectators have separate chats
+//	mute               MutePayload (hides opponent's chat while muted)
+//	time_expired       no payload (optional; the server clock also detects expiry)
+//
+// Spectators can send only get_state and chat.
+//
+// (keep alive is done with websocket ping and pong frames, not messages)
+//
+// Server messages (seq numbers every message sent to a player seat, or to spectators, across
+// reconnections; a client reconnecting with ?lastSeq=<n> is first sent the messages after n,
+// or a snapshot if those are no longer kept):
+//
+//	ack       no payload; replyTo is seq of the accepted client message
+//	error     ProtocolError; replyTo is seq of the rejected client message (0 if unparseable)
+//	snapshot  SnapshotPayload: the full match state as seen by the recipient (sent on connect and on get_state)
+//	diff      DiffPayload: changes since the previous snapshot or diff; if its baseSeq is not the
+//	          seq of the last state message the client applied, the client should send get_state
+//	notice    NoticePayload: a message from the administrators (e.g. of upcoming maintenance)
+//	spectator_chat
+//	          SpectatorChatPayload: the whole spectator chat, to spectators only (sent without the
+//	          spectator delay when a spectator connects and whenever the chat changes)
+//	closed    ClosedPayload: on an HTTP stream instead of a websocket close frame (see bots.go)
+//
+// Matchmaking queue connection (/ws-queue?ruleset=<standard|short>&rated=<true|false>&timeControl=<none|minutes+seconds>):
+// the client sends nothing, and leaves the queue by closing the connection. The server sends:
+//
+//	queued   QueuedPayload (on joining the queue)
+//	matched  MatchedPayload; the server then closes the connection and the client should go to
+//	         /match/<match>/<color>
+const protocolVersion = 1
+
+// server message types
+const (
+	ackMsg           = "ack"
+	errorMsg         = "error"
+	snapshotMsg      = "snapshot"
+	diffMsg          = "diff"
+	queuedMsg        = "queued"
+	matchedMsg       = "matched"
+	noticeMsg        = "notice"
+	spectatorChatMsg = "spectator_chat"
+	closedMsg        = "closed" // last message of an HTTP stream (see bots.go)
+)
+
+// error codes
+const (
+	badMessageError         = "bad_message"
+	unsupportedVersionError = "unsupported_version"
+	unknownTypeError        = "unknown_type"
+	badPayloadError         = "bad_payload"
+	gameOverError           = "game_over"
+	notYourTurnError        = "not_your_turn"
+	invalidActionError      = "invalid_action" // action not allowed in current phase or state
+	illegalMoveError        = "illegal_move"   // card or square choice breaks the rules
+	rateLimitedError        = "rate_limited"
+	serverError             = "server_error" // the match was aborted by a crash (see crash.go)
+)
+
+type ClientMessage struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	Seq     int64           `json:"seq"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type ServerMessage struct {
+	V       int         `json:"v"`
+	Type    string      `json:"type"`
+	Seq     int64       `json:"seq"`
+	ReplyTo int64       `json:"replyTo,omitempty"` // seq of the client message this responds to
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+type ClickCardPayload struct {
+	SelectedCard int `json:"selectedCard"` // index into player's cards
+}
+
+type PlayCardPayload struct {
+	Card int `json:"card"` // index into player's cards
+	Pos  Pos `json:"pos"`
+}
+
+type QueuedPayload struct {
+	Waiting int `json:"waiting"` // players in the queue, including the recipient
+}
+
+type MatchedPayload struct {
+	Match string `json:"match"`
+	Color string `json:"color"`
+}
+
+type ProtocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func protocolError(code string, message string) error {
+	return &ProtocolError{code, message}
+}
+
+// decode payload into v; missing payload is an error
+func decodePayload(payload json.RawMessage, v interface{}) error {
+	if len(payload) == 0 {
+		return protocolError(badPayloadError, "missing payload")
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return protocolError(badPayloadError, err.Error())
+	}
+	return nil
+}
+
+func encodeServerMessage(msgType string, seq int64, replyTo int64, payload interface{}) ([]byte, error) {
+	return json.Marshal(ServerMessage{protocolVersion, msgType, seq, replyTo, payload})
+}
+
+// send message to player
+// (if player is not connected, message is kept for replay when they reconnect)
+// assumes match mutex is held
+func (m *Match) sendMessage(color string, msgType string, replyTo int64, payload interface{}) {
+	conn, box := m.WhiteConn, &m.whiteOutbox
+	if color == black {
+		conn, box = m.BlackConn, &m.blackOutbox
+	}
+	bytes, err := box.add(msgType, replyTo, payload)
+	if err != nil {
+		logger.Error("could not JSON encode message", "type", msgType, "err", err)
+		return
+	}
+	if conn != nil {
+		conn.queue(bytes)
+	}
+}
+
+// assumes match mutex is held
+func (m *Match) sendError(color string, replyTo int64, err error) {
+	protoErr, ok := err.(*ProtocolError)
+	if !ok {
+		protoErr = &ProtocolError{invalidActionError, err.Error()}
+	}
+	m.sendMessage(color, errorMsg, replyTo, protoErr)
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Ratings
+//
+// Players have a separate Glicko-2 rating in each pool (ruleset and time control). A rating is a
+// (Rating, Deviation) estimate: a new player starts at defaultRating with a large deviation which shrinks
+// as they play. Until the deviation falls below provisionalDeviation, the rating is provisional: it is
+// shown with a "?" and left off the leaderboard. Each rated game is its own rating period.
+// Results against the AI count, with the AI at a fixed rating for its level (the AI's own rating is never updated).
+
+const (
+	glickoScale          = 173.7178 // converts between Glicko and Glicko-2 scales
+	glickoTau            = 0.5      // constrains change in volatility
+	glickoEpsilon        = 0.000001 // convergence tolerance for the volatility iteration
+	defaultDeviation     = 350.0
+	minDeviation         = 30.0 // keeps ratings of even the most active players able to move
+	defaultVolatility    = 0.06
+	provisionalDeviation = 110.0
+	aiDeviation          = 50.0
+	maxRatingChanges     = 100 // history kept per user
+	leaderboardSize      = 100
+)
+
+var aiRatings = map[string]float64{
+	easyAI:   900,
+	normalAI: 1200,
+}
+
+// a user's rating in one pool
+type Rating struct {
+	UserID     string
+	UserName   string
+	Pool       string
+	Rating     float64
+	Deviation  float64
+	Volatility float64
+	Games      int
+	Wins       int
+	Losses     int
+	Draws      int
+}
+
+// a rated game's effect on a player's rating
+type RatingChange struct {
+	Match          string
+	Pool           string
+	Opponent       string // name ("AI" for the AI)
+	OpponentRating float64
+	Result         string // win, loss, or draw
+	Before         float64
+	After          float64
+	Time           int64 // unix nano
+}
+
+// results
+const (
+	win  = "win"
+	loss = "loss"
+)
+
+func newRating(userID string, userName string, pool string) *Rating {
+	return &Rating{
+		UserID:     userID,
+		UserName:   userName,
+		Pool:       pool,
+		Rating:     defaultRating,
+		Deviation:  defaultDeviation,
+		Volatility: defaultVolatility,
+	}
+}
+
+func (r *Rating) Provisional() bool {
+	return r.Deviation >= provisionalDeviation
+}
+
+// rating for display, e.g. "1523" or "1500?"
+func (r *Rating) Display() string {
+	s := strconv.Itoa(int(math.Round(r.Rating)))
+	if r.Provisional() {
+		s += "?"
+	}
+	return s
+}
+
+// pool of a match with the given settings, e.g. "standard 10+5" or "short none"
+// (a rated match's time bank is whole minutes)
+func ratingPool(maxRounds int, timeBank int64, timeIncrement int64) string {
+	ruleset := standardRuleset
+	if maxRounds == shortRulesetRounds {
+		ruleset = shortRuleset
+	} else if maxRounds > 0 {
+		ruleset = strconv.Itoa(maxRounds) + " rounds"
+	}
+	timeControl := "none"
+	if timeBank > 0 {
+		timeControl = strconv.FormatInt(timeBank/int64(time.Minute), 10) + "+" +
+			strconv.FormatInt(timeIncrement/int64(time.Second), 10)
+	}
+	return ruleset + " " + timeControl
+}
+
+func (m *Match) ratingPool() string {
+	return ratingPool(m.MaxRounds, m.TimeBank, m.TimeIncrement)
+}
+
+// Glicko-2 update of the rating after one game against an opponent with the given rating and deviation
+// score is 1 for a win, 0.5 for a draw, and 0 for a loss
+func (r *Rating) update(opponentRating float64, opponentDeviation float64, score float64) {
+	r.ratePeriod([]glickoGame{{opponentRating, opponentDeviation, score}})
+	r.Games++
+	switch score {
+	case 1:
+		r.Wins++
+	case 0:
+		r.Losses++
+	default:
+		r.Draws++
+	}
+}
+
+// a game of a rating period: the opponent's rating and deviation, and the score
+type glickoGame struct {
+	rating    float64
+	deviation float64
+	score     float64
+}
+
+// Glicko-2 update of the rating, deviation, and volatility after a rating period's games
+// (steps 2 to 8 of Glickman's "Example of the Glicko-2 system")
+func (r *Rating) ratePeriod(games []glickoGame) {
+	mu := (r.Rating - defaultRating) / glickoScale
+	phi := r.Deviation / glickoScale
+
+	var vInverse, improvement float64 // (improvement is the sum of g*(score-expected))
+	for _, game := range games {
+		muJ := (game.rating - defaultRating) / glickoScale
+		phiJ := game.deviation / glickoScale
+		g := 1 / math.Sqrt(1+3*phiJ*phiJ/(math.Pi*math.Pi))
+		expected := 1 / (1 + math.Exp(-g*(mu-muJ)))
+		vInverse += g * g * expected * (1 - expected)
+		improvement += g * (game.score - expected)
+	}
+	v := 1 / vInverse
+	delta := v * improvement
+
+	// new volatility (by the Illinois algorithm, as in Glickman's paper)
+	a := math.Log(r.Volatility * r.Volatility)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		d := phi*phi + v + ex
+		return ex*(delta*delta-phi*phi-v-ex)/(2*d*d) - (x-a)/(glickoTau*glickoTau)
+	}
+	A := a
+	var B float64
+	if delta*delta > phi*phi+v {
+		B = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*glickoTau) < 0 {
+			k++
+		}
+		B = a - k*glickoTau
+	}
+	fA, fB := f(A), f(B)
+	for math.Abs(B-A) > glickoEpsilon {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB <= 0 {
+			A, fA = B, fB
+		} else {
+			fA /= 2
+		}
+		B, fB = C, fC
+	}
+	volatility := math.Exp(A / 2)
+
+	phiStar := math.Sqrt(phi*phi + volatility*volatility)
+	newPhi := 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+	newMu := mu + newPhi*newPhi*improvement
+
+	r.Rating = newMu*glickoScale + defaultRating
+	r.Deviation = math.Max(minDeviation, math.Min(defaultDeviation, newPhi*glickoScale))
+	r.Volatility = volatility
+}
+
+// user's rating in the pool (a new rating if they have none)
+func (cl *Cluster) loadRating(pool string, userID string) (*Rating, error) {
+	bytes, err := cl.Store.LoadRating(pool, userID)
+	if err != nil {
+		return nil, err
+	}
+	if bytes == nil {
+		user, err := cl.loadUser(userID)
+		if err != nil {
+			return nil, err
+		}
+		name := ""
+		if user != nil {
+			name = user.Name
+		}
+		return newRating(userID, name, pool), nil
+	}
+	rating := &Rating{}
+	if err := json.Unmarshal(bytes, rating); err != nil {
+		return nil, err
+	}
+	return rating, nil
+}
+
+func (cl *Cluster) saveRating(rating *Rating) error {
+	bytes, err := json.Marshal(rating)
+	if err != nil {
+		return err
+	}
+	return cl.Store.SaveRating(rating.Pool, rating.UserID, bytes)
+}
+
+func (cl *Cluster) listRatings(pool string) ([]*Rating, error) {
+	list, err := cl.Store.ListRatings(pool)
+	if err != nil {
+		return nil, err
+	}
+	ratings := make([]*Rating, 0, len(list))
+	for _, bytes := range list {
+		rating := &Rating{}
+		if err := json.Unmarshal(bytes, rating); err != nil {
+			logger.Error("could not JSON decode rating", "err", err)
+			continue
+		}
+		ratings = append(ratings, rating)
+	}
+	return ratings, nil
+}
+
+// most recent first
+func (cl *Cluster) listRatingChanges(userID string) ([]RatingChange, error) {
+	list, err := cl.Store.ListRatingChanges(userID)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]RatingChange, 0, len(list))
+	for i := len(list) - 1; i >= 0; i-- {
+		var change RatingChange
+		if err := json.Unmarshal(list[i], &change); err != nil {
+			logger.Error("could not JSON decode rating change", "err", err)
+			continue
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// update the players' ratings with the result of a finished match
+// (should be called only once per match: see matchOver)
+func (cl *Cluster) recordResult(m *Match) {
+	m.Mutex.RLock()
+	name := m.Name
+	rated := m.Rated
+	winner := m.Winner
+	pool := m.ratingPool()
+	whiteID, blackID := m.WhitePlayerID, m.BlackPlayerID
+	whiteAI := m.WhiteAI && !m.WhiteAITakeover
+	blackAI := m.BlackAI && !m.BlackAITakeover
+	aiLevel := m.aiLevel(white)
+	if blackAI {
+		aiLevel = m.aiLevel(black)
+	}
+	m.Mutex.RUnlock()
+
+	if !rated || (winner != white && winner != black && winner != draw) {
+		return
+	}
+	// a player can't gain rating by playing themself
+	if !whiteAI && !blackAI && whiteID == blackID {
+		return
+	}
+	if whiteAI && blackAI {
+		return
+	}
+
+	type player struct {
+		ai     bool
+		rating *Rating
+	}
+	players := map[string]*player{white: {ai: whiteAI}, black: {ai: blackAI}}
+	for color, id := range map[string]string{white: whiteID, black: blackID} {
+		p := players[color]
+		if p.ai {
+			p.rating = &Rating{UserName: aiName(aiLevel), Rating: aiRatings[aiLevel], Deviation: aiDeviation}
+			continue
+		}
+		var err error
+		if p.rating, err = cl.loadRating(pool, id); err != nil {
+			logger.Error("could not load rating", "user", id, "err", err)
+			return
+		}
+	}
+
+	now := time.Now().UnixNano()
+	for _, color := range []string{white, black} {
+		p, opponent := players[color], players[otherColor(color)]
+		if p.ai {
+			continue
+		}
+		score, result := 0.5, draw
+		if winner == color {
+			score, result = 1, win
+		} else if winner == otherColor(color) {
+			score, result = 0, loss
+		}
+		// both players are updated from the ratings they had before the game
+		before := p.rating.Rating
+		updated := *p.rating
+		updated.update(opponent.rating.Rating, opponent.rating.Deviation, score)
+		if err := cl.saveRating(&updated); err != nil {
+			logger.Error("could not save rating", "user", updated.UserID, "err", err)
+			continue
+		}
+		bytes, err := json.Marshal(RatingChange{
+			Match:          name,
+			Pool:           pool,
+			Opponent:       opponent.rating.UserName,
+			OpponentRating: opponent.rating.Rating,
+			Result:         result,
+			Before:         before,
+			After:          updated.Rating,
+			Time:           now,
+		})
+		if err == nil {
+			err = cl.Store.AddRatingChange(updated.UserID, bytes)
+		}
+		if err != nil {
+			logger.Error("could not save rating change", "user", updated.UserID, "err", err)
+		}
+	}
+	logger.Info("recorded result of rated match", "match", name, "winner", winner)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func near(got float64, want float64, tolerance float64) bool {
+	return math.Abs(got-want) <= tolerance
+}
+
+// the worked example of Glickman's "Example of the Glicko-2 system"
+func TestRatePeriodGlickmanExample(t *testing.T) {
+	r := &Rating{Rating: 1500, Deviation: 200, Volatility: 0.06}
+	r.ratePeriod([]glickoGame{
+		{1400, 30, 1},
+		{1550, 100, 0},
+		{1700, 300, 0},
+	})
+	if !near(r.Rating, 1464.06, 0.01) || !near(r.Deviation, 151.52, 0.01) || !near(r.Volatility, 0.05999, 0.00001) {
+		t.Fatalf("rating %.2f, deviation %.2f, volatility %.5f; want 1464.06, 151.52, 0.05999",
+			r.Rating, r.Deviation, r.Volatility)
+	}
+}
+
+func TestRatingUpdate(t *testing.T) {
+	tests := []struct {
+		name   string
+		before Rating
+		game   glickoGame
+		check  func(t *testing.T, before Rating, after Rating)
+	}{
+		{"new player wins against new player",
+			Rating{Rating: defaultRating, Deviation: defaultDeviation, Volatility: defaultVolatility},
+			glickoGame{defaultRating, defaultDeviation, 1},
+			func(t *testing.T, before Rating, after Rating) {
+				// (the opponent's loss is the mirror image)
+				loser := before
+				loser.update(defaultRating, defaultDeviation, 0)
+				if after.Rating <= before.Rating || !near(after.Rating-before.Rating, before.Rating-loser.Rating, 1e-9) {
+					t.Fatalf("winner %.2f, loser %.2f from %.2f; want equal and opposite changes",
+						after.Rating, loser.Rating, before.Rating)
+				}
+				if after.Deviation >= before.Deviation {
+					t.Fatalf("deviation %.2f, want less than %.2f", after.Deviation, before.Deviation)
+				}
+				if after.Games != 1 || after.Wins != 1 || loser.Losses != 1 {
+					t.Fatalf("counts %+v and %+v", after, loser)
+				}
+			}},
+		{"draw between equals",
+			Rating{Rating: 1700, Deviation: 80, Volatility: defaultVolatility},
+			glickoGame{1700, 80, 0.5},
+			func(t *testing.T, before Rating, after Rating) {
+				if !near(after.Rating, before.Rating, 1e-9) || after.Draws != 1 {
+					t.Fatalf("rating %.4f, draws %d; want unchanged rating and one draw", after.Rating, after.Draws)
+				}
+			}},
+		{"upset of a much stronger opponent",
+			// (the improvement is large enough that the volatility iteration starts from its first bracket)
+			Rating{Rating: 1500, Deviation: 50, Volatility: defaultVolatility},
+			glickoGame{2200, 50, 1},
+			func(t *testing.T, before Rating, after Rating) {
+				if after.Volatility <= before.Volatility {
+					t.Fatalf("volatility %.5f, want more than %.5f", after.Volatility, before.Volatility)
+				}
+				if after.Rating <= before.Rating+10 {
+					t.Fatalf("rating %.2f, want well above %.2f", after.Rating, before.Rating)
+				}
+			}},
+		{"expected win of a settled player",
+			Rating{Rating: 1500, Deviation: 50, Volatility: defaultVolatility},
+			glickoGame{900, 50, 1},
+			func(t *testing.T, before Rating, after Rating) {
+				if after.Rating <= before.Rating || after.Rating > before.Rating+1 {
+					t.Fatalf("rating %.2f, want slightly above %.2f", after.Rating, before.Rating)
+				}
+			}},
+		{"deviation floor",
+			Rating{Rating: 1500, Deviation: minDeviation, Volatility: 0.01},
+			glickoGame{1500, minDeviation, 0.5},
+			func(t *testing.T, before Rating, after Rating) {
+				if after.Deviation != minDeviation {
+					t.Fatalf("deviation %.2f, want %.2f", after.Deviation, minDeviation)
+				}
+			}},
+		{"deviation ceiling",
+			Rating{Rating: 1500, Deviation: defaultDeviation, Volatility: 0.5},
+			glickoGame{1500, defaultDeviation, 0},
+			func(t *testing.T, before Rating, after Rating) {
+				if after.Deviation > defaultDeviation {
+					t.Fatalf("deviation %.2f, want at most %.2f", after.Deviation, defaultDeviation)
+				}
+			}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			after := test.before
+			after.update(test.game.rating, test.game.deviation, test.game.score)
+			test.check(t, test.before, after)
+		})
+	}
+}
+
+// a game against the AI is rated against the AI's fixed rating for its level, and only the player's rating changes
+func TestRecordResultAgainstAI(t *testing.T) {
+	tests := []struct {
+		level  string
+		winner string
+		score  float64
+	}{
+		{easyAI, white, 1},
+		{easyAI, black, 0},
+		{normalAI, white, 1},
+		{normalAI, draw, 0.5},
+	}
+	for _, test := range tests {
+		t.Run(test.level+" "+test.winner, func(t *testing.T) {
+			cl := &Cluster{Store: newMemoryStore()}
+			m := &Match{Name: "match", Rated: true, Winner: test.winner, WhitePlayerID: "u1", BlackAI: true, AILevel: test.level}
+			cl.recordResult(m)
+
+			pool := m.ratingPool()
+			want := newRating("u1", "", pool)
+			want.update(aiRatings[test.level], aiDeviation, test.score)
+			got, err := cl.loadRating(pool, "u1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != *want {
+				t.Fatalf("rating %+v, want %+v", *got, *want)
+			}
+			ratings, err := cl.Store.ListRatings(pool)
+			if err != nil || len(ratings) != 1 {
+				t.Fatalf("%d ratings in the pool (%v), want only the player's", len(ratings), err)
+			}
+			changes, err := cl.Store.ListRatingChanges("u1")
+			if err != nil || len(changes) != 1 {
+				t.Fatalf("%d rating changes (%v), want 1", len(changes), err)
+			}
+			var change RatingChange
+			if err := json.Unmarshal(changes[0], &change); err != nil {
+				t.Fatal(err)
+			}
+			if change.OpponentRating != aiRatings[test.level] || change.Before != defaultRating || change.After != want.Rating {
+				t.Fatalf("change %+v", change)
+			}
+		})
+	}
+}
+
+func TestRatedTimeBank(t *testing.T) {
+	tests := []struct {
+		timeBank string
+		rated    bool
+		ok       bool
+	}{
+		{"600", true, true},
+		{"90", true, false},
+		{"30", true, false},
+		{"90", false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.timeBank+" "+strconv.FormatBool(test.rated), func(t *testing.T) {
+			cl := &Cluster{Store: newMemoryStore(), Matches: NewMatchMap()}
+			settings := map[string]string{"timeBank": test.timeBank, "rated": strconv.FormatBool(test.rated)}
+			param := func(key string) string { return settings[key] }
+			_, _, err := cl.createMatch(&User{ID: "u1", Name: "u1"}, param, "")
+			if _, invalid := err.(*settingError); invalid == test.ok || (test.ok && err != nil) {
+				t.Fatalf("got %v, want ok %v", err, test.ok)
+			}
+		})
+	}
+}
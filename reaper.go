@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// Reaper
+//
+// Every reapInterval, each instance evicts the matches it owns which are
+//   - finished: over for longer than the finished retention (time to see the result and ask for a rematch)
+//   - abandoned: with no one connected (not even spectators) for longer than the abandoned retention
+//   - idle: without a move for longer than the idle timeout
+// Abandoned and idle matches are first ended. A match is archived to history (see matchOver) before it
+// is evicted, and its remaining connections are closed with closeMatchEndedCode. Matches left in the
+// store by instances which went away are taken over, so they are archived and evicted the same way.
+//
+// Retentions are set with FINISHED_RETENTION, ABANDONED_RETENTION, and IDLE_TIMEOUT (durations, e.g. "10m").
+
+const (
+	reapInterval              = 30 * time.Second
+	defaultFinishedRetention  = 10 * time.Minute
+	defaultAbandonedRetention = 10 * time.Minute
+	defaultIdleTimeout        = time.Duration(matchTimeout)
+)
+
+type ReaperConfig struct {
+	FinishedRetention  time.Duration
+	AbandonedRetention time.Duration
+	IdleTimeout        time.Duration
+}
+
+func loadReaperConfig() ReaperConfig {
+	config := ReaperConfig{defaultFinishedRetention, defaultAbandonedRetention, defaultIdleTimeout}
+	for env, d := range map[string]*time.Duration{
+		"FINISHED_RETENTION":  &config.FinishedRetention,
+		"ABANDONED_RETENTION": &config.AbandonedRetention,
+		"IDLE_TIMEOUT":        &config.IdleTimeout,
+	} {
+		s := os.Getenv(env)
+		if s == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(s)
+		if err != nil || parsed <= 0 {
+			logger.Warn("invalid retention: using default", "env", env, "value", s, "default", *d)
+			continue
+		}
+		*d = parsed
+	}
+	return config
+}
+
+// why a match should be reaped ("" if it should not)
+// assumes match mutex is held
+func (m *Match) reapReason(config ReaperConfig, now int64) string {
+	if m.Phase == gameoverPhase {
+		endTime := m.EndTime
+		if endTime == 0 {
+			endTime = m.LastMoveTime
+		}
+		// (delayed spectators have yet to see the end)
+		if now > endTime+int64(config.FinishedRetention) && len(m.spectatorBacklog) == 0 && !m.rematchStarting {
+			return "finished"
+		}
+		return ""
+	}
+	if now > m.LastMoveTime+int64(config.IdleTimeout) {
+		return "idle"
+	}
+	if m.WhiteConn == nil && m.BlackConn == nil && len(m.Spectators) == 0 {
+		lastPresence := m.LastMoveTime
+		for _, t := range []int64{m.WhiteDisconnectTime, m.BlackDisconnectTime} {
+			if t > lastPresence {
+				lastPresence = t
+			}
+		}
+		if now > lastPresence+int64(config.AbandonedRetention) {
+			return "abandoned"
+		}
+	}
+	return ""
+}
+
+func (cl *Cluster) runReaper() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		cl.reap()
+	}
+}
+
+func (cl *Cluster) reap() {
+	defer recoverPanic("reaper")
+	if cl.shuttingDown() {
+		return
+	}
+	now := time.Now().UnixNano()
+	for _, m := range cl.Matches.List() {
+		m.Mutex.Lock()
+		reason := m.reapReason(cl.reaperConfig, now)
+		if reason == "idle" || reason == "abandoned" {
+			if m.WhiteConn != nil && m.BlackConn != nil {
+				m.endMatch(none, timeoutReason)
+			} else {
+				m.endMatch(none, abandonmentReason)
+			}
+			m.sendState(white, false, false)
+			m.sendState(black, false, false)
+			m.sendSpectators(false, false)
+		}
+		m.Mutex.Unlock()
+		if reason != "" {
+			cl.evict(m, reason)
+		}
+	}
+
+	// matches whose owner went away
+	summaries, err := cl.listSummaries()
+	if err != nil {
+		logger.Error("could not list matches", "err", err)
+		return
+	}
+	for _, summary := range summaries {
+		expired := now > summary.LastMoveTime+int64(cl.reaperConfig.IdleTimeout)
+		if summary.Phase != gameoverPhase && !expired {
+			continue
+		}
+		if owner, err := cl.Store.MatchOwner(summary.Name); err != nil || owner != "" {
+			continue
+		}
+		// (taken over, it is reaped on a later pass)
+		if _, _, err := cl.localMatch(summary.Name); err != nil {
+			logger.Error("could not take over match", "match", summary.Name, "err", err)
+		}
+	}
+}
+
+// archive the match, close its connections, and drop it from this instance and the store
+func (cl *Cluster) evict(m *Match, reason string) {
+	cl.matchOver(m) // (does nothing if the result was already recorded)
+	m.Mutex.Lock()
+	m.reaped = true
+	conns := []*Client{m.WhiteConn, m.BlackConn}
+	for conn := range m.Spectators {
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		if conn != nil {
+			conn.close(closeMatchEndedCode, "The match has ended.")
+		}
+	}
+	name := m.Name
+	m.Mutex.Unlock()
+	cl.Matches.Delete(name)
+	cl.deleteMatch(name)
+	logger.Info("reaped match", "match", name, "reason", reason)
+}
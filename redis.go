@@ -0,0 +1,716 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal client of the Redis protocol (RESP), enough for the match store and bus.
+// Works against Redis itself or anything speaking its protocol (e.g. miniredis).
+
+const (
+	redisTimeout          = 5 * time.Second // for dialing and for each command
+	maxRedisReconnectWait = 30 * time.Second
+)
+
+// keys
+const (
+	ownerKeyPrefix   = "chrss:owner:"  // + match name -> id of owning instance (expires with the lease)
+	matchKeyPrefix   = "chrss:match:"  // + match name -> saved match state
+	summariesKey     = "chrss:matches" // hash of match name -> summary
+	usersKey         = "chrss:users"   // hash of user id -> user
+	userNumberKey    = "chrss:usernumber"
+	queueKey         = "chrss:queue"    // hash of ticket -> queue entry
+	resultKeyPrefix  = "chrss:result:"  // + match name -> set once the match's result is recorded
+	ratingsKeyPrefix = "chrss:ratings:" // + pool -> hash of user id -> rating
+	poolsKey         = "chrss:pools"    // set of rating pools
+	changesKeyPrefix = "chrss:changes:" // + user id -> list of rating changes
+	userKeyPrefix    = "chrss:index:"   // + index -> hash of key -> user id
+	tokenKeyPrefix   = "chrss:login:"   // + login token -> login (expires with the token)
+	recordsKeyPrefix = "chrss:records:" // + user id -> list of match records
+	replayKeyPrefix  = "chrss:replay:"  // + match name -> list of replay frames
+	accessKeyPrefix  = "chrss:access:"  // + match name -> who may see its replay
+)
+
+const resultClaimTTL = 24 * time.Hour // long after the match is gone from the store
+
+// take lease if it is free or already ours
+const acquireScript = `local owner = redis.call('GET', KEYS[1])
+if owner == false or owner == ARGV[1] then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return ARGV[1]
+end
+return owner`
+
+const updateFieldScript = `if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 1 then
+	redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+	return 1
+end
+return 0`
+
+const releaseScript = `if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`
+
+// claim hash field if it is free
+const claimFieldScript = `local owner = redis.call('HGET', KEYS[1], ARGV[1])
+if owner == false then
+	redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+	return ARGV[2]
+end
+return owner`
+
+const releaseFieldScript = `if redis.call('HGET', KEYS[1], ARGV[1]) == ARGV[2] then
+	return redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return 0`
+
+const takeScript = `local value = redis.call('GET', KEYS[1])
+if value then
+	redis.call('DEL', KEYS[1])
+end
+return value`
+
+// error reply from the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// rawurl is redis://[:password@]host:port[/db] (or rediss:// for TLS)
+func dialRedis(rawurl string) (net.Conn, *bufio.Reader, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, nil, err
+	}
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "redis":
+		conn, err = dialer.Dial("tcp", u.Host)
+	case "rediss":
+		conn, err = tls.DialWithDialer(dialer, "tcp", u.Host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, nil, errors.New("Unsupported redis URL scheme: " + u.Scheme)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+	var setup [][]string
+	if password, ok := u.User.Password(); ok {
+		setup = append(setup, []string{"AUTH", password})
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" && db != "0" {
+		setup = append(setup, []string{"SELECT", db})
+	}
+	for _, args := range setup {
+		conn.SetDeadline(time.Now().Add(redisTimeout))
+		err = writeCommand(conn, args...)
+		if err == nil {
+			_, err = readReply(r)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, r, nil
+}
+
+func writeCommand(w io.Writer, args ...string) error {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// returns string (simple string), int64, []byte (bulk string, nil if null), or []interface{} (array, nil if null)
+// an error reply is returned as a redisError (within an array, as an element)
+func readReply(r *bufio.Reader) (interface{}, error) {
+	reply, err := readReplyValue(r)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(redisError); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+func readReplyValue(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("redis: malformed reply line")
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return redisError(rest), nil
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return []byte(nil), nil
+		}
+		bytes := make([]byte, n+2)
+		if _, err := io.ReadFull(r, bytes); err != nil {
+			return nil, err
+		}
+		return bytes[:n], nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return []interface{}(nil), nil
+		}
+		elements := make([]interface{}, n)
+		for i := range elements {
+			if elements[i], err = readReplyValue(r); err != nil {
+				return nil, err
+			}
+		}
+		return elements, nil
+	}
+	return nil, errors.New("redis: unknown reply type " + string(kind))
+}
+
+// connection for commands, redialed after any network error
+type redisClient struct {
+	sync.Mutex
+	url  string
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// send commands together and read all their replies
+func (c *redisClient) pipeline(commands ...[]string) ([]interface{}, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.conn == nil {
+		conn, r, err := dialRedis(c.url)
+		if err != nil {
+			return nil, err
+		}
+		c.conn, c.r = conn, r
+	}
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var err error
+	for _, args := range commands {
+		if err = writeCommand(c.conn, args...); err != nil {
+			break
+		}
+	}
+	replies := make([]interface{}, len(commands))
+	for i := 0; err == nil && i < len(commands); i++ {
+		replies[i], err = readReplyValue(c.r)
+	}
+	if err != nil {
+		// connection is in an unknown state
+		c.conn.Close()
+		c.conn = nil
+		return nil, err
+	}
+	for _, reply := range replies {
+		if e, ok := reply.(redisError); ok {
+			return nil, e
+		}
+	}
+	return replies, nil
+}
+
+var errTransactionAborted = errors.New("redis: transaction aborted")
+
+// run commands in a MULTI/EXEC transaction and return their replies
+// (an error reply to any command is returned as the error)
+func (c *redisClient) transaction(commands ...[]string) ([]interface{}, error) {
+	pipeline := append([][]string{{"MULTI"}}, commands...)
+	pipeline = append(pipeline, []string{"EXEC"})
+	replies, err := c.pipeline(pipeline...)
+	if err != nil {
+		return nil, err
+	}
+	results, _ := replies[len(replies)-1].([]interface{})
+	if results == nil {
+		return nil, errTransactionAborted
+	}
+	for _, result := range results {
+		if e, ok := result.(redisError); ok {
+			return nil, e
+		}
+	}
+	return results, nil
+}
+
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	replies, err := c.pipeline(args)
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// the bulk strings of an array reply
+func bulkStrings(reply interface{}) [][]byte {
+	elements, _ := reply.([]interface{})
+	strings := make([][]byte, 0, len(elements))
+	for _, element := range elements {
+		if bytes, ok := element.([]byte); ok {
+			strings = append(strings, bytes)
+		}
+	}
+	return strings
+}
+
+func (c *redisClient) bytes(args ...string) ([]byte, error) {
+	reply, err := c.do(args...)
+	if err != nil {
+		return nil, err
+	}
+	bytes, _ := reply.([]byte)
+	return bytes, nil
+}
+
+type redisStore struct {
+	client *redisClient
+}
+
+func newRedisStore(url string) *redisStore {
+	return &redisStore{&redisClient{url: url}}
+}
+
+func (s *redisStore) AcquireMatch(name string, instance string, ttl time.Duration) (string, error) {
+	owner, err := s.client.bytes("EVAL", acquireScript, "1", ownerKeyPrefix+name,
+		instance, strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	return string(owner), err
+}
+
+func (s *redisStore) ReleaseMatch(name string, instance string) error {
+	_, err := s.client.do("EVAL", releaseScript, "1", ownerKeyPrefix+name, instance)
+	return err
+}
+
+func (s *redisStore) MatchOwner(name string) (string, error) {
+	owner, err := s.client.bytes("GET", ownerKeyPrefix+name)
+	return string(owner), err
+}
+
+func (s *redisStore) SaveMatch(name string, summary []byte, state []byte) error {
+	_, err := s.client.transaction(
+		[]string{"SET", matchKeyPrefix + name, string(state)},
+		[]string{"HSET", summariesKey, name, string(summary)},
+	)
+	return err
+}
+
+func (s *redisStore) LoadMatch(name string) ([]byte, error) {
+	return s.client.bytes("GET", matchKeyPrefix+name)
+}
+
+func (s *redisStore) LoadMatchSummary(name string) ([]byte, error) {
+	return s.client.bytes("HGET", summariesKey, name)
+}
+
+func (s *redisStore) ListMatchSummaries() ([][]byte, error) {
+	reply, err := s.client.do("HVALS", summariesKey)
+	if err != nil {
+		return nil, err
+	}
+	return bulkStrings(reply), nil
+}
+
+func (s *redisStore) DeleteMatch(name string) error {
+	_, err := s.client.transaction(
+		[]string{"DEL", matchKeyPrefix + name},
+		[]string{"HDEL", summariesKey, name},
+	)
+	return err
+}
+
+func (s *redisStore) SaveUser(userID string, user []byte) error {
+	_, err := s.client.do("HSET", usersKey, userID, string(user))
+	return err
+}
+
+func (s *redisStore) LoadUser(userID string) ([]byte, error) {
+	return s.client.bytes("HGET", usersKey, userID)
+}
+
+func (s *redisStore) DeleteUser(userID string) error {
+	_, err := s.client.do("HDEL", usersKey, userID)
+	return err
+}
+
+func (s *redisStore) ClaimUserKey(index string, key string, userID string) (string, error) {
+	owner, err := s.client.bytes("EVAL", claimFieldScript, "1", userKeyPrefix+index, key, userID)
+	return string(owner), err
+}
+
+func (s *redisStore) LookupUserKey(index string, key string) (string, error) {
+	owner, err := s.client.bytes("HGET", userKeyPrefix+index, key)
+	return string(owner), err
+}
+
+func (s *redisStore) ReleaseUserKey(index string, key string, userID string) error {
+	_, err := s.client.do("EVAL", releaseFieldScript, "1", userKeyPrefix+index, key, userID)
+	return err
+}
+
+func (s *redisStore) SaveLoginToken(token string, login []byte, ttl time.Duration) error {
+	_, err := s.client.do("SET", tokenKeyPrefix+token, string(login),
+		"PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	return err
+}
+
+func (s *redisStore) TakeLoginToken(token string) ([]byte, error) {
+	return s.client.bytes("EVAL", takeScript, "1", tokenKeyPrefix+token)
+}
+
+func (s *redisStore) NextUserNumber() (int64, error) {
+	reply, err := s.client.do("INCR", userNumberKey)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := reply.(int64)
+	return n, nil
+}
+
+func (s *redisStore) AddQueueEntry(ticket string, entry []byte) error {
+	_, err := s.client.do("HSET", queueKey, ticket, string(entry))
+	return err
+}
+
+func (s *redisStore) UpdateQueueEntry(ticket string, entry []byte) (bool, error) {
+	reply, err := s.client.do("EVAL", updateFieldScript, "1", queueKey, ticket, string(entry))
+	if err != nil {
+		return false, err
+	}
+	return reply == int64(1), nil
+}
+
+func (s *redisStore) RemoveQueueEntry(ticket string) (bool, error) {
+	reply, err := s.client.do("HDEL", queueKey, ticket)
+	if err != nil {
+		return false, err
+	}
+	return reply == int64(1), nil
+}
+
+func (s *redisStore) ListQueueEntries() ([][]byte, error) {
+	reply, err := s.client.do("HVALS", queueKey)
+	if err != nil {
+		return nil, err
+	}
+	return bulkStrings(reply), nil
+}
+
+func (s *redisStore) ClaimResult(name string) (bool, error) {
+	reply, err := s.client.do("SET", resultKeyPrefix+name, "1", "NX",
+		"PX", strconv.FormatInt(int64(resultClaimTTL/time.Millisecond), 10))
+	if err != nil {
+		return false, err
+	}
+	return reply == "OK", nil
+}
+
+func (s *redisStore) AddMatchRecord(userID string, record []byte) error {
+	_, err := s.client.pipeline(
+		[]string{"RPUSH", recordsKeyPrefix + userID, string(record)},
+		[]string{"LTRIM", recordsKeyPrefix + userID, strconv.Itoa(-maxMatchRecords), "-1"},
+	)
+	return err
+}
+
+func (s *redisStore) ListMatchRecords(userID string) ([][]byte, error) {
+	reply, err := s.client.do("LRANGE", recordsKeyPrefix+userID, "0", "-1")
+	if err != nil {
+		return nil, err
+	}
+	return bulkStrings(reply), nil
+}
+
+func (s *redisStore) DeleteMatchRecords(userID string) error {
+	_, err := s.client.do("DEL", recordsKeyPrefix+userID)
+	return err
+}
+
+func (s *redisStore) AddReplayFrames(name string, frames [][]byte) error {
+	push := []string{"RPUSH", replayKeyPrefix + name}
+	for _, frame := range frames {
+		push = append(push, string(frame))
+	}
+	_, err := s.client.pipeline(
+		push,
+		[]string{"PEXPIRE", replayKeyPrefix + name, strconv.FormatInt(int64(replayRetention/time.Millisecond), 10)},
+	)
+	return err
+}
+
+func (s *redisStore) ListReplayFrames(name string) ([][]byte, error) {
+	reply, err := s.client.do("LRANGE", replayKeyPrefix+name, "0", "-1")
+	if err != nil {
+		return nil, err
+	}
+	return bulkStrings(reply), nil
+}
+
+func (s *redisStore) SaveReplayAccess(name string, access []byte) error {
+	_, err := s.client.do("SET", accessKeyPrefix+name, string(access),
+		"PX", strconv.FormatInt(int64(replayRetention/time.Millisecond), 10))
+	return err
+}
+
+func (s *redisStore) LoadReplayAccess(name string) ([]byte, error) {
+	return s.client.bytes("GET", accessKeyPrefix+name)
+}
+
+func (s *redisStore) SaveRating(pool string, userID string, rating []byte) error {
+	_, err := s.client.transaction(
+		[]string{"HSET", ratingsKeyPrefix + pool, userID, string(rating)},
+		[]string{"SADD", poolsKey, pool},
+	)
+	return err
+}
+
+func (s *redisStore) LoadRating(pool string, userID string) ([]byte, error) {
+	return s.client.bytes("HGET", ratingsKeyPrefix+pool, userID)
+}
+
+func (s *redisStore) ListRatings(pool string) ([][]byte, error) {
+	reply, err := s.client.do("HVALS", ratingsKeyPrefix+pool)
+	if err != nil {
+		return nil, err
+	}
+	return bulkStrings(reply), nil
+}
+
+func (s *redisStore) ListRatingPools() ([]string, error) {
+	reply, err := s.client.do("SMEMBERS", poolsKey)
+	if err != nil {
+		return nil, err
+	}
+	pools := []string{}
+	for _, pool := range bulkStrings(reply) {
+		pools = append(pools, string(pool))
+	}
+	return pools, nil
+}
+
+func (s *redisStore) DeleteRating(pool string, userID string) error {
+	_, err := s.client.do("HDEL", ratingsKeyPrefix+pool, userID)
+	return err
+}
+
+func (s *redisStore) AddRatingChange(userID string, change []byte) error {
+	_, err := s.client.pipeline(
+		[]string{"RPUSH", changesKeyPrefix + userID, string(change)},
+		[]string{"LTRIM", changesKeyPrefix + userID, strconv.Itoa(-maxRatingChanges), "-1"},
+	)
+	return err
+}
+
+func (s *redisStore) ListRatingChanges(userID string) ([][]byte, error) {
+	reply, err := s.client.do("LRANGE", changesKeyPrefix+userID, "0", "-1")
+	if err != nil {
+		return nil, err
+	}
+	return bulkStrings(reply), nil
+}
+
+func (s *redisStore) DeleteRatingChanges(userID string) error {
+	_, err := s.client.do("DEL", changesKeyPrefix+userID)
+	return err
+}
+
+// publishes with a command connection; receives on a dedicated subscription connection,
+// which is redialed (and its channels resubscribed) if lost
+type redisBus struct {
+	client *redisClient
+	sync.Mutex
+	conn        net.Conn // subscription connection (nil if not connected)
+	subscribers map[string]map[chan []byte]bool
+	pending     map[string]chan struct{} // closed when server confirms subscription to the channel
+}
+
+func newRedisBus(url string) *redisBus {
+	return &redisBus{
+		client:      &redisClient{url: url},
+		subscribers: make(map[string]map[chan []byte]bool),
+		pending:     make(map[string]chan struct{}),
+	}
+}
+
+func (b *redisBus) Publish(channel string, message []byte) error {
+	_, err := b.client.do("PUBLISH", channel, string(message))
+	return err
+}
+
+func (b *redisBus) Subscribe(channel string) (<-chan []byte, func(), error) {
+	ch := make(chan []byte, subscriptionBufferSize)
+	b.Lock()
+	if b.conn == nil {
+		if err := b.connect(); err != nil {
+			b.Unlock()
+			return nil, nil, err
+		}
+	}
+	if b.subscribers[channel] == nil {
+		b.subscribers[channel] = make(map[chan []byte]bool)
+		b.pending[channel] = make(chan struct{})
+		if err := b.write("SUBSCRIBE", channel); err != nil {
+			delete(b.subscribers, channel)
+			delete(b.pending, channel)
+			b.Unlock()
+			return nil, nil, err
+		}
+	}
+	b.subscribers[channel][ch] = true
+	confirmed := b.pending[channel]
+	b.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			b.Lock()
+			delete(b.subscribers[channel], ch)
+			if len(b.subscribers[channel]) == 0 {
+				delete(b.subscribers, channel)
+				delete(b.pending, channel)
+				if b.conn != nil {
+					b.write("UNSUBSCRIBE", channel)
+				}
+			}
+			close(ch)
+			b.Unlock()
+		})
+	}
+	if confirmed != nil {
+		select {
+		case <-confirmed:
+		case <-time.After(redisTimeout):
+			unsubscribe()
+			return nil, nil, errors.New("redis: timed out subscribing to " + channel)
+		}
+	}
+	return ch, unsubscribe, nil
+}
+
+// dial subscription connection and resubscribe to all channels
+// assumes bus mutex is held
+func (b *redisBus) connect() error {
+	conn, r, err := dialRedis(b.client.url)
+	if err != nil {
+		return err
+	}
+	b.conn = conn
+	go b.readLoop(conn, r)
+	if len(b.subscribers) == 0 {
+		return nil
+	}
+	channels := []string{"SUBSCRIBE"}
+	for channel := range b.subscribers {
+		channels = append(channels, channel)
+	}
+	return b.write(channels...)
+}
+
+// assumes bus mutex is held
+func (b *redisBus) write(args ...string) error {
+	b.conn.SetWriteDeadline(time.Now().Add(redisTimeout))
+	return writeCommand(b.conn, args...)
+}
+
+func (b *redisBus) readLoop(conn net.Conn, r *bufio.Reader) {
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			conn.Close()
+			b.reconnect(conn, err)
+			return
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) < 3 {
+			continue
+		}
+		kind, _ := parts[0].([]byte)
+		channel, _ := parts[1].([]byte)
+		b.Lock()
+		switch string(kind) {
+		case "subscribe":
+			if confirmed := b.pending[string(channel)]; confirmed != nil {
+				close(confirmed)
+				b.pending[string(channel)] = nil
+			}
+		case "message":
+			message, _ := parts[2].([]byte)
+			for ch := range b.subscribers[string(channel)] {
+				select {
+				case ch <- message:
+				default:
+					logger.Warn("dropped message to slow subscriber", "channel", channel)
+				}
+			}
+		}
+		b.Unlock()
+	}
+}
+
+// after the subscription connection is lost, redial until connected again
+// (messages published in the meantime are lost)
+func (b *redisBus) reconnect(lost net.Conn, err error) {
+	b.Lock()
+	if b.conn != lost {
+		b.Unlock()
+		return
+	}
+	b.conn = nil
+	b.Unlock()
+	logger.Warn("lost redis subscription connection", "err", err)
+	for wait := time.Second; ; wait *= 2 {
+		b.Lock()
+		if b.conn != nil || len(b.subscribers) == 0 {
+			// already redialed by Subscribe, or no need to
+			b.Unlock()
+			return
+		}
+		err := b.connect()
+		if err != nil && b.conn != nil {
+			b.conn.Close()
+			b.conn = nil
+		}
+		b.Unlock()
+		if err == nil {
+			return
+		}
+		logger.Error("could not reconnect redis subscription connection", "err", err)
+		if wait > maxRedisReconnectWait {
+			wait = maxRedisReconnectWait
+		}
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// a fresh miniredis for the test, and its URL
+func startRedis(t *testing.T) (*miniredis.Miniredis, string) {
+	t.Helper()
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	return server, "redis://" + server.Addr()
+}
+
+func TestRedisLease(t *testing.T) {
+	type step struct {
+		op       string // acquire, release, owner, or wait
+		instance string
+		wait     time.Duration
+		want     string // owner returned
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"free lease is taken", []step{
+			{op: "owner", want: ""},
+			{op: "acquire", instance: "a", want: "a"},
+			{op: "owner", want: "a"},
+		}},
+		{"held lease is not taken", []step{
+			{op: "acquire", instance: "a", want: "a"},
+			{op: "acquire", instance: "b", want: "a"},
+			{op: "owner", want: "a"},
+		}},
+		{"holder renews", []step{
+			{op: "acquire", instance: "a", want: "a"},
+			{op: "wait", wait: leaseTTL / 2},
+			{op: "acquire", instance: "a", want: "a"},
+			{op: "wait", wait: leaseTTL * 3 / 4},
+			{op: "acquire", instance: "b", want: "a"},
+		}},
+		{"lapsed lease is taken", []step{
+			{op: "acquire", instance: "a", want: "a"},
+			{op: "wait", wait: leaseTTL + time.Millisecond},
+			{op: "owner", want: ""},
+			{op: "acquire", instance: "b", want: "b"},
+		}},
+		{"only the holder releases", []step{
+			{op: "acquire", instance: "a", want: "a"},
+			{op: "release", instance: "b"},
+			{op: "owner", want: "a"},
+			{op: "release", instance: "a"},
+			{op: "owner", want: ""},
+			{op: "acquire", instance: "b", want: "b"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, url := startRedis(t)
+			store := newRedisStore(url)
+			for i, step := range test.steps {
+				var owner string
+				var err error
+				switch step.op {
+				case "acquire":
+					owner, err = store.AcquireMatch("match", step.instance, leaseTTL)
+				case "release":
+					err = store.ReleaseMatch("match", step.instance)
+				case "owner":
+					owner, err = store.MatchOwner("match")
+				case "wait":
+					server.FastForward(step.wait)
+				}
+				if err != nil {
+					t.Fatalf("step %d (%s): %v", i, step.op, err)
+				}
+				if owner != step.want {
+					t.Fatalf("step %d (%s %s): owner %q, want %q", i, step.op, step.instance, owner, step.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, store *redisStore, server *miniredis.Miniredis)
+	}{
+		{"match", func(t *testing.T, store *redisStore, server *miniredis.Miniredis) {
+			must := musts{t}
+			check(t, store.SaveMatch("a", []byte(`{"Name":"a"}`), []byte("state a")))
+			check(t, store.SaveMatch("b", []byte(`{"Name":"b"}`), []byte("state b")))
+			check(t, store.SaveMatch("a", []byte(`{"Name":"a","Round":2}`), []byte("state a2")))
+			wantBytes(t, "state", must.bytes(store.LoadMatch("a")), "state a2")
+			wantBytes(t, "summary", must.bytes(store.LoadMatchSummary("a")), `{"Name":"a","Round":2}`)
+			wantList(t, "summaries", must.list(store.ListMatchSummaries()), `{"Name":"a","Round":2}`, `{"Name":"b"}`)
+			check(t, store.DeleteMatch("a"))
+			wantBytes(t, "deleted state", must.bytes(store.LoadMatch("a")), "")
+			wantBytes(t, "deleted summary", must.bytes(store.LoadMatchSummary("a")), "")
+			wantList(t, "summaries after delete", must.list(store.ListMatchSummaries()), `{"Name":"b"}`)
+		}},
+		{"failed transaction", func(t *testing.T, store *redisStore, server *miniredis.Miniredis) {
+			// the summaries hash is the wrong type, so its command fails within the EXEC
+			server.Set(summariesKey, "not a hash")
+			if err := store.SaveMatch("a", []byte("summary"), []byte("state")); err == nil {
+				t.Fatal("SaveMatch succeeded though the summary was not saved")
+			}
+			if err := store.DeleteMatch("a"); err == nil {
+				t.Fatal("DeleteMatch succeeded though the summary was not deleted")
+			}
+		}},
+		{"user", func(t *testing.T, store *redisStore, server *miniredis.Miniredis) {
+			must := musts{t}
+			check(t, store.SaveUser("u1", []byte("user 1")))
+			wantBytes(t, "user", must.bytes(store.LoadUser("u1")), "user 1")
+			wantBytes(t, "missing user", must.bytes(store.LoadUser("u2")), "")
+			check(t, store.DeleteUser("u1"))
+			wantBytes(t, "deleted user", must.bytes(store.LoadUser("u1")), "")
+			for i := int64(1); i <= 3; i++ {
+				n, err := store.NextUserNumber()
+				check(t, err)
+				if n != i {
+					t.Fatalf("user number %d, want %d", n, i)
+				}
+			}
+		}},
+		{"user keys", func(t *testing.T, store *redisStore, server *miniredis.Miniredis) {
+			must := musts{t}
+			wantString(t, "claim", must.str(store.ClaimUserKey("name", "bob", "u1")), "u1")
+			wantString(t, "claim taken", must.str(store.ClaimUserKey("name", "bob", "u2")), "u1")
+			wantString(t, "other index", must.str(store.ClaimUserKey("email", "bob", "u2")), "u2")
+			wantString(t, "lookup", must.str(store.LookupUserKey("name", "bob")), "u1")
+			check(t, store.ReleaseUserKey("name", "bob", "u2"))
+			wantString(t, "released by other", must.str(store.LookupUserKey("name", "bob")), "u1")
+			check(t, store.ReleaseUserKey("name", "bob", "u1"))
+			wantString(t, "released", must.str(store.LookupUserKey("name", "bob")), "")
+		}},
+		{"login token", func(t *testing.T, store *redisStore, server *miniredis.Miniredis) {
+			must := musts{t}
+			check(t, store.SaveLoginToken("t1", []byte("login 1"), time.Minute))
+			check(t, store.SaveLoginToken("t2", []byte("login 2"), time.Minute))
+			wantBytes(t, "take", must.bytes(store.TakeLoginToken("t1")), "login 1")
+			wantBytes(t, "take again", must.bytes(store.TakeLoginToken("t1")), "")
+			server.FastForward(time.Minute + time.Millisecond)
+			wantBytes(t, "expired", must.bytes(store.TakeLoginToken("t2")), "")
+		}},
+		{"queue", func(t *testing.T, store *redisStore, server *miniredis.Miniredis) {
+			must := musts{t}
+			check(t, store.AddQueueEntry("t1", []byte("entry 1")))
+			check(t, store.AddQueueEntry("t2", []byte("entry 2")))
+			wantBool(t, "update", must.ok(store.UpdateQueueEntry("t1", []byte("entry 1b"))), true)
+			wantBool(t, "update missing", must.ok(store.UpdateQueueEntry("t3", []byte("entry 3"))), false)
+			wantList(t, "entries", must.list(store.ListQueueEntries()), "entry 1b", "entry 2")
+			wantBool(t, "remove", must.ok(store.RemoveQueueEntry("t1")), true)
+			wantBool(t, "remove again", must.ok(store.RemoveQueueEntry("t1")), false)
+			wantList(t, "entries after remove", must.list(store.ListQueueEntries()), "entry 2")
+		}},
+		{"result claim", func(t *testing.T, store *redisStore, server *miniredis.Miniredis) {
+			must := musts{t}
+			wantBool(t, "first claim", must.ok(store.ClaimResult("a")), true)
+			wantBool(t, "second claim", must.ok(store.ClaimResult("a")), false)
+			wantBool(t, "other match", must.ok(store.ClaimResult("b")), true)
+		}},
+		{"match records", func(t *testing.T, store *redisStore, server *miniredis.Miniredis) {
+			must := musts{t}
+			for i := 0; i < maxMatchRecords+2; i++ {
+				check(t, store.AddMatchRecord("u1", []byte(strconv.Itoa(i))))
+			}
+			records := must.list(store.ListMatchRecords("u1"))
+			if len(records) != maxMatchRecords || string(records[0]) != "2" ||
+				string(records[len(records)-1]) != strconv.Itoa(maxMatchRecords+1) {
+				t.Fatalf("kept %d records from %s, want the last %d", len(records), records[0], maxMatchRecords)
+			}
+			check(t, store.DeleteMatchRecords("u1"))
+			wantList(t, "deleted records", must.list(store.ListMatchRecords("u1")))
+		}},
+		{"replay frames", func(t *testing.T, store *redisStore, server *miniredis.Miniredis) {
+			must := musts{t}
+			check(t, store.AddReplayFrames("a", [][]byte{[]byte("1"), []byte("2")}))
+			check(t, store.AddReplayFrames("a", [][]byte{[]byte("3")}))
+			frames := must.list(store.ListReplayFrames("a"))
+			if !reflect.DeepEqual(frames, [][]byte{[]byte("1"), []byte("2"), []byte("3")}) {
+				t.Fatalf("frames %q", frames)
+			}
+			server.FastForward(replayRetention + time.Millisecond)
+			wantList(t, "expired frames", must.list(store.ListReplayFrames("a")))
+		}},
+		{"replay access", func(t *testing.T, store *redisStore, server *miniredis.Miniredis) {
+			must := musts{t}
+			wantBytes(t, "unsaved access", must.bytes(store.LoadReplayAccess("a")), "")
+			check(t, store.SaveReplayAccess("a", []byte("access")))
+			wantBytes(t, "access", must.bytes(store.LoadReplayAccess("a")), "access")
+			server.FastForward(replayRetention + time.Millisecond)
+			wantBytes(t, "expired access", must.bytes(store.LoadReplayAccess("a")), "")
+		}},
+		{"ratings", func(t *testing.T, store *redisStore, server *miniredis.Miniredis) {
+			must := musts{t}
+			check(t, store.SaveRating("live", "u1", []byte("r1")))
+			check(t, store.SaveRating("live", "u2", []byte("r2")))
+			check(t, store.SaveRating("blitz", "u1", []byte("r3")))
+			wantBytes(t, "rating", must.bytes(store.LoadRating("live", "u1")), "r1")
+			wantBytes(t, "missing rating", must.bytes(store.LoadRating("blitz", "u2")), "")
+			wantList(t, "ratings", must.list(store.ListRatings("live")), "r1", "r2")
+			pools, err := store.ListRatingPools()
+			check(t, err)
+			sort.Strings(pools)
+			if !reflect.DeepEqual(pools, []string{"blitz", "live"}) {
+				t.Fatalf("pools %q", pools)
+			}
+			check(t, store.DeleteRating("live", "u1"))
+			wantList(t, "ratings after delete", must.list(store.ListRatings("live")), "r2")
+		}},
+		{"rating changes", func(t *testing.T, store *redisStore, server *miniredis.Miniredis) {
+			must := musts{t}
+			for i := 0; i < maxRatingChanges+1; i++ {
+				check(t, store.AddRatingChange("u1", []byte(strconv.Itoa(i))))
+			}
+			changes := must.list(store.ListRatingChanges("u1"))
+			if len(changes) != maxRatingChanges || string(changes[0]) != "1" {
+				t.Fatalf("kept %d changes from %s, want the last %d", len(changes), changes[0], maxRatingChanges)
+			}
+			check(t, store.DeleteRatingChanges("u1"))
+			wantList(t, "deleted changes", must.list(store.ListRatingChanges("u1")))
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, url := startRedis(t)
+			test.run(t, newRedisStore(url), server)
+		})
+	}
+}
+
+// relayed connections between two instances, each with its own bus
+func TestRedisRelay(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, relaying *redisBus, owning *redisBus, server *miniredis.Miniredis)
+	}{
+		{"client message to owner", func(t *testing.T, relaying *redisBus, owning *redisBus, server *miniredis.Miniredis) {
+			events := subscribe(t, owning, instanceChannel("owner"))
+			relayer := &Cluster{ID: "relayer", Bus: relaying}
+			sent := relayEvent{Kind: messageEvent, ConnID: "c1", Match: "a", Color: white, UserID: "u1",
+				Name: "Bob", LastSeq: 3, Data: []byte(`{"type":"pass"}`)}
+			check(t, relayer.publishRelayEvent("owner", sent))
+			var received relayEvent
+			check(t, json.Unmarshal(receive(t, events), &received))
+			if !reflect.DeepEqual(received, sent) {
+				t.Fatalf("received %+v, want %+v", received, sent)
+			}
+		}},
+		{"server messages and close to relaying instance", func(t *testing.T, relaying *redisBus, owning *redisBus, server *miniredis.Miniredis) {
+			frames := subscribe(t, relaying, connChannel("c1"))
+			conn := newRelayedClient(owning, "c1", "test connection")
+			conn.queue([]byte(`{"type":"ack"}`))
+			conn.close(closeReplacedCode, "replaced")
+			var frame relayFrame
+			check(t, json.Unmarshal(receive(t, frames), &frame))
+			if string(frame.Data) != `{"type":"ack"}` || frame.CloseCode != 0 {
+				t.Fatalf("first frame %+v, want the message", frame)
+			}
+			frame = relayFrame{}
+			check(t, json.Unmarshal(receive(t, frames), &frame))
+			if frame.CloseCode != closeReplacedCode || frame.CloseText != "replaced" || frame.Data != nil {
+				t.Fatalf("second frame %+v, want the close", frame)
+			}
+		}},
+		{"no delivery after unsubscribe", func(t *testing.T, relaying *redisBus, owning *redisBus, server *miniredis.Miniredis) {
+			messages, unsubscribe, err := owning.Subscribe("chrss:test")
+			check(t, err)
+			unsubscribe()
+			check(t, relaying.Publish("chrss:test", []byte("lost")))
+			if _, ok := <-messages; ok {
+				t.Fatal("message delivered after unsubscribe")
+			}
+		}},
+		{"resubscribed after the connection is lost", func(t *testing.T, relaying *redisBus, owning *redisBus, server *miniredis.Miniredis) {
+			events := subscribe(t, owning, instanceChannel("owner"))
+			server.Close()
+			check(t, server.Restart())
+			// (messages published before the bus reconnects are lost, so keep publishing)
+			deadline := time.After(10 * time.Second)
+			for {
+				relaying.Publish(instanceChannel("owner"), []byte("after restart"))
+				select {
+				case message := <-events:
+					if string(message) != "after restart" {
+						t.Fatalf("received %q", message)
+					}
+					return
+				case <-time.After(100 * time.Millisecond):
+				case <-deadline:
+					t.Fatal("no message after the server restarted")
+				}
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, url := startRedis(t)
+			test.run(t, newRedisBus(url), newRedisBus(url), server)
+		})
+	}
+}
+
+func subscribe(t *testing.T, bus *redisBus, channel string) <-chan []byte {
+	t.Helper()
+	messages, unsubscribe, err := bus.Subscribe(channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(unsubscribe)
+	return messages
+}
+
+func receive(t *testing.T, messages <-chan []byte) []byte {
+	t.Helper()
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(redisTimeout):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// unwraps results, failing the test on error
+type musts struct {
+	t *testing.T
+}
+
+func (m musts) bytes(b []byte, err error) []byte {
+	m.t.Helper()
+	check(m.t, err)
+	return b
+}
+
+func (m musts) list(list [][]byte, err error) [][]byte {
+	m.t.Helper()
+	check(m.t, err)
+	return list
+}
+
+func (m musts) str(s string, err error) string {
+	m.t.Helper()
+	check(m.t, err)
+	return s
+}
+
+func (m musts) ok(ok bool, err error) bool {
+	m.t.Helper()
+	check(m.t, err)
+	return ok
+}
+
+func wantBytes(t *testing.T, what string, got []byte, want string) {
+	t.Helper()
+	if string(got) != want {
+		t.Fatalf("%s: %q, want %q", what, got, want)
+	}
+}
+
+func wantString(t *testing.T, what string, got string, want string) {
+	t.Helper()
+	if got != want {
+		t.Fatalf("%s: %q, want %q", what, got, want)
+	}
+}
+
+func wantBool(t *testing.T, what string, got bool, want bool) {
+	t.Helper()
+	if got != want {
+		t.Fatalf("%s: %v, want %v", what, got, want)
+	}
+}
+
+// compares ignoring order
+func wantList(t *testing.T, what string, got [][]byte, want ...string) {
+	t.Helper()
+	sort.Slice(got, func(i, j int) bool { return bytes.Compare(got[i], got[j]) < 0 })
+	sort.Strings(want)
+	if len(got) != len(want) {
+		t.Fatalf("%s: %q, want %q", what, got, want)
+	}
+	for i := range got {
+		if string(got[i]) != want[i] {
+			t.Fatalf("%s: %q, want %q", what, got, want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"time"
+)
+
+// Rematches
+//
+// Once a match is over, either player can ask for a rematch, and once the other accepts (the AI always
+// does), the owner creates a new match with the same settings and the colors swapped. The finished match's
+// state names the rematch, and clients (players and spectators alike) follow it there. A series of rematches
+// carries a running score.
+
+// results of the matches in a series before this one, by color in this match
+type Series struct {
+	Games     int `json:"games"`
+	WhiteWins int `json:"whiteWins"`
+	BlackWins int `json:"blackWins"`
+	Draws     int `json:"draws"`
+}
+
+// score of the series, including this match if it is over
+// assumes match mutex is held
+func (m *Match) seriesScore() Series {
+	series := m.Series
+	if m.Phase == gameoverPhase {
+		series.Games++
+		switch m.Winner {
+		case white:
+			series.WhiteWins++
+		case black:
+			series.BlackWins++
+		case draw:
+			series.Draws++
+		}
+	}
+	return series
+}
+
+// assumes match mutex is held
+func (m *Match) isAIOpponent(color string) bool {
+	opponent := otherColor(color)
+	_, takeover := m.disconnectState(opponent)
+	isAI := m.WhiteAI
+	if opponent == black {
+		isAI = m.BlackAI
+	}
+	return isAI && !*takeover
+}
+
+// ask for a rematch, or accept the opponent's request
+// assumes match mutex is held
+func (m *Match) requestRematch(player string) error {
+	if m.Phase != gameoverPhase {
+		return protocolError(invalidActionError, "match is not over")
+	}
+	if m.EndReason == declinedReason {
+		return protocolError(invalidActionError, "challenge was declined")
+	}
+	if m.Rematch != "" || m.RematchAccepted {
+		return protocolError(invalidActionError, "rematch already agreed")
+	}
+	if m.RematchOffer == player {
+		return protocolError(invalidActionError, "rematch already requested")
+	}
+	if m.RematchOffer == otherColor(player) || m.isAIOpponent(player) {
+		m.RematchAccepted = true
+		m.Log = append(m.Log, player+" accepted a rematch")
+		return nil
+	}
+	m.RematchOffer = player
+	m.Log = append(m.Log, player+" asked for a rematch")
+	return nil
+}
+
+// assumes match mutex is held
+func (m *Match) declineRematch(player string) error {
+	if m.RematchOffer != otherColor(player) || m.RematchAccepted {
+		return protocolError(invalidActionError, "opponent has not asked for a rematch")
+	}
+	m.RematchOffer = none
+	m.Log = append(m.Log, player+" declined the rematch")
+	return nil
+}
+
+// new match with the same settings and players as the finished match, colors swapped
+// assumes match mutex is held
+func (m *Match) rematchOf() *Match {
+	match := newMatch(m.CreatorName)
+	match.TurnTimer = m.TurnTimer
+	match.DevMode = m.DevMode
+	match.MaxRounds = m.MaxRounds
+	match.DisconnectGrace = m.DisconnectGrace
+	match.DisconnectPolicy = m.DisconnectPolicy
+	match.SpectatorDelay = m.SpectatorDelay
+	match.TimeBank = m.TimeBank
+	match.TimeIncrement = m.TimeIncrement
+	match.Rated = m.Rated
+	match.AILevel = m.AILevel
+	match.Private = m.Private
+	match.PasswordHash = m.PasswordHash
+	match.InviteToken = m.InviteToken
+	match.WhitePlayerID, match.BlackPlayerID = m.BlackPlayerID, m.WhitePlayerID
+	match.WhiteAI = m.BlackAI && !m.BlackAITakeover
+	match.BlackAI = m.WhiteAI && !m.WhiteAITakeover
+	score := m.seriesScore()
+	match.Series = Series{score.Games, score.BlackWins, score.WhiteWins, score.Draws}
+	// both players have agreed to play, so no ready up
+	match.Phase = kingPlacementPhase
+	match.Round = 1
+	match.LastMoveTime = time.Now().UnixNano()
+	match.RoundStartTime = match.LastMoveTime
+	return match
+}
+
+// create the rematch once both players have agreed to it (does nothing otherwise)
+// locks match mutex
+func (cl *Cluster) startRematch(m *Match) {
+	m.Mutex.Lock()
+	if !m.RematchAccepted || m.Rematch != "" || m.rematchStarting {
+		m.Mutex.Unlock()
+		return
+	}
+	m.rematchStarting = true
+	rematch := m.rematchOf()
+	m.Mutex.Unlock()
+
+	err := cl.startMatch(rematch)
+
+	m.Mutex.Lock()
+	m.rematchStarting = false
+	if err != nil {
+		m.logger().Error("could not create rematch", "err", err)
+		m.RematchAccepted = false
+		m.RematchOffer = none
+		m.Log = append(m.Log, "the rematch could not be created")
+	} else {
+		m.Rematch = rematch.Name
+		m.Log = append(m.Log, "rematch started")
+	}
+	m.sendState(white, false, false)
+	m.sendState(black, false, false)
+	m.sendSpectators(false, false)
+	m.Mutex.Unlock()
+	cl.saveMatch(m)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strconv"
+)
+
+// recent server messages for one recipient (a player seat, or all spectators),
+// numbered so that a reconnecting client can be sent what it missed
+type outbox struct {
+	seq      int64    // seq of most recent message (0 if none)
+	messages [][]byte // encoded messages, oldest first; last element has seq
+}
+
+// number and encode the message and keep it for replay
+func (o *outbox) add(msgType string, replyTo int64, payload interface{}) ([]byte, error) {
+	bytes, err := encodeServerMessage(msgType, o.seq+1, replyTo, payload)
+	if err != nil {
+		return nil, err
+	}
+	o.seq++
+	o.messages = append(o.messages, bytes)
+	if len(o.messages) > maxReplayMessages {
+		o.messages = o.messages[len(o.messages)-maxReplayMessages:]
+	}
+	return bytes, nil
+}
+
+// messages after lastSeq; returns false if some of them are no longer kept
+// (or lastSeq is ahead of us, e.g. client saw a previous server process)
+func (o *outbox) since(lastSeq int64) ([][]byte, bool) {
+	if lastSeq > o.seq {
+		return nil, false
+	}
+	missed := o.seq - lastSeq
+	if missed > int64(len(o.messages)) {
+		return nil, false
+	}
+	return o.messages[int64(len(o.messages))-missed:], true
+}
+
+// parse lastSeq query value of a reconnecting client (-1 if absent or invalid)
+func parseLastSeq(s string) int64 {
+	if s == "" {
+		return -1
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// write to newly connected player everything sent after lastSeq
+// returns false if the messages can't be replayed (in which case caller should send a snapshot)
+// assumes match mutex is held
+func (m *Match) resume(color string, lastSeq int64) bool {
+	conn, view, box := m.WhiteConn, m.whiteView, &m.whiteOutbox
+	if color == black {
+		conn, view, box = m.BlackConn, m.blackView, &m.blackOutbox
+	}
+	if lastSeq < 0 || view == nil || conn == nil {
+		return false
+	}
+	missed, ok := box.since(lastSeq)
+	if !ok {
+		return false
+	}
+	for _, bytes := range missed {
+		conn.queue(bytes)
+	}
+	return true
+}
+
+// assumes match mutex is held
+func (m *Match) resumeSpectator(conn *Client, lastSeq int64) bool {
+	if lastSeq < 0 {
+		return false
+	}
+	missed, ok := m.spectatorOutbox.since(lastSeq)
+	if !ok {
+		return false
+	}
+	for _, bytes := range missed {
+		conn.queue(bytes)
+	}
+	return true
+}
+
+// close connection superseded by a newer connection for the same seat
+// (client should not try to reconnect upon this close code)
+func closeReplaced(c *Client) {
+	c.close(closeReplacedCode, "replaced by a newer connection")
+}
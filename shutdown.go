@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Graceful shutdown
+//
+// On SIGTERM (which Heroku sends before restarting or replacing a dyno) or SIGINT, the instance stops
+// taking new matches and connections, tells everyone connected that the server is restarting, and hands
+// off its matches: each is saved one last time, marked with the shutdown time (so the turn clocks don't
+// count the downtime against anyone), and its lease released. Websockets are then closed with
+// closeRestartingCode, and clients reconnect shortly after, at which point the next instance (or another
+// running instance) restores the match. On boot, an instance also restores any unfinished matches no
+// instance owns.
+//
+// Without REDIS_URL, the store lives in memory, so it is written to STORE_SNAPSHOT (by default,
+// chrss-store.json in the system temp directory) at shutdown and read back on the next boot.
+
+const (
+	shutdownTimeout     = 20 * time.Second // Heroku kills the process 30 seconds after SIGTERM
+	socketCloseWait     = 5 * time.Second  // time allowed for close frames to go out
+	restartNotice       = "The server is restarting. You will be reconnected shortly."
+	restartCloseText    = "Server restarting, reconnect shortly."
+	defaultSnapshotName = "chrss-store.json"
+)
+
+var errShuttingDown = errors.New("The server is restarting. Try again shortly.")
+
+func (cl *Cluster) shuttingDown() bool {
+	return atomic.LoadInt32(&cl.draining) != 0
+}
+
+func storeSnapshotPath() string {
+	if path := os.Getenv("STORE_SNAPSHOT"); path != "" {
+		return path
+	}
+	return filepath.Join(os.TempDir(), defaultSnapshotName)
+}
+
+// serve until SIGTERM or SIGINT, then shut down gracefully
+func (cl *Cluster) serve(server *http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("server failed", "err", err)
+			os.Exit(1)
+		}
+	}()
+	sig := <-signals
+	logger.Info("shutting down", "signal", sig.String())
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	cl.shutdown(ctx, server)
+	logger.Info("shut down")
+}
+
+func (cl *Cluster) shutdown(ctx context.Context, server *http.Server) {
+	atomic.StoreInt32(&cl.draining, 1)
+	for _, m := range cl.Matches.List() {
+		cl.handOff(m)
+	}
+	cl.Store.ReleaseMatch(matchmakerLease, cl.ID)
+
+	closeAllSockets(closeRestartingCode, restartCloseText)
+	deadline := time.Now().Add(socketCloseWait)
+	for openSocketCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	// (hijacked websocket connections are not waited on by Shutdown, hence the above)
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Error("could not shut down http server", "err", err)
+	}
+
+	if store, ok := cl.Store.(*memoryStore); ok {
+		path := storeSnapshotPath()
+		if err := store.writeSnapshot(path); err != nil {
+			logger.Error("could not write store snapshot", "path", path, "err", err)
+		} else {
+			logger.Info("wrote store snapshot", "path", path)
+		}
+	}
+}
+
+// save the match for the next owner, and stop running it
+func (cl *Cluster) handOff(m *Match) {
+	m.Mutex.Lock()
+	m.ShutdownTime = time.Now().UnixNano() // (also stops the clock and event processing; see stopped)
+	m.sendNotice(NoticePayload{restartNotice})
+	for _, conn := range []*Client{m.WhiteConn, m.BlackConn} {
+		if conn != nil {
+			conn.close(closeRestartingCode, restartCloseText)
+		}
+	}
+	for conn := range m.Spectators {
+		conn.close(closeRestartingCode, restartCloseText)
+	}
+	m.Mutex.Unlock()
+
+	cl.saveMatch(m)
+
+	m.Mutex.Lock()
+	m.disowned = true // (no saves after the lease is released)
+	m.Mutex.Unlock()
+	cl.Matches.Delete(m.Name)
+	if err := cl.Store.ReleaseMatch(m.Name, cl.ID); err != nil {
+		m.logger().Error("could not release match", "err", err)
+	}
+	m.logger().Info("handed off match")
+}
+
+// true once this instance no longer runs the match (taken over, reaped, or handed off at shutdown)
+// assumes match mutex is held
+func (m *Match) stopped() bool {
+	return m.disowned || m.reaped || m.ShutdownTime != 0
+}
+
+// shift the clocks of a match handed off at shutdown past the downtime
+// (should be called once, when the match is restored)
+func (m *Match) resumeAfterShutdown(now int64) {
+	if m.ShutdownTime == 0 {
+		return
+	}
+	downtime := now - m.ShutdownTime
+	if downtime > 0 {
+		m.LastMoveTime += downtime
+		if m.RoundStartTime != 0 {
+			m.RoundStartTime += downtime
+		}
+	}
+	m.ShutdownTime = 0
+}
+
+// take over the unfinished matches no instance owns (e.g. those handed off by the previous boot)
+func (cl *Cluster) restoreMatches() {
+	summaries, err := cl.listSummaries()
+	if err != nil {
+		logger.Error("could not list matches", "err", err)
+		return
+	}
+	for _, summary := range summaries {
+		if summary.Phase == gameoverPhase {
+			continue // (the reaper archives these)
+		}
+		if owner, err := cl.Store.MatchOwner(summary.Name); err != nil || owner != "" {
+			continue
+		}
+		m, _, err := cl.localMatch(summary.Name)
+		if err != nil {
+			logger.Error("could not restore match", "match", summary.Name, "err", err)
+			continue
+		}
+		if m != nil {
+			m.logger().Info("restored match")
+		}
+	}
+}
+
+// the contents of the in-memory store (less leases and the queue, which don't outlive the instance)
+type storeSnapshot struct {
+	Matches    map[string][]byte
+	Summaries  map[string][]byte
+	Users      map[string][]byte
+	UserNumber int64
+	UserKeys   map[string]map[string]string
+	Results    map[string]bool
+	Ratings    map[string]map[string][]byte
+	Changes    map[string][][]byte
+	Records    map[string][][]byte
+	Replays    map[string][][]byte
+}
+
+func (s *memoryStore) writeSnapshot(path string) error {
+	s.Lock()
+	bytes, err := json.Marshal(storeSnapshot{
+		Matches:    s.matches,
+		Summaries:  s.summaries,
+		Users:      s.users,
+		UserNumber: s.userNumber,
+		UserKeys:   s.userKeys,
+		Results:    s.results,
+		Ratings:    s.ratings,
+		Changes:    s.changes,
+		Records:    s.records,
+		Replays:    s.replays,
+	})
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+	// (written aside and renamed, so a partly written snapshot is never read)
+	temp := path + ".tmp"
+	if err := ioutil.WriteFile(temp, bytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// load the snapshot, if there is one, and delete it (so it is restored only once)
+func (s *memoryStore) readSnapshot(path string) error {
+	bytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snapshot storeSnapshot
+	if err := json.Unmarshal(bytes, &snapshot); err != nil {
+		return err
+	}
+	s.Lock()
+	for name, bytes := range snapshot.Matches {
+		s.matches[name] = bytes
+	}
+	for name, bytes := range snapshot.Summaries {
+		s.summaries[name] = bytes
+	}
+	for id, bytes := range snapshot.Users {
+		s.users[id] = bytes
+	}
+	if snapshot.UserNumber > s.userNumber {
+		s.userNumber = snapshot.UserNumber
+	}
+	for index, keys := range snapshot.UserKeys {
+		s.userKeys[index] = keys
+	}
+	for name, recorded := range snapshot.Results {
+		s.results[name] = recorded
+	}
+	for pool, ratings := range snapshot.Ratings {
+		s.ratings[pool] = ratings
+	}
+	for id, changes := range snapshot.Changes {
+		s.changes[id] = changes
+	}
+	for id, records := range snapshot.Records {
+		s.records[id] = records
+	}
+	for name, replay := range snapshot.Replays {
+		s.replays[name] = replay
+	}
+	s.Unlock()
+	return os.Remove(path)
+}
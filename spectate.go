@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// a state message held back until the spectator delay has elapsed
+type delayedMessage struct {
+	SendTime int64 // unix nano
+	Type     string
+	Payload  json.RawMessage
+	Snapshot json.RawMessage // full state as of this message (for spectators who join after it is sent)
+}
+
+// the state as seen by spectators: only public information
+// (no cards, highlights, or king placements not yet revealed)
+func (m *Match) spectatorState(newTurn bool, newRound bool) gin.H {
+	state := gin.H{
+		"spectator":                 true,
+		"turnRemainingMilliseconds": m.turnRemaining() / int64(time.Millisecond),
+		"color":                     white, // spectators view the board from white's side
+		"board":                     m.Board.Pieces,
+		"boardStatus":               m.SquareStatuses,
+		"private":                   PrivateState{Cards: []Card{}, PlayableCards: []bool{}, SelectedCard: -1},
+		"turn":                      m.Turn,
+		"newTurn":                   newTurn,
+		"winner":                    m.Winner,
+		"endReason":                 m.EndReason,
+		"drawOffer":                 m.DrawOffer,
+		"maxRounds":                 m.MaxRounds,
+		"round":                     m.Round,
+		"newRound":                  newRound,
+		"blackPublic":               m.BlackPublic,
+		"whitePublic":               m.WhitePublic,
+		"phase":                     m.Phase,
+		"firstTurnColor":            m.FirstTurnColor,
+		"log":                       m.Log,
+		"whitePresence":             m.presence(white),
+		"blackPresence":             m.presence(black),
+		"spectators":                len(m.Spectators),
+		"rematch":                   m.Rematch,
+		"series":                    m.seriesScore(),
+		"chat":                      m.Chat,
+	}
+	if m.TimeBank > 0 {
+		state["whiteTimeBankMilliseconds"] = m.timeBankRemaining(white) / int64(time.Millisecond)
+		state["blackTimeBankMilliseconds"] = m.timeBankRemaining(black) / int64(time.Millisecond)
+	}
+	return state
+}
+
+// send public state to all spectators (after the spectator delay, if any), and record it for the replay
+// assumes match mutex is held
+func (m *Match) sendSpectators(newTurn bool, newRound bool) {
+	m.recordReplayFrame()
+	if len(m.Spectators) == 0 {
+		return
+	}
+	state := m.spectatorState(newTurn, newRound)
+	msg := delayedMessage{SendTime: time.Now().UnixNano() + m.SpectatorDelay}
+	var err error
+	if m.spectatorView == nil {
+		m.spectatorView = &clientView{}
+		msg.Type = snapshotMsg
+		msg.Payload, err = json.Marshal(m.spectatorView.snapshot(state))
+	} else {
+		msg.Type = diffMsg
+		msg.Payload, err = json.Marshal(m.spectatorView.diff(state))
+	}
+	if err != nil {
+		logger.Error("could not JSON encode spectator state", "err", err)
+		return
+	}
+	msg.Snapshot, err = json.Marshal(SnapshotPayload{m.spectatorView.seq, state})
+	if err != nil {
+		logger.Error("could not JSON encode spectator snapshot", "err", err)
+		return
+	}
+	m.spectatorBacklog = append(m.spectatorBacklog, msg)
+	if m.SpectatorDelay == 0 {
+		m.flushSpectatorBacklog()
+	}
+}
+
+// send delayed messages which are now due
+// assumes match mutex is held
+func (m *Match) flushSpectatorBacklog() {
+	now := time.Now().UnixNano()
+	i := 0
+	for ; i < len(m.spectatorBacklog) && m.spectatorBacklog[i].SendTime <= now; i++ {
+		msg := m.spectatorBacklog[i]
+		bytes, err := m.spectatorOutbox.add(msg.Type, 0, msg.Payload)
+		if err != nil {
+			logger.Error("could not JSON encode spectator message", "err", err)
+			continue
+		}
+		m.lastSpectatorSnapshot = msg.Snapshot
+		for conn := range m.Spectators {
+			conn.queue(bytes)
+		}
+	}
+	m.spectatorBacklog = m.spectatorBacklog[i:]
+}
+
+// send the spectator chat to all spectators (without the spectator delay)
+// assumes match mutex is held
+func (m *Match) sendSpectatorChat() {
+	if len(m.Spectators) == 0 {
+		return
+	}
+	bytes, err := m.spectatorOutbox.add(spectatorChatMsg, 0, SpectatorChatPayload{m.SpectatorChat})
+	if err != nil {
+		logger.Error("could not JSON encode spectator chat", "err", err)
+		return
+	}
+	for conn := range m.Spectators {
+		conn.queue(bytes)
+	}
+}
+
+// returns false if match is at max spectators
+// assumes match mutex is held
+// lastSeq is seq of last message seen by a reconnecting spectator (-1 for new spectator)
+func (m *Match) addSpectator(conn *Client, lastSeq int64) bool {
+	if len(m.Spectators) >= maxSpectators {
+		return false
+	}
+	if m.Spectators == nil {
+		m.Spectators = make(map[*Client]bool)
+	}
+	m.Spectators[conn] = true
+	// new spectator starts from the last snapshot and is then sent the same diffs as the others
+	// (if nothing has yet been sent to spectators, the next message sent is a snapshot)
+	if !m.resumeSpectator(conn, lastSeq) {
+		m.sendSpectatorSnapshot(conn)
+		if len(m.SpectatorChat) > 0 {
+			// (the others are sent the chat again too)
+			m.sendSpectatorChat()
+		}
+	}
+	m.sendSpectators(false, false)
+	// players see the new spectator count
+	m.sendState(white, false, false)
+	m.sendState(black, false, false)
+	return true
+}
+
+// assumes match mutex is held
+func (m *Match) removeSpectator(conn *Client) {
+	delete(m.Spectators, conn)
+	delete(m.spectatorChatLimiters, conn)
+	m.sendSpectators(false, false)
+	m.sendState(white, false, false)
+	m.sendState(black, false, false)
+}
+
+// does nothing if spectators have not yet been sent anything
+// assumes match mutex is held
+func (m *Match) sendSpectatorSnapshot(conn *Client) {
+	if m.lastSpectatorSnapshot == nil {
+		return
+	}
+	// numbered as the last message sent to spectators (the state it represents)
+	bytes, err := encodeServerMessage(snapshotMsg, m.spectatorOutbox.seq, 0, json.RawMessage(m.lastSpectatorSnapshot))
+	if err != nil {
+		logger.Error("could not JSON encode spectator snapshot", "err", err)
+		return
+	}
+	conn.queue(bytes)
+}
+
+// spectators cannot send events other than get_state (to resync after a gap) and chat
+func spectatorMessage(data []byte, match *Match, conn *Client) {
+	var msg ClientMessage
+	if json.Unmarshal(data, &msg) != nil {
+		return
+	}
+	switch msg.Type {
+	case "get_state":
+		match.Mutex.Lock()
+		match.sendSpectatorSnapshot(conn)
+		match.Mutex.Unlock()
+	case "chat":
+		match.Mutex.Lock()
+		match.guard("spectator chat", func() {
+			if match.spectatorChat(conn, msg.Payload) {
+				match.sendSpectatorChat()
+			}
+		})
+		match.Mutex.Unlock()
+	}
+}
+
+// read-only connection for a spectator (?invite=<token> for a private match)
+// (the owner checks whether the user may watch)
+func (cl *Cluster) watchSocket(c *gin.Context) {
+	if cl.shuttingDown() {
+		c.String(http.StatusServiceUnavailable, errShuttingDown.Error())
+		return
+	}
+	user, err := cl.currentUser(c)
+	if err != nil {
+		logger.Error("could not identify user", "err", err)
+		c.String(http.StatusInternalServerError, "Could not identify user.")
+		return
+	}
+	name := c.Param("name")
+	match, owner, err := cl.localMatch(name)
+	if err != nil {
+		logger.Error("could not load match", "match", name, "err", err)
+	}
+	if match == nil && owner == "" {
+		c.String(http.StatusNotFound, "No match with id '%s' exists.", name)
+		return
+	}
+	invite := c.Query("invite")
+	if match != nil {
+		match.Mutex.RLock()
+		allowed := match.canWatch(user.ID, invite)
+		match.Mutex.RUnlock()
+		// a private match doesn't exist for those without the invite
+		if !allowed {
+			c.String(http.StatusNotFound, "No match with id '%s' exists.", name)
+			return
+		}
+	}
+	wsConn, err := wsupgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		logger.Error("could not upgrade to websocket", "err", err)
+		return
+	}
+	lastSeq := parseLastSeq(c.Query("lastSeq"))
+	if match == nil {
+		conn := newClient(wsConn, connLabel(name, "")+" (relayed)")
+		cl.relay(conn, func(handle func([]byte), limited func([]byte)) {
+			cl.readMessages(wsConn, conn, user.ID, handle, limited)
+		}, name, owner, "", user.ID, user.Name, invite, lastSeq)
+		return
+	}
+	conn := newClient(wsConn, connLabel(name, ""))
+	conn.Name = user.Name
+	match.Mutex.Lock()
+	if !match.addSpectator(conn, lastSeq) {
+		match.Mutex.Unlock()
+		conn.close(websocket.CloseTryAgainLater, "Match is at max spectators.")
+		return
+	}
+	match.Mutex.Unlock()
+	cl.saveMatch(match)
+
+	cl.readMessages(wsConn, conn, user.ID, func(data []byte) {
+		spectatorMessage(data, match, conn)
+	}, nil)
+
+	match.Mutex.Lock()
+	conn.close(websocket.CloseNormalClosure, "")
+	match.removeSpectator(conn)
+	match.Mutex.Unlock()
+	cl.saveMatch(match)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// a server with only the spectator route, and the cluster behind it
+func startWatchServer(t *testing.T) (*Cluster, string) {
+	t.Helper()
+	sessionSecret = []byte("test secret")
+	cl := &Cluster{
+		ID:          "test",
+		Store:       newMemoryStore(),
+		Bus:         newMemoryBus(),
+		Matches:     NewMatchMap(),
+		relayQueues: make(map[string]*relayQueue),
+		userBuckets: NewUserBuckets(),
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/ws-watch/:name", cl.authenticateBot, cl.watchSocket)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return cl, "ws" + strings.TrimPrefix(server.URL, "http") + "/ws-watch/"
+}
+
+func TestWatchPrivateMatch(t *testing.T) {
+	cl, url := startWatchServer(t)
+	player := &User{ID: "player", Name: "player", Created: time.Now().UnixNano()}
+	if err := cl.saveUser(player); err != nil {
+		t.Fatal(err)
+	}
+	newWatched := func(name string, private bool) *Match {
+		m := newMatch(player.Name)
+		m.Name = name
+		m.WhitePlayerID = player.ID
+		if err := m.restrict(private, ""); err != nil {
+			t.Fatal(err)
+		}
+		cl.Matches.Store(m)
+		return m
+	}
+	private := newWatched("Private-Match", true)
+	newWatched("Public-Match", false)
+
+	playerSession := sessionCookie + "=" + signSession(player.ID, time.Now().Add(time.Hour))
+	tests := []struct {
+		name    string
+		path    string
+		cookie  string
+		allowed bool
+	}{
+		{"stranger to private match", "Private-Match", "", false},
+		{"stranger with wrong invite", "Private-Match?invite=wrong", "", false},
+		{"stranger with invite", "Private-Match?invite=" + private.InviteToken, "", true},
+		{"player of private match", "Private-Match", playerSession, true},
+		{"stranger to public match", "Public-Match", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			if test.cookie != "" {
+				header.Set("Cookie", test.cookie)
+			}
+			conn, response, err := websocket.DefaultDialer.Dial(url+test.path, header)
+			if conn != nil {
+				conn.Close()
+			}
+			if test.allowed && err != nil {
+				t.Fatalf("refused: %v", err)
+			}
+			if !test.allowed && (err == nil || response == nil || response.StatusCode != http.StatusNotFound) {
+				t.Fatalf("got %v (%v), want a 404", response, err)
+			}
+		})
+	}
+}
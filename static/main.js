@@ -20,6 +20,27 @@ var log = document.getElementById('log');
 var logBox = document.getElementById('log_box');
 var readyup = document.getElementById('readyup');
 var readyupButton = document.querySelector('#readyup > button');
+var resignButton = document.getElementById('resign_button');
+var offerDrawButton = document.getElementById('offer_draw_button');
+var drawOffered = document.getElementById('draw_offered');
+var acceptDrawButton = document.getElementById('accept_draw_button');
+var declineDrawButton = document.getElementById('decline_draw_button');
+var rematchButton = document.getElementById('rematch_button');
+var rematchOffered = document.getElementById('rematch_offered');
+var declineRematchButton = document.getElementById('decline_rematch_button');
+var seriesScore = document.getElementById('series_score');
+var chat = document.getElementById('chat');
+var spectatorChat = document.getElementById('spectator_chat');
+var muteButton = document.getElementById('mute_button');
+var chatForm = document.getElementById('chat_form');
+var chatInput = document.getElementById('chat_input');
+var opponentPresence = document.getElementById('opponent_presence');
+var errorMessage = document.getElementById('error_message');
+var inviteLink = document.querySelector('#invite_link > a');
+var notice = document.getElementById('notice');
+var replayControls = document.getElementById('replay_controls');
+var replayPosition = document.getElementById('replay_position');
+var replayPlayButton = document.getElementById('replay_play');
 
 var matchState;
 
@@ -187,28 +208,159 @@ var cardDescriptions = {
 };
 
 
-var matchId = window.location.pathname.substring(7);
-var url = 'wss://chrss-game.herokuapp.com/ws/' + matchId;   
+// spectators load this page from /watch/:name rather than /match/:name/:color
+var spectating = window.location.pathname.startsWith('/watch/');
+// and finished matches are replayed from /replay/:name
+var replaying = window.location.pathname.startsWith('/replay/');
+var matchId = window.location.pathname.substring(replaying ? 8 : 7);
+var wsPath = spectating ? '/ws-watch/' : '/ws/';
+var url = 'wss://chrss-game.herokuapp.com' + wsPath + matchId;   
 if (location.hostname == 'localhost') {
-    url = 'ws://localhost:5000/ws/' + matchId;  // can't do wss over localhost it seems?
+    url = 'ws://localhost:5000' + wsPath + matchId;  // can't do wss over localhost it seems?
+}
+// from the join page, when the match is private or has a password
+var seatGrant = new URLSearchParams(window.location.search).get('grant');
+// spectators of a private match come with its invite
+var spectatorInvite = new URLSearchParams(window.location.search).get('invite');
+var conn;
+var lastMessageSeq = 0; // seq of last message received from server (sent when reconnecting)
+var reconnectDelay = 1000;
+const maxReconnectDelay = 16000;
+const closeReplacedCode = 4001; // must match server: this tab's connection was replaced by another
+const closeRejectedCode = 4002; // must match server: another player has this seat
+const closeMatchEndedCode = 4003; // must match server: the match is over and has been cleaned up
+const closePolicyViolationCode = 1008; // server cut us off (e.g. for sending too many messages)
+const closeRestartingCode = 4004; // must match server: the server is restarting, and the match resumes after
+const restartReconnectDelay = 3000; // time for the restarted (or another) server to take up the match
+
+function connect() {
+    var params = new URLSearchParams();
+    if (seatGrant) {
+        params.set('grant', seatGrant);
+    }
+    if (spectatorInvite) {
+        params.set('invite', spectatorInvite);
+    }
+    if (lastMessageSeq > 0) {
+        params.set('lastSeq', lastMessageSeq);
+    }
+    var resumeUrl = url;
+    if (params.toString()) {
+        resumeUrl += '?' + params.toString();
+    }
+    conn = new WebSocket(resumeUrl);
+    conn.onmessage = onMessage;
+    conn.onerror = onError;
+    conn.onclose = onClose;
+    conn.onopen = onOpen;
 }
-var conn = new WebSocket(url);
 
 
 var waitingResponse = false;
 
-conn.onmessage = function(msg){
+// must match protocolVersion in server code
+const protocolVersion = 1;
+var nextSeq = 1;
+
+// payload may be omitted for messages which take none
+function send(type, payload) {
+    var msg = {v: protocolVersion, type: type, seq: nextSeq++};
+    if (payload !== undefined) {
+        msg.payload = payload;
+    }
+    conn.send(JSON.stringify(msg));
+}
+
+var serverState;      // state as last sent by the server
+var lastStateSeq = 0;  // seq of last snapshot or diff applied to serverState
+var resyncing = false; // true while waiting for requested snapshot
+var spectatorChatMessages = []; // sent apart from the state (which spectators get after the spectator delay)
+
+// returns false if the diff cannot be applied (in which case a new snapshot is requested)
+function applyDiff(diff) {
+    if (resyncing) {
+        return false; // discard diffs until snapshot arrives
+    }
+    if (!serverState || diff.baseSeq !== lastStateSeq) {
+        console.log('missed state: have ' + lastStateSeq + ', diff based on ' + diff.baseSeq);
+        resyncing = true;
+        send("get_state");
+        return false;
+    }
+    for (var field in diff.fields) {
+        serverState[field] = diff.fields[field];
+    }
+    for (var idx in diff.squares) {
+        serverState.board[idx] = diff.squares[idx];
+    }
+    for (var idx in diff.statuses) {
+        serverState.boardStatus[idx] = diff.statuses[idx];
+    }
+    if (diff.log) {
+        serverState.log = serverState.log.concat(diff.log);
+    }
+    lastStateSeq = diff.seq;
+    return true;
+}
+
+function onMessage(msg) {
     console.log(" <== " + new Date() + " <== \n");
     console.log(msg);
 
-    var response = JSON.parse(msg.data);
-    if (response === "ping") {
-        return;
+    var envelope = JSON.parse(msg.data);
+    if (envelope.type === 'snapshot') {
+        // a snapshot carries the seq of the message whose state it represents
+        lastMessageSeq = envelope.seq;
+    } else if (envelope.seq <= lastMessageSeq) {
+        return; // already seen
+    } else {
+        lastMessageSeq = envelope.seq;
     }
-    matchState = response;
-    if (matchState.error) {
-        alert(matchState.error);  // todo: use overlay instead of alert
+    switch (envelope.type) {
+        case 'ack':
+            return;
+        case 'error':
+            console.log('request ' + envelope.replyTo + ' rejected: ', envelope.payload);
+            errorMessage.innerHTML = envelope.payload.message;
+            waitingResponse = false;
+            return;
+        case 'snapshot':
+            resyncing = false;
+            serverState = envelope.payload.state;
+            if (!serverState.log) {
+                serverState.log = [];
+            }
+            lastStateSeq = envelope.payload.seq;
+            break;
+        case 'diff':
+            if (!applyDiff(envelope.payload)) {
+                return;
+            }
+            break;
+        case 'spectator_chat':
+            spectatorChatMessages = envelope.payload.chat || [];
+            if (!serverState) {
+                return;
+            }
+            break;
+        case 'notice':
+            // from the administrators (e.g. of upcoming maintenance); shown until the next notice
+            notice.textContent = envelope.payload.message;
+            notice.style.display = 'block';
+            return;
+        default:
+            console.log('unknown message type: ' + envelope.type);
+            return;
     }
+    showState(serverState);
+    waitingResponse = false;
+}
+
+function showState(state) {
+    // matchState is modified for display, so we keep serverState as the base for diffs
+    matchState = Object.assign({}, state);
+    matchState.board = state.board.slice();
+    errorMessage.innerHTML = '';
 
     if (matchState.color === 'black') {
         matchState.public = matchState.blackPublic;
@@ -220,14 +372,24 @@ conn.onmessage = function(msg){
         let idx = kingPos.x + kingPos.y * board.nColumns;
         matchState.board[idx] = matchState.public.king;
     }
-    if (!matchState.log) {
-        matchState.log = [];
-    }
     setTimers(matchState);
     draw(matchState);
 
     updateSquareInfoBox(boardClientX, boardClientY);
 
+    if (replaying) {
+        return;
+    }
+    // follow the players to the rematch
+    if (matchState.rematch) {
+        if (spectating) {
+            // (the rematch has the same invite)
+            window.location.replace('/watch/' + matchState.rematch + window.location.search);
+        } else {
+            window.location.replace('/match/' + matchState.rematch + '/' + otherColor(matchState.color));
+        }
+        return;
+    }
     // sounds
     try {
         if (matchState.newRound) {
@@ -245,23 +407,118 @@ conn.onmessage = function(msg){
     } catch (ex) {
         console.log(ex);
     }
-
-    waitingResponse = false;
 }
 
-conn.onerror = function(err) {
+function onError(err) {
     console.log("Connection error " + new Date() + " error: ", err);
     console.log(err);
 }
 
-conn.onclose = function(err) {
-    console.log("Connection close " + new Date(), err);
+function onClose(evt) {
+    console.log("Connection close " + new Date(), evt);
     readyup.style.display = 'block';
-    readyup.innerHTML = '<div>CONNECTION LOST.<br/>DID YOU JOIN THIS MATCH IN ANOTHER BROWSER TAB?<br/>REFRESH TO RECONNECT</div>';
+    if (evt.code === closeReplacedCode) {
+        readyup.innerHTML = '<div>CONNECTION LOST.<br/>DID YOU JOIN THIS MATCH IN ANOTHER BROWSER TAB?<br/>REFRESH TO RECONNECT</div>';
+        return;
+    }
+    if (evt.code === closeRejectedCode || evt.code === closeMatchEndedCode || evt.code === closePolicyViolationCode) {
+        readyup.innerHTML = '<div>' + evt.reason.toUpperCase() + '</div>';
+        return;
+    }
+    if (evt.code === closeRestartingCode) {
+        readyup.innerHTML = '<div>SERVER RESTARTING. RECONNECTING...</div>';
+        reconnectDelay = Math.max(reconnectDelay, restartReconnectDelay);
+    } else {
+        readyup.innerHTML = '<div>CONNECTION LOST. RECONNECTING...</div>';
+    }
+    // resume where we left off (server replays the messages we missed)
+    window.setTimeout(connect, reconnectDelay);
+    reconnectDelay = Math.min(reconnectDelay * 2, maxReconnectDelay);
 }
 
-conn.onopen = function(){
-    conn.send("get_state ");
+function onOpen() {
+    // (server sends a snapshot or the missed messages upon connection, so there's no need to request state)
+    reconnectDelay = 1000;
+    if (matchState) {
+        draw(matchState); // clear the connection lost notice
+    }
+}
+
+// each replay frame has only the log entries added since the previous frame
+var replayFrames = [];
+var replayIdx = 0;
+var replayTimerHandle;
+const replayStepInterval = 1500;
+
+function loadReplay() {
+    fetch('/replay/' + matchId + '/frames').then(function (response) {
+        if (!response.ok) {
+            throw new Error('no replay');
+        }
+        return response.json();
+    }).then(function (frames) {
+        var log = [];
+        replayFrames = frames.map(function (frame) {
+            log = log.concat(frame.log);
+            return Object.assign({}, frame, {log: log, replay: true});
+        });
+        replayControls.style.display = 'block';
+        showReplayFrame(0);
+    }).catch(function (err) {
+        readyup.style.display = 'block';
+        readyup.innerHTML = '<div>NO REPLAY OF THIS MATCH</div>';
+    });
+}
+
+function showReplayFrame(idx) {
+    replayIdx = Math.max(0, Math.min(idx, replayFrames.length - 1));
+    replayPosition.innerHTML = (replayIdx + 1) + ' / ' + replayFrames.length;
+    showState(replayFrames[replayIdx]);
+    if (replayIdx === replayFrames.length - 1) {
+        stopReplay();
+    }
+}
+
+function stopReplay() {
+    window.clearInterval(replayTimerHandle);
+    replayTimerHandle = undefined;
+    replayPlayButton.innerHTML = 'Play';
+}
+
+document.getElementById('replay_first').addEventListener('click', function (evt) {
+    stopReplay();
+    showReplayFrame(0);
+});
+document.getElementById('replay_prev').addEventListener('click', function (evt) {
+    stopReplay();
+    showReplayFrame(replayIdx - 1);
+});
+document.getElementById('replay_next').addEventListener('click', function (evt) {
+    stopReplay();
+    showReplayFrame(replayIdx + 1);
+});
+document.getElementById('replay_last').addEventListener('click', function (evt) {
+    stopReplay();
+    showReplayFrame(replayFrames.length - 1);
+});
+replayPlayButton.addEventListener('click', function (evt) {
+    if (replayTimerHandle !== undefined) {
+        stopReplay();
+        return;
+    }
+    if (replayIdx === replayFrames.length - 1) {
+        showReplayFrame(0);
+    }
+    replayPlayButton.innerHTML = 'Pause';
+    replayTimerHandle = window.setInterval(function () {
+        showReplayFrame(replayIdx + 1);
+    }, replayStepInterval);
+});
+
+if (replaying) {
+    loadReplay();
+} else {
+    connect();
 }
 
 // account for pixel ratio (avoids blurry text on high dpi screens)
@@ -292,17 +549,65 @@ function draw(matchState) {
     drawStatusIcons(ctx, matchState);
     drawSquareHighlight(ctx, matchState);
     drawWait(ctx, matchState);
-    drawWinner(ctx, matchState.winner);
+    drawWinner(ctx, matchState);
     drawCards(matchState);
     drawScoreboard(scoreboardCtx, matchState);
     drawButtons(matchState);
+    drawMatchControls(matchState);
     drawTimer(matchState);
     drawReadyUp(matchState);
+    drawInviteLink(matchState);
     drawLog(matchState);
+    drawChat(matchState);
+
+    function drawChat(matchState) {
+        var chatBox = chat.parentElement;
+        if (matchState.replay) {
+            chatBox.style.display = 'none';
+            return;
+        }
+        chatBox.style.display = 'block';
+        chat.innerHTML = chatEntries(matchState.chat || [], function (from) {
+            return (from === matchState.color) ? 'you' : from;
+        });
+        chat.scrollTop = chat.scrollHeight;
+        muteButton.style.display = matchState.spectator ? 'none' : 'inline';
+        muteButton.innerHTML = matchState.muted ? 'Unmute opponent' : 'Mute opponent';
+        if (matchState.spectator) {
+            document.getElementById('spectator_chat_heading').style.display = 'block';
+            spectatorChat.style.display = 'block';
+            spectatorChat.innerHTML = chatEntries(spectatorChatMessages, function (from) {
+                return from;
+            });
+            spectatorChat.scrollTop = spectatorChat.scrollHeight;
+        }
+    }
+
+    function chatEntries(messages, senderName) {
+        var s = '';
+        for (var i = 0; i < messages.length; i++) {
+            var msg = messages[i];
+            var cls = msg.emote ? 'chat_entry chat_emote' : 'chat_entry';
+            s += '<div class="' + cls + '"><b>' + escapeHTML(senderName(msg.from)) + ':</b> ' + escapeHTML(msg.text) + '</div>';
+        }
+        return s;
+    }
+
+    function drawInviteLink(matchState) {
+        if (matchState.inviteLink) {
+            inviteLink.href = matchState.inviteLink;
+            inviteLink.innerHTML = window.location.origin + matchState.inviteLink;
+            inviteLink.parentElement.style.display = 'block';
+        } else {
+            inviteLink.parentElement.style.display = 'none';
+        }
+    }
 
     function drawReadyUp(matchState) {
         if (matchState.phase === 'readyUp') {
-            if (matchState.public.ready) {
+            if (matchState.spectator) {
+                readyup.innerHTML = '<div>WAITING FOR PLAYERS TO READY UP</div>';
+            } else if (matchState.public.ready) {
                 readyup.innerHTML = '<div>WAITING FOR OTHER PLAYER TO READY UP</div>';
             }
             readyup.style.display = 'block';
@@ -312,6 +617,18 @@ function draw(matchState) {
     }
 
     function drawButtons(matchState) {
+        if (matchState.replay) {
+            passButton.style.visibility = 'hidden';
+            waitOpponent.innerHTML = 'Replay';
+            waitOpponent.style.visibility = 'visible';
+            return;
+        }
+        if (matchState.spectator) {
+            passButton.style.visibility = 'hidden';
+            waitOpponent.innerHTML = 'Spectating (' + matchState.spectators + ' watching)';
+            waitOpponent.style.visibility = 'visible';
+            return;
+        }
         switch (matchState.phase) {
             case 'readyUp':
                 waitOpponent.style.visibility = 'hidden';
@@ -341,6 +658,9 @@ function draw(matchState) {
     }
 
     function drawWait(ctx, matchState) {
+        if (matchState.spectator) {
+            return;
+        }
         if ((matchState.phase === 'main' && matchState.turn !== matchState.color) || 
             (matchState.phase === 'kingPlacement' && matchState.public.kingPlayed)) {
             ctx.fillStyle = 'rgba(20, 30, 100, 0.30)';
@@ -348,19 +668,81 @@ function draw(matchState) {
         }
     }
 
-    function drawWinner(ctx, winner) {
-        if (winner === "none") {
+    function drawWinner(ctx, matchState) {
+        if (matchState.phase !== 'gameover') {
             return
         }
         ctx.fillStyle = 'rgba(0, 0, 0, 0.65)';
         ctx.fillRect(0, 0, board.width, board.height);
 
-        var messages = {"black": "Black Wins", "white": "White Wins", "draw": "Draw! Nobody Wins"};
+        var messages = {"black": "Black Wins", "white": "White Wins", "draw": "Draw! Nobody Wins", "none": "Match Ended"};
         
         ctx.fillStyle = "white";
         ctx.font = "60px Arial";
         ctx.textAlign = "center";
-        ctx.fillText(messages[winner], board.width / 2, board.height / 2 + 20);
+        ctx.fillText(messages[matchState.winner], board.width / 2, board.height / 2 + 20);
+        if (matchState.endReason) {
+            ctx.font = "30px Arial";
+            ctx.fillText('by ' + matchState.endReason, board.width / 2, board.height / 2 + 70);
+        }
+    }
+
+    function drawMatchControls(matchState) {
+        var inPlay = !matchState.spectator && (matchState.phase === 'main' || matchState.phase === 'kingPlacement');
+        var opponentOffered = inPlay && matchState.drawOffer !== 'none' && matchState.drawOffer !== matchState.color;
+        resignButton.style.visibility = inPlay ? 'visible' : 'hidden';
+        offerDrawButton.style.visibility = (inPlay && matchState.drawOffer === 'none') ? 'visible' : 'hidden';
+        acceptDrawButton.style.visibility = opponentOffered ? 'visible' : 'hidden';
+        declineDrawButton.style.visibility = opponentOffered ? 'visible' : 'hidden';
+        if (opponentOffered) {
+            drawOffered.innerHTML = 'Opponent offers a draw';
+            drawOffered.style.visibility = 'visible';
+        } else if (inPlay && matchState.drawOffer === matchState.color) {
+            drawOffered.innerHTML = 'Draw offered';
+            drawOffered.style.visibility = 'visible';
+        } else {
+            drawOffered.style.visibility = 'hidden';
+        }
+
+        var over = !matchState.spectator && !matchState.replay && matchState.phase === 'gameover';
+        var opponentAsked = over && matchState.rematchOffer === otherColor(matchState.color);
+        rematchButton.innerHTML = opponentAsked ? 'Accept rematch' : 'Rematch';
+        rematchButton.style.visibility = (over && !matchState.rematch && matchState.rematchOffer !== matchState.color) ? 'visible' : 'hidden';
+        declineRematchButton.style.visibility = opponentAsked ? 'visible' : 'hidden';
+        if (opponentAsked) {
+            rematchOffered.innerHTML = 'Opponent wants a rematch';
+            rematchOffered.style.visibility = 'visible';
+        } else if (over && matchState.rematchOffer === matchState.color) {
+            rematchOffered.innerHTML = 'Rematch requested';
+            rematchOffered.style.visibility = 'visible';
+        } else {
+            rematchOffered.style.visibility = 'hidden';
+        }
+
+        // score is shown once there has been a rematch
+        var series = matchState.series;
+        if (series && (series.games > 1 || (series.games === 1 && matchState.phase !== 'gameover'))) {
+            var draws = series.draws ? ' (' + series.draws + ' drawn)' : '';
+            if (matchState.spectator) {
+                seriesScore.innerHTML = 'Series: white ' + series.whiteWins + ' - ' + series.blackWins + ' black' + draws;
+            } else {
+                var wins = (matchState.color === 'white') ? series.whiteWins : series.blackWins;
+                var losses = (matchState.color === 'white') ? series.blackWins : series.whiteWins;
+                seriesScore.innerHTML = 'Series: you ' + wins + ' - ' + losses + ' opponent' + draws;
+            }
+            seriesScore.style.visibility = 'visible';
+        } else {
+            seriesScore.style.visibility = 'hidden';
+        }
+
+        var presence = (matchState.color === 'black') ? matchState.whitePresence : matchState.blackPresence;
+        var presenceMessages = {'disconnected': 'Opponent disconnected', 'ai': 'Opponent: AI'};
+        if (!matchState.spectator && matchState.phase !== 'gameover' && presenceMessages[presence]) {
+            opponentPresence.innerHTML = presenceMessages[presence];
+            opponentPresence.style.visibility = 'visible';
+        } else {
+            opponentPresence.style.visibility = 'hidden';
+        }
     }
 
     function drawScoreboard(ctx, matchState) {
@@ -739,12 +1121,42 @@ function drawStatusInfo(square, piece) {
 }
 
 
+function escapeHTML(s) {
+    var div = document.createElement('div');
+    div.textContent = s;
+    return div.innerHTML;
+}
+
+function otherColor(color) {
+    return (color === 'white') ? 'black' : 'white';
+}
+
+function fmtClock(milliseconds) {
+    var seconds = Math.max(0, Math.floor(milliseconds / 1000));
+    var remainder = seconds % 60;
+    return Math.floor(seconds / 60) + ':' + ((remainder < 10) ? '0' : '') + remainder;
+}
+
 function drawTimer(match) {
+    if (match.replay) {
+        timer.innerHTML = fmtClock(match.elapsedMilliseconds) + ' into the match';
+        return;
+    }
     switch (matchState.phase) {
         case 'main':
         case 'kingPlacement':
             var seconds = Math.floor(match.turnRemainingMilliseconds / 1000);
-            timer.innerHTML = ((seconds < 0) ? 0 : seconds) + ' seconds';
+            var s = ((seconds < 0) ? 0 : seconds) + ' seconds';
+            if (match.whiteTimeBankMilliseconds !== undefined) {
+                var own = match.whiteTimeBankMilliseconds;
+                var opponent = match.blackTimeBankMilliseconds;
+                if (match.color === 'black') {
+                    own = match.blackTimeBankMilliseconds;
+                    opponent = match.whiteTimeBankMilliseconds;
+                }
+                s += '<br/>you ' + fmtClock(own) + ' / opp ' + fmtClock(opponent);
+            }
+            timer.innerHTML = s;
             break;
     }
 }
@@ -754,13 +1166,13 @@ function drawTimer(match) {
 // *** logic ***
 
 var timerHandle;
-var timeSincePing;
 const interval = 1000;
-const pingInterval = 20000;
 
 function setTimers(match) {
     window.clearInterval(timerHandle);
-    timeSincePing = 0;
+    if (match.replay) {
+        return;
+    }
     
     switch (match.phase) {
         case 'kingPlacement':
@@ -768,20 +1180,16 @@ function setTimers(match) {
             timerHandle = window.setInterval(
                 function () {
                     match.turnRemainingMilliseconds -= interval;
-                    drawTimer(match);
-
-                    // extra half second as cushion (don't want to 
-                    // send too early or else server ignores event)
-                    if (match.turnRemainingMilliseconds + 500 < 0) {
-                        conn.send("time_expired ");
-                        waitingResponse = true;
-                    }
-
-                    timeSincePing += interval;
-                    if (timeSincePing > pingInterval) {
-                        conn.send("ping ");
-                        timeSincePing = 0;
+                    // the server only runs down the bank of the player whose turn it is
+                    if (match.phase === 'main' && match.whiteTimeBankMilliseconds !== undefined) {
+                        if (match.turn === 'white') {
+                            match.whiteTimeBankMilliseconds -= interval;
+                        } else {
+                            match.blackTimeBankMilliseconds -= interval;
+                        }
                     }
+                    drawTimer(match);
+                    // (the server advances the turn itself when the timer expires)
                 },
                 interval
             );
@@ -792,23 +1200,70 @@ function setTimers(match) {
 readyupButton.addEventListener('click', function (evt) {
     switch (matchState.phase) {
         case 'readyUp':
-            conn.send("ready " );
+            send("ready");
             waitingResponse = true;
             break;
     }
 }, false);
 
+resignButton.addEventListener('click', function (evt) {
+    if (confirm('Resign this match?')) {
+        send("resign");
+    }
+}, false);
+
+offerDrawButton.addEventListener('click', function (evt) {
+    send("offer_draw");
+}, false);
+
+acceptDrawButton.addEventListener('click', function (evt) {
+    send("accept_draw");
+}, false);
+
+declineDrawButton.addEventListener('click', function (evt) {
+    send("decline_draw");
+}, false);
+
+chatForm.addEventListener('submit', function (evt) {
+    evt.preventDefault();
+    var text = chatInput.value.trim();
+    if (text === '') {
+        return;
+    }
+    send("chat", {text: text});
+    chatInput.value = '';
+}, false);
+
+document.getElementById('emotes').addEventListener('click', function (evt) {
+    var emote = evt.target.getAttribute('data-emote');
+    if (emote) {
+        send("chat", {emote: emote});
+    }
+}, false);
+
+muteButton.addEventListener('click', function (evt) {
+    send("mute", {muted: !matchState.muted});
+}, false);
+
+rematchButton.addEventListener('click', function (evt) {
+    send("rematch");
+}, false);
+
+declineRematchButton.addEventListener('click', function (evt) {
+    send("decline_rematch");
+}, false);
+
 cardList.addEventListener('mousedown', function (evt) {
     switch (matchState.phase) {
         case 'main':
-            if (waitingResponse || (matchState.color !== matchState.turn)) {
+            if (spectating || waitingResponse || (matchState.color !== matchState.turn)) {
                 return; // not your turn!
             }
             var idx = evt.target.getAttribute('cardIdx');
             if (idx === '' || idx === null) {
                 return;
             }
-            conn.send("click_card " + JSON.stringify({selectedCard: parseInt(idx)}));
+            send("click_card", {selectedCard: parseInt(idx)});
             waitingResponse = true;
             break;
     }
@@ -926,7 +1381,7 @@ canvas.addEventListener('mouseleave', function (evt) {
 }, false);
 
 canvas.addEventListener('mousedown', function (evt) {
-    if (waitingResponse) {
+    if (waitingResponse || spectating) {
         return; // not your turn!
     }
     switch (matchState.phase) {
@@ -959,7 +1414,7 @@ canvas.addEventListener('mousedown', function (evt) {
                 squareY = board.nRows - 1 - squareY;
             }
      
-            conn.send("click_board " + JSON.stringify({x: squareX, y: squareY}));    
+            send("click_board", {x: squareX, y: squareY});    
             waitingResponse = true;
             break;
     }
@@ -0,0 +1,52 @@
+var queueForm = document.getElementById('queue_form');
+var queueButton = document.getElementById('queue_button');
+var leaveButton = document.getElementById('leave_button');
+var queueStatus = document.getElementById('queue_status');
+
+var conn;
+const closeReplacedCode = 4001; // must match server: queued again in another tab
+const closeRestartingCode = 4004; // must match server: the server is restarting
+const restartRejoinDelay = 5000;
+
+function joinQueue() {
+    var params = new URLSearchParams(new FormData(queueForm));
+    var protocol = window.location.protocol === 'https:' ? 'wss://' : 'ws://';
+    conn = new WebSocket(protocol + window.location.host + '/ws-queue?' + params.toString());
+    conn.onmessage = function (msg) {
+        var envelope = JSON.parse(msg.data);
+        switch (envelope.type) {
+            case 'queued':
+                queueStatus.innerHTML = 'Waiting for an opponent... (' + envelope.payload.waiting + ' in queue)';
+                break;
+            case 'matched':
+                queueStatus.innerHTML = 'Opponent found!';
+                window.location.href = '/match/' + envelope.payload.match + '/' + envelope.payload.color;
+                break;
+        }
+    };
+    conn.onclose = function (evt) {
+        queueButton.style.display = 'inline';
+        leaveButton.style.display = 'none';
+        if (evt.code === closeReplacedCode) {
+            queueStatus.innerHTML = 'You joined the queue in another tab.';
+        } else if (evt.code === closeRestartingCode) {
+            // (the queue does not survive the restart, so we join again)
+            queueStatus.innerHTML = 'The server is restarting. Rejoining the queue shortly...';
+            window.setTimeout(joinQueue, restartRejoinDelay);
+        } else if (evt.reason !== 'matched') {
+            queueStatus.innerHTML = evt.reason || 'Left the queue.';
+        }
+    };
+    queueButton.style.display = 'none';
+    leaveButton.style.display = 'inline';
+    queueStatus.innerHTML = 'Joining queue...';
+}
+
+queueForm.addEventListener('submit', function (evt) {
+    evt.preventDefault();
+    joinQueue();
+});
+
+leaveButton.addEventListener('click', function (evt) {
+    conn.close();
+});
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// state shared by all server instances
+// Every instance can see every match, but a match is run (its clock ticked and its events processed)
+// only by the instance which holds its ownership lease. The owner saves the match to the store
+// so that another instance can take it over if the owner goes away.
+type MatchStore interface {
+	// take or renew the ownership lease of the match for instance
+	// returns the owner after the call ("" if none), which is instance only if it now holds the lease
+	AcquireMatch(name string, instance string, ttl time.Duration) (string, error)
+	// give up the lease (does nothing if instance does not hold it)
+	ReleaseMatch(name string, instance string) error
+	// current owner ("" if none)
+	MatchOwner(name string) (string, error)
+	SaveMatch(name string, summary []byte, state []byte) error
+	// nil if no such match
+	LoadMatch(name string) ([]byte, error)
+	// nil if no such match
+	LoadMatchSummary(name string) ([]byte, error)
+	ListMatchSummaries() ([][]byte, error)
+	DeleteMatch(name string) error
+	SaveUser(userID string, user []byte) error
+	// nil if no such user
+	LoadUser(userID string) ([]byte, error)
+	DeleteUser(userID string) error
+	NextUserNumber() (int64, error)
+	// unique keys of users (e.g. display names and emails), each in its own index
+	// claims key for userID if it is free; returns the user holding the key after the call
+	ClaimUserKey(index string, key string, userID string) (string, error)
+	// "" if key is free
+	LookupUserKey(index string, key string) (string, error)
+	// frees key (does nothing if userID does not hold it)
+	ReleaseUserKey(index string, key string, userID string) error
+	// one-time login tokens
+	SaveLoginToken(token string, login []byte, ttl time.Duration) error
+	// returns the login and deletes the token (nil if no such token or it expired)
+	TakeLoginToken(token string) ([]byte, error)
+	// matchmaking queue
+	AddQueueEntry(ticket string, entry []byte) error
+	// replaces entry only if still queued; returns false if not
+	UpdateQueueEntry(ticket string, entry []byte) (bool, error)
+	// returns false if entry was not queued (e.g. already removed by another instance)
+	RemoveQueueEntry(ticket string) (bool, error)
+	ListQueueEntries() ([][]byte, error)
+	// returns true only for the first claim of the match's result (so that it is recorded only once)
+	ClaimResult(name string) (bool, error)
+	// finished matches of a user; keeps only the most recent maxMatchRecords
+	AddMatchRecord(userID string, record []byte) error
+	// oldest first
+	ListMatchRecords(userID string) ([][]byte, error)
+	DeleteMatchRecords(userID string) error
+	// frames are appended as the match is played (and kept for replayRetention after it ends)
+	AddReplayFrames(name string, frames [][]byte) error
+	// oldest first
+	ListReplayFrames(name string) ([][]byte, error)
+	// who may see the replay, saved once the match ends (and kept as long as its frames)
+	SaveReplayAccess(name string, access []byte) error
+	// nil if none was saved
+	LoadReplayAccess(name string) ([]byte, error)
+	SaveRating(pool string, userID string, rating []byte) error
+	// nil if user has no rating in the pool
+	LoadRating(pool string, userID string) ([]byte, error)
+	ListRatings(pool string) ([][]byte, error)
+	ListRatingPools() ([]string, error)
+	DeleteRating(pool string, userID string) error
+	// keeps only the most recent maxRatingChanges
+	AddRatingChange(userID string, change []byte) error
+	// oldest first
+	ListRatingChanges(userID string) ([][]byte, error)
+	DeleteRatingChanges(userID string) error
+}
+
+// delivers messages between instances
+// (delivery is at most once: messages published while no one is subscribed are lost)
+type MessageBus interface {
+	Publish(channel string, message []byte) error
+	// messages published to channel until unsubscribe is called
+	Subscribe(channel string) (messages <-chan []byte, unsubscribe func(), err error)
+}
+
+const subscriptionBufferSize = 256 // messages buffered per subscription before further messages are dropped
+
+// store for a single instance
+type memoryStore struct {
+	sync.Mutex
+	owners     map[string]lease
+	matches    map[string][]byte
+	summaries  map[string][]byte
+	users      map[string][]byte
+	userNumber int64
+	userKeys   map[string]map[string]string // index -> key -> user
+	tokens     map[string]loginToken
+	queue      map[string][]byte
+	results    map[string]bool
+	ratings    map[string]map[string][]byte // pool -> user -> rating
+	changes    map[string][][]byte
+	records    map[string][][]byte
+	replays    map[string][][]byte // (a single instance keeps replays until it restarts)
+	access     map[string][]byte   // replay access
+}
+
+type lease struct {
+	owner  string
+	expiry time.Time
+}
+
+type loginToken struct {
+	login  []byte
+	expiry time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		owners:    make(map[string]lease),
+		matches:   make(map[string][]byte),
+		summaries: make(map[string][]byte),
+		users:     make(map[string][]byte),
+		userKeys:  make(map[string]map[string]string),
+		tokens:    make(map[string]loginToken),
+		queue:     make(map[string][]byte),
+		results:   make(map[string]bool),
+		ratings:   make(map[string]map[string][]byte),
+		changes:   make(map[string][][]byte),
+		records:   make(map[string][][]byte),
+		replays:   make(map[string][][]byte),
+		access:    make(map[string][]byte),
+	}
+}
+
+func (s *memoryStore) AcquireMatch(name string, instance string, ttl time.Duration) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	l, ok := s.owners[name]
+	if ok && l.owner != instance && now.Before(l.expiry) {
+		return l.owner, nil
+	}
+	s.owners[name] = lease{instance, now.Add(ttl)}
+	return instance, nil
+}
+
+func (s *memoryStore) ReleaseMatch(name string, instance string) error {
+	s.Lock()
+	if s.owners[name].owner == instance {
+		delete(s.owners, name)
+	}
+	s.Unlock()
+	return nil
+}
+
+func (s *memoryStore) MatchOwner(name string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	l, ok := s.owners[name]
+	if !ok || time.Now().After(l.expiry) {
+		return "", nil
+	}
+	return l.owner, nil
+}
+
+func (s *memoryStore) SaveMatch(name string, summary []byte, state []byte) error {
+	s.Lock()
+	s.summaries[name] = summary
+	s.matches[name] = state
+	s.Unlock()
+	return nil
+}
+
+func (s *memoryStore) LoadMatch(name string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.matches[name], nil
+}
+
+func (s *memoryStore) LoadMatchSummary(name string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.summaries[name], nil
+}
+
+func (s *memoryStore) ListMatchSummaries() ([][]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	summaries := make([][]byte, 0, len(s.summaries))
+	for _, summary := range s.summaries {
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+func (s *memoryStore) DeleteMatch(name string) error {
+	s.Lock()
+	delete(s.summaries, name)
+	delete(s.matches, name)
+	s.Unlock()
+	return nil
+}
+
+func (s *memoryStore) SaveUser(userID string, user []byte) error {
+	s.Lock()
+	s.users[userID] = user
+	s.Unlock()
+	return nil
+}
+
+func (s *memoryStore) LoadUser(userID string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.users[userID], nil
+}
+
+func (s *memoryStore) DeleteUser(userID string) error {
+	s.Lock()
+	delete(s.users, userID)
+	s.Unlock()
+	return nil
+}
+
+func (s *memoryStore) NextUserNumber() (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.userNumber++
+	return s.userNumber, nil
+}
+
+func (s *memoryStore) ClaimUserKey(index string, key string, userID string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.userKeys[index] == nil {
+		s.userKeys[index] = make(map[string]string)
+	}
+	if owner, ok := s.userKeys[index][key]; ok {
+		return owner, nil
+	}
+	s.userKeys[index][key] = userID
+	return userID, nil
+}
+
+func (s *memoryStore) LookupUserKey(index string, key string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.userKeys[index][key], nil
+}
+
+func (s *memoryStore) ReleaseUserKey(index string, key string, userID string) error {
+	s.Lock()
+	if s.userKeys[index][key] == userID {
+		delete(s.userKeys[index], key)
+	}
+	s.Unlock()
+	return nil
+}
+
+func (s *memoryStore) SaveLoginToken(token string, login []byte, ttl time.Duration) error {
+	s.Lock()
+	s.tokens[token] = loginToken{login, time.Now().Add(ttl)}
+	s.Unlock()
+	return nil
+}
+
+func (s *memoryStore) TakeLoginToken(token string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	t, ok := s.tokens[token]
+	delete(s.tokens, token)
+	if !ok || time.Now().After(t.expiry) {
+		return nil, nil
+	}
+	return t.login, nil
+}
+
+func (s *memoryStore) AddQueueEntry(ticket string, entry []byte) error {
+	s.Lock()
+	s.queue[ticket] = entry
+	s.Unlock()
+	return nil
+}
+
+func (s *memoryStore) UpdateQueueEntry(ticket string, entry []byte) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.queue[ticket]; !ok {
+		return false, nil
+	}
+	s.queue[ticket] = entry
+	return true, nil
+}
+
+func (s *memoryStore) RemoveQueueEntry(ticket string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.queue[ticket]
+	delete(s.queue, ticket)
+	return ok, nil
+}
+
+func (s *memoryStore) ListQueueEntries() ([][]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	entries := make([][]byte, 0, len(s.queue))
+	for _, entry := range s.queue {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (s *memoryStore) ClaimResult(name string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.results[name] {
+		return false, nil
+	}
+	s.results[name] = true
+	return true, nil
+}
+
+func (s *memoryStore) AddMatchRecord(userID string, record []byte) error {
+	s.Lock()
+	records := append(s.records[userID], record)
+	if len(records) > maxMatchRecords {
+		records = records[len(records)-maxMatchRecords:]
+	}
+	s.records[userID] = records
+	s.Unlock()
+	return nil
+}
+
+func (s *memoryStore) ListMatchRecords(userID string) ([][]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	return append([][]byte{}, s.records[userID]...), nil
+}
+
+func (s *memoryStore) DeleteMatchRecords(userID string) error {
+	s.Lock()
+	delete(s.records, userID)
+	s.Unlock()
+	return nil
+}
+
+func (s *memoryStore) AddReplayFrames(name string, frames [][]byte) error {
+	s.Lock()
+	s.replays[name] = append(s.replays[name], frames...)
+	s.Unlock()
+	return nil
+}
+
+func (s *memoryStore) ListReplayFrames(name string) ([][]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	return append([][]byte{}, s.replays[name]...), nil
+}
+
+func (s *memoryStore) SaveReplayAccess(name string, access []byte) error {
+	s.Lock()
+	s.access[name] = access
+	s.Unlock()
+	return nil
+}
+
+func (s *memoryStore) LoadReplayAccess(name string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.access[name], nil
+}
+
+func (s *memoryStore) SaveRating(pool string, userID string, rating []byte) error {
+	s.Lock()
+	if s.ratings[pool] == nil {
+		s.ratings[pool] = make(map[string][]byte)
+	}
+	s.ratings[pool][userID] = rating
+	s.Unlock()
+	return nil
+}
+
+func (s *memoryStore) LoadRating(pool string, userID string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.ratings[pool][userID], nil
+}
+
+func (s *memoryStore) ListRatings(pool string) ([][]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	ratings := make([][]byte, 0, len(s.ratings[pool]))
+	for _, rating := range s.ratings[pool] {
+		ratings = append(ratings, rating)
+	}
+	return ratings, nil
+}
+
+func (s *memoryStore) ListRatingPools() ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	pools := make([]string, 0, len(s.ratings))
+	for pool := range s.ratings {
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
+func (s *memoryStore) DeleteRating(pool string, userID string) error {
+	s.Lock()
+	delete(s.ratings[pool], userID)
+	s.Unlock()
+	return nil
+}
+
+func (s *memoryStore) AddRatingChange(userID string, change []byte) error {
+	s.Lock()
+	changes := append(s.changes[userID], change)
+	if len(changes) > maxRatingChanges {
+		changes = changes[len(changes)-maxRatingChanges:]
+	}
+	s.changes[userID] = changes
+	s.Unlock()
+	return nil
+}
+
+func (s *memoryStore) ListRatingChanges(userID string) ([][]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	return append([][]byte{}, s.changes[userID]...), nil
+}
+
+func (s *memoryStore) DeleteRatingChanges(userID string) error {
+	s.Lock()
+	delete(s.changes, userID)
+	s.Unlock()
+	return nil
+}
+
+// bus for a single instance
+type memoryBus struct {
+	sync.Mutex
+	subscribers map[string]map[chan []byte]bool
+}
+
+func newMemoryBus() *memoryBus {
+	return &memoryBus{subscribers: make(map[string]map[chan []byte]bool)}
+}
+
+func (b *memoryBus) Publish(channel string, message []byte) error {
+	b.Lock()
+	defer b.Unlock()
+	for ch := range b.subscribers[channel] {
+		select {
+		case ch <- message:
+		default:
+			logger.Warn("dropped message to slow subscriber", "channel", channel)
+		}
+	}
+	return nil
+}
+
+func (b *memoryBus) Subscribe(channel string) (<-chan []byte, func(), error) {
+	ch := make(chan []byte, subscriptionBufferSize)
+	b.Lock()
+	if b.subscribers[channel] == nil {
+		b.subscribers[channel] = make(map[chan []byte]bool)
+	}
+	b.subscribers[channel][ch] = true
+	b.Unlock()
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			b.Lock()
+			delete(b.subscribers[channel], ch)
+			if len(b.subscribers[channel]) == 0 {
+				delete(b.subscribers, channel)
+			}
+			b.Unlock()
+			close(ch)
+		})
+	}
+	return ch, unsubscribe, nil
+}
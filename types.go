@@ -3,8 +3,6 @@ package main
 import (
 	"sync"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
 const (
@@ -117,7 +115,31 @@ const nRows = 6
 
 const turnTimer = 50 * int64(time.Second)
 const turnTimerDev = 50 * int64(time.Minute)
-const maxConcurrentMatches = 100
+const clockTickInterval = 250 * time.Millisecond // how often the server checks for turn and time bank expiry
+const maxTimeBank = 60 * int64(time.Minute)
+const maxTimeIncrement = 60 * int64(time.Second)
+const defaultDisconnectGrace = 60 * int64(time.Second) // how long a disconnected player has to return
+const maxDisconnectGrace = 10 * int64(time.Minute)
+const maxSpectators = 50         // per match
+const maxReplayMessages = 200    // per recipient, messages kept for replay to reconnecting clients
+const closeReplacedCode = 4001   // websocket close code for connection superseded by a newer one
+const closeRejectedCode = 4002   // websocket close code for connection refused a seat held by another player
+const closeMatchEndedCode = 4003 // websocket close code for connection to a match the reaper has evicted
+const closeRestartingCode = 4004 // websocket close code for connection closed because the server is restarting
+
+const (
+	sendQueueSize = 64               // outbound messages queued per connection before it's deemed too slow
+	writeWait     = 10 * time.Second // time allowed to write a message
+	pongWait      = 60 * time.Second // time allowed between pongs from peer
+	pingPeriod    = 25 * time.Second // must be less than pongWait
+)
+const maxSpectatorDelay = 5 * int64(time.Minute)
+const maxConcurrentMatches = 100 // per instance
+
+const (
+	leaseTTL         = 15 * time.Second // how long an instance which stops renewing keeps ownership of its matches
+	leaseRenewPeriod = 5 * time.Second  // also how often owned matches are saved to the store
+)
 
 const (
 	nCommandCards = 3
@@ -215,39 +237,106 @@ const (
 
 const matchTimeout = 20 * int64(time.Minute)
 
+// why the match ended
+const (
+	checkmateReason   = "checkmate" // king killed or two vassals killed
+	resignReason      = "resignation"
+	agreementReason   = "agreement" // draw offered and accepted
+	roundLimitReason  = "round limit"
+	timeoutReason     = "timeout"
+	abandonmentReason = "abandonment"
+	crashReason       = "server error" // match aborted because of a panic (see guard)
+	adminReason       = "administrator decision"
+	abortReason       = "administrator abort" // match ended without a result by an administrator
+	declinedReason    = "challenge declined"  // match ended without a result before it started
+)
+
+const maxRoundsLimit = 100 // upper bound on the optional round limit a match creator can set
+
 type Match struct {
-	Name                 string // used to identify the match in browser
-	BlackConn            *websocket.Conn
-	WhiteConn            *websocket.Conn
+	Name                 string  // used to identify the match in browser
+	BlackConn            *Client `json:"-"`
+	WhiteConn            *Client `json:"-"`
 	BlackPlayerID        string
 	WhitePlayerID        string
 	CreatorName          string
-	Mutex                sync.RWMutex
+	Mutex                sync.RWMutex `json:"-"`
 	DevMode              bool
 	Board                Board
-	BoardTemp            Board                          // used for AI scoring
+	BoardTemp            Board                          `json:"-"` // used for AI scoring
 	SquareStatusesDirect [nColumns * nRows]SquareStatus // the status effects applied directly to squares
 	// the status effects on squares from pieces combined with the effects applied directly to the squares
 	// (should be recomputed any time pieces are placed/moved/killed)
-	SquareStatuses     [nColumns * nRows]SquareStatus
-	tempSquareStatuses [nColumns * nRows]SquareStatus // used for AI scoring
-	TurnTimer          int64
-	CommunalCards      []Card // card in pool shared by both players
-	BlackPrivate       PrivateState
-	WhitePrivate       PrivateState
-	BlackPublic        PublicState
-	WhitePublic        PublicState
-	BlackAI            bool
-	WhiteAI            bool
-	Turn               string // white, black
-	FirstTurnColor     string // color of player who had first turn this round
-	MaxRank            int    // max rank card to draw
-	Round              int    // starts at 1
-	Winner             string // white, black, none, draw
-	StartTime          int64  // unix time
-	LastMoveTime       int64  // should be initialized to match start time
-	Log                []string
-	Phase              Phase
+	SquareStatuses        [nColumns * nRows]SquareStatus
+	tempSquareStatuses    [nColumns * nRows]SquareStatus // used for AI scoring
+	TurnTimer             int64
+	TimeBank              int64 // total time per player in nanoseconds (0 for no total time clock)
+	TimeIncrement         int64 // added to player's time bank after each of their turns
+	WhiteTimeBank         int64 // remaining as of start of current turn
+	BlackTimeBank         int64
+	DisconnectGrace       int64  // nanoseconds a disconnected player has to reconnect
+	DisconnectPolicy      string // forfeit or ai
+	WhiteDisconnectTime   int64  // unix nano time of disconnect; 0 if connected (or never connected)
+	BlackDisconnectTime   int64
+	WhiteAITakeover       bool // true if AI is playing white in place of a disconnected player
+	BlackAITakeover       bool
+	Spectators            map[*Client]bool `json:"-"`
+	SpectatorDelay        int64            // nanoseconds spectators' view lags behind the match
+	spectatorBacklog      []delayedMessage // messages not yet sent because of the delay
+	lastSpectatorSnapshot []byte           // snapshot as of the most recent message sent to spectators (sent to new spectators)
+	whiteView             *clientView      // what each recipient was last sent (nil if nothing yet)
+	blackView             *clientView
+	spectatorView         *clientView
+	whiteOutbox           outbox // messages sent to each recipient, kept for replay
+	blackOutbox           outbox
+	spectatorOutbox       outbox
+	CommunalCards         []Card // card in pool shared by both players
+	BlackPrivate          PrivateState
+	WhitePrivate          PrivateState
+	BlackPublic           PublicState
+	WhitePublic           PublicState
+	BlackAI               bool
+	WhiteAI               bool
+	AILevel               string // easy or normal (of the AI player, not of an AI taking over for a disconnected player)
+	Turn                  string // white, black
+	FirstTurnColor        string // color of player who had first turn this round
+	MaxRank               int    // max rank card to draw
+	Round                 int    // starts at 1
+	Winner                string // white, black, none, draw
+	EndReason             string // set when match enters gameover phase
+	DrawOffer             string // color of player with an outstanding draw offer, or none
+	MaxRounds             int    // if above 0, match ends after this round and winner is decided by tiebreak
+	Rated                 bool   // result counts toward the players' ratings
+	ChallengedID          string // user challenged to the match by its creator (see bots.go); "" if not a challenge
+	Private               bool   // left out of the lobby: seat taken only through the invite link
+	InviteToken           string // "" unless private or password protected
+	PasswordHash          string // bcrypt hash ("" if no password)
+	RematchOffer          string // color of player who asked for a rematch, or none
+	RematchAccepted       bool
+	Rematch               string // name of the rematch once created
+	Series                Series // results of earlier matches in the series of rematches
+	rematchStarting       bool
+	Chat                  []ChatMessage // between the players
+	SpectatorChat         []ChatMessage // between the spectators (not seen by players)
+	WhiteMutedOpponent    bool
+	BlackMutedOpponent    bool
+	whiteChatLimiter      chatLimiter
+	blackChatLimiter      chatLimiter
+	spectatorChatLimiters map[*Client]*chatLimiter
+	StartTime             int64 // unix nano time play began (until both players are ready, the time the match was created)
+	LastMoveTime          int64 // should be initialized to match start time
+	EndTime               int64 // unix nano time the match ended; 0 if not over
+	RoundStartTime        int64 // unix nano time the current round started
+	ShutdownTime          int64 // unix nano time the match was handed off at shutdown; 0 while running
+	Log                   []string
+	Phase                 Phase
+	WhiteCardsPlayed      map[string]int // card name -> times played
+	BlackCardsPlayed      map[string]int
+	ReplayLogLength       int      // length of the log as of the last replay frame
+	replayFrames          [][]byte // replay frames not yet added to the store
+	saveMutex             sync.Mutex
+	disowned              bool // another instance has taken over the match, so this instance no longer runs it
+	reaped                bool // evicted by the reaper, so no longer runs or is saved
 }
 
 type Board struct {
@@ -348,8 +437,3 @@ type MatchMap struct {
 	sync.RWMutex
 	internal map[string]*Match
 }
-
-type UserMap struct {
-	sync.RWMutex
-	internal map[string]bool
-}